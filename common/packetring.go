@@ -0,0 +1,101 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// A captured frame, as read from the capture handle.
+type RingFrame struct {
+	Ts     time.Time
+	Data   []byte
+	Length int // of the frame on the wire
+}
+
+// The frames of a packet ring when an event was published, the oldest
+// first.
+type RingFrames struct {
+	Stream   uint32
+	Datalink int
+	Frames   []RingFrame
+}
+
+// The last frames of a TCP connection. A snapshot of them is added to
+// the events of the connection, so that they can be dumped for the
+// transactions that fail. The events can be published from another
+// goroutine than the one adding the frames.
+type PacketRing struct {
+	stream   uint32
+	datalink int // pcap link type of the frames
+
+	mutex  sync.Mutex
+	frames []RingFrame
+	next   int // oldest frame, once the ring is full
+	bytes  int
+}
+
+func NewPacketRing(size int, stream uint32) *PacketRing {
+	return &PacketRing{
+		stream:   stream,
+		datalink: -1,
+		frames:   make([]RingFrame, 0, size),
+	}
+}
+
+// Adds a frame, replacing the oldest one when the ring is full. The
+// frames of another link type than the first frame are ignored. The
+// data is not copied, it must not be modified afterwards.
+func (ring *PacketRing) Add(ts time.Time, data []byte, length int, datalink int) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	if ring.datalink < 0 {
+		ring.datalink = datalink
+	} else if datalink != ring.datalink {
+		return
+	}
+
+	frame := RingFrame{Ts: ts, Data: data, Length: length}
+	if len(ring.frames) < cap(ring.frames) {
+		ring.frames = append(ring.frames, frame)
+	} else {
+		ring.bytes -= len(ring.frames[ring.next].Data)
+		ring.frames[ring.next] = frame
+		ring.next = (ring.next + 1) % len(ring.frames)
+	}
+	ring.bytes += len(data)
+}
+
+// Returns the number of bytes of the frames held by the ring.
+func (ring *PacketRing) Bytes() int {
+	if ring == nil {
+		return 0
+	}
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	return ring.bytes
+}
+
+// Returns a copy of the frames currently in the ring.
+func (ring *PacketRing) Frames() *RingFrames {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	frames := make([]RingFrame, 0, len(ring.frames))
+	frames = append(frames, ring.frames[ring.next:]...)
+	frames = append(frames, ring.frames[:ring.next]...)
+	return &RingFrames{
+		Stream:   ring.stream,
+		Datalink: ring.datalink,
+		Frames:   frames,
+	}
+}
+
+// Adds the frames to the event, in the packet_ring field that the
+// publisher removes.
+func (ring *PacketRing) AddFields(event MapStr) {
+	if ring == nil {
+		return
+	}
+	event["packet_ring"] = ring.Frames()
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketRing_frames(t *testing.T) {
+	ring := NewPacketRing(3, 42)
+	ts := time.Now()
+
+	for i := 0; i < 5; i++ {
+		ring.Add(ts.Add(time.Duration(i)*time.Second), make([]byte, 10+i), 100, 1)
+	}
+	// frames of another link type are ignored
+	ring.Add(ts, make([]byte, 10), 10, 113)
+
+	assert.Equal(t, 12+13+14, ring.Bytes())
+
+	frames := ring.Frames()
+	assert.Equal(t, uint32(42), frames.Stream)
+	assert.Equal(t, 1, frames.Datalink)
+	assert.Equal(t, 3, len(frames.Frames))
+	for i, frame := range frames.Frames {
+		assert.Equal(t, 12+i, len(frame.Data))
+		assert.Equal(t, 100, frame.Length)
+		assert.Equal(t, ts.Add(time.Duration(2+i)*time.Second), frame.Ts)
+	}
+
+	// the snapshot doesn't change with the ring
+	ring.Add(ts, make([]byte, 20), 20, 1)
+	assert.Equal(t, 12, len(frames.Frames[0].Data))
+}
+
+func TestPacketRing_AddFields(t *testing.T) {
+	tuple := TcpTuple{}
+	event := MapStr{}
+	tuple.AddFields(event)
+	assert.Equal(t, MapStr{}, event)
+
+	tuple.Packets = NewPacketRing(10, 1)
+	tuple.Packets.Add(time.Now(), []byte{1, 2, 3}, 3, 1)
+	tuple.AddFields(event)
+	frames, ok := event["packet_ring"].(*RingFrames)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(frames.Frames))
+}
@@ -2,7 +2,9 @@ package common
 
 import (
 	"fmt"
+	"hash/fnv"
 	"net"
+	"time"
 )
 
 // In order for the IpPortTuple and the TcpTuple to be used as
@@ -10,8 +12,14 @@ import (
 // net.IP is problematic because it's internally represented as a slice.
 // We're introducing the HashableIpPortTuple and the HashableTcpTuple
 // types which are internally simple byte arrays.
+//
+// The VLAN ID and the capture device are part of the hashable values,
+// so that the same addresses and ports on two VLANs, which may be
+// distinct networks with overlapping addresses, or seen on two devices
+// are followed separately. The device is represented by the hash of
+// its name.
 
-const MaxIpPortTupleRawSize = 16 + 16 + 2 + 2
+const MaxIpPortTupleRawSize = 16 + 16 + 2 + 2 + 2 + 4
 
 type HashableIpPortTuple [MaxIpPortTupleRawSize]byte
 
@@ -20,8 +28,16 @@ type IpPortTuple struct {
 	Src_ip, Dst_ip     net.IP
 	Src_port, Dst_port uint16
 
-	raw    HashableIpPortTuple // Src_ip:Src_port:Dst_ip:Dst_port
-	revRaw HashableIpPortTuple // Dst_ip:Dst_port:Src_ip:Src_port
+	// ID of the outermost 802.1Q tag of the packet, zero when the
+	// packet isn't tagged.
+	Vlan uint16
+
+	// Name of the device the packet was captured on, empty when it was
+	// read from a file.
+	Device string
+
+	raw    HashableIpPortTuple // Src_ip:Src_port:Dst_ip:Dst_port:Vlan:Device
+	revRaw HashableIpPortTuple // Dst_ip:Dst_port:Src_ip:Src_port:Vlan:Device
 }
 
 func NewIpPortTuple(ip_length int, src_ip net.IP, src_port uint16,
@@ -49,6 +65,20 @@ func (t *IpPortTuple) ComputeHashebles() {
 	copy(t.revRaw[16:18], []byte{byte(t.Dst_port >> 8), byte(t.Dst_port)})
 	copy(t.revRaw[18:34], t.Src_ip)
 	copy(t.revRaw[34:36], []byte{byte(t.Src_port >> 8), byte(t.Src_port)})
+
+	putVlanDevice(t.raw[36:42], t.Vlan, t.Device)
+	copy(t.revRaw[36:42], t.raw[36:42])
+}
+
+// Writes the VLAN ID and the hash of the device name to the 6 bytes of
+// the hashable value.
+func putVlanDevice(raw []byte, vlan uint16, device string) {
+	h := fnv.New32a()
+	h.Write([]byte(device))
+	dev := h.Sum32()
+
+	copy(raw, []byte{byte(vlan >> 8), byte(vlan),
+		byte(dev >> 24), byte(dev >> 16), byte(dev >> 8), byte(dev)})
 }
 
 func (t *IpPortTuple) String() string {
@@ -59,6 +89,17 @@ func (t *IpPortTuple) String() string {
 		t.Dst_port)
 }
 
+// Adds to the event the VLAN ID of the packets, if tagged, and the
+// device they were captured on.
+func (t *IpPortTuple) AddFields(event MapStr) {
+	if t.Vlan != 0 {
+		event["vlan"] = t.Vlan
+	}
+	if len(t.Device) > 0 {
+		event["device"] = t.Device
+	}
+}
+
 // Hashable returns a hashable value that uniquely identifies
 // the IP-port tuple.
 func (t *IpPortTuple) Hashable() HashableIpPortTuple {
@@ -71,7 +112,7 @@ func (t *IpPortTuple) RevHashable() HashableIpPortTuple {
 	return t.revRaw
 }
 
-const MaxTcpTupleRawSize = 16 + 16 + 2 + 2 + 4
+const MaxTcpTupleRawSize = 16 + 16 + 2 + 2 + 4 + 2 + 4
 
 type HashableTcpTuple [MaxTcpTupleRawSize]byte
 
@@ -80,8 +121,39 @@ type TcpTuple struct {
 	Src_ip, Dst_ip     net.IP
 	Src_port, Dst_port uint16
 	Stream_id          uint32
+	Vlan               uint16
+	Device             string
+
+	// set when the start of the connection was captured
+	Handshake *TcpHandshake
+
+	// set when the packets of the connection are kept for the dumps
+	Packets *PacketRing
 
-	raw HashableTcpTuple // Src_ip:Src_port:Dst_ip:Dst_port:stream_id
+	raw HashableTcpTuple // Src_ip:Src_port:Dst_ip:Dst_port:stream_id:Vlan:Device
+}
+
+// Capture times of the packets of the TCP three-way handshake. The
+// times of the packets that weren't seen are zero.
+type TcpHandshake struct {
+	Syn    time.Time
+	SynAck time.Time
+	Ack    time.Time
+}
+
+// Adds to the event the time it took to establish the connection and
+// the round-trip times, in microseconds, from the sniffer to the server
+// (SYN to SYN-ACK) and to the client (SYN-ACK to ACK).
+func (h *TcpHandshake) AddFields(event MapStr) {
+	if h == nil || h.SynAck.IsZero() || h.Ack.IsZero() {
+		return
+	}
+
+	event["rtt_client"] = int32(h.Ack.Sub(h.SynAck).Nanoseconds() / 1e3)
+	if !h.Syn.IsZero() {
+		event["rtt_server"] = int32(h.SynAck.Sub(h.Syn).Nanoseconds() / 1e3)
+		event["connect_time"] = int32(h.Ack.Sub(h.Syn).Nanoseconds() / 1e3)
+	}
 }
 
 func TcpTupleFromIpPort(t *IpPortTuple, tcp_id uint32) TcpTuple {
@@ -92,6 +164,8 @@ func TcpTupleFromIpPort(t *IpPortTuple, tcp_id uint32) TcpTuple {
 		Src_port:  t.Src_port,
 		Dst_port:  t.Dst_port,
 		Stream_id: tcp_id,
+		Vlan:      t.Vlan,
+		Device:    t.Device,
 	}
 	tuple.ComputeHashebles()
 
@@ -105,6 +179,7 @@ func (t *TcpTuple) ComputeHashebles() {
 	copy(t.raw[34:36], []byte{byte(t.Dst_port >> 8), byte(t.Dst_port)})
 	copy(t.raw[36:40], []byte{byte(t.Stream_id >> 24), byte(t.Stream_id >> 16),
 		byte(t.Stream_id >> 8), byte(t.Stream_id)})
+	putVlanDevice(t.raw[40:46], t.Vlan, t.Device)
 }
 
 func (t TcpTuple) String() string {
@@ -120,9 +195,25 @@ func (t TcpTuple) String() string {
 func (t TcpTuple) IpPort() *IpPortTuple {
 	ipport := NewIpPortTuple(t.Ip_length, t.Src_ip, t.Src_port,
 		t.Dst_ip, t.Dst_port)
+	ipport.Vlan = t.Vlan
+	ipport.Device = t.Device
+	ipport.ComputeHashebles()
 	return &ipport
 }
 
+// Adds to the event the VLAN ID, the capture device and the handshake
+// times of the connection.
+func (t *TcpTuple) AddFields(event MapStr) {
+	if t.Vlan != 0 {
+		event["vlan"] = t.Vlan
+	}
+	if len(t.Device) > 0 {
+		event["device"] = t.Device
+	}
+	t.Handshake.AddFields(event)
+	t.Packets.AddFields(event)
+}
+
 // Hashable() returns a hashable value that uniquely identifies
 // the TCP tuple.
 func (t *TcpTuple) Hashable() HashableTcpTuple {
@@ -3,6 +3,7 @@ package common
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,7 +25,7 @@ func TestTuples_tuples_ipv4(t *testing.T) {
 	assert.Equal(v4InV6Prefix, tuple.raw[18:30], "prefix_dst")
 	assert.Equal([]byte{192, 168, 0, 2}, tuple.raw[30:34], "dst_ip")
 	assert.Equal([]byte{0x23, 0xf1}, tuple.raw[34:36], "dst_port")
-	assert.Equal(36, len(tuple.raw))
+	assert.Equal(42, len(tuple.raw))
 
 	assert.Equal(v4InV6Prefix, tuple.revRaw[0:12], "rev prefix_dst")
 	assert.Equal([]byte{192, 168, 0, 2}, tuple.revRaw[12:16], "rev dst_ip")
@@ -33,13 +34,34 @@ func TestTuples_tuples_ipv4(t *testing.T) {
 	assert.Equal(v4InV6Prefix, tuple.revRaw[18:30], "rev prefix_src")
 	assert.Equal([]byte{192, 168, 0, 1}, tuple.revRaw[30:34], "rev src_ip")
 	assert.Equal([]byte{0x23, 0xf0}, tuple.revRaw[34:36], "rev src_port")
-	assert.Equal(36, len(tuple.revRaw))
+	assert.Equal(42, len(tuple.revRaw))
 
 	tcp_tuple := TcpTupleFromIpPort(&tuple, 1)
-	assert.Equal(tuple.raw[:], tcp_tuple.raw[0:36], "Wrong TCP tuple hashable")
+	assert.Equal(tuple.raw[0:36], tcp_tuple.raw[0:36], "Wrong TCP tuple hashable")
 	assert.Equal([]byte{0, 0, 0, 1}, tcp_tuple.raw[36:40], "stream_id")
 }
 
+func TestTuples_vlanAndDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	tuple := NewIpPortTuple(4, net.IPv4(192, 168, 0, 1), 9200, net.IPv4(192, 168, 0, 2), 9201)
+	other := tuple
+	other.Vlan = 10
+	other.ComputeHashebles()
+	assert.NotEqual(tuple.Hashable(), other.Hashable())
+	assert.Equal(other.raw[36:42], other.revRaw[36:42])
+
+	other = tuple
+	other.Device = "eth1"
+	other.ComputeHashebles()
+	assert.NotEqual(tuple.Hashable(), other.Hashable())
+
+	tcp_tuple := TcpTupleFromIpPort(&other, 1)
+	assert.Equal(other.Hashable(), tcp_tuple.IpPort().Hashable())
+	orig_tuple := TcpTupleFromIpPort(&tuple, 1)
+	assert.NotEqual(orig_tuple.Hashable(), tcp_tuple.Hashable())
+}
+
 func TestTuples_tuples_ipv6(t *testing.T) {
 	assert := assert.New(t)
 
@@ -56,16 +78,41 @@ func TestTuples_tuples_ipv6(t *testing.T) {
 
 	assert.Equal(ip2, tuple.raw[18:34], "dst_ip")
 	assert.Equal([]byte{0x23, 0xf1}, tuple.raw[34:36], "dst_port")
-	assert.Equal(36, len(tuple.raw))
+	assert.Equal(42, len(tuple.raw))
 
 	assert.Equal(ip2, tuple.revRaw[0:16], "rev dst_ip")
 	assert.Equal([]byte{0x23, 0xf1}, tuple.revRaw[16:18], "rev dst_port")
 
 	assert.Equal(ip1, tuple.revRaw[18:34], "rev src_ip")
 	assert.Equal([]byte{0x23, 0xf0}, tuple.revRaw[34:36], "rev src_port")
-	assert.Equal(36, len(tuple.revRaw))
+	assert.Equal(42, len(tuple.revRaw))
 
 	tcp_tuple := TcpTupleFromIpPort(&tuple, 1)
-	assert.Equal(tuple.raw[:], tcp_tuple.raw[0:36], "Wrong TCP tuple hashable")
+	assert.Equal(tuple.raw[0:36], tcp_tuple.raw[0:36], "Wrong TCP tuple hashable")
 	assert.Equal([]byte{0, 0, 0, 1}, tcp_tuple.raw[36:40], "stream_id")
 }
+
+func TestTcpHandshake_AddFields(t *testing.T) {
+	ts := time.Date(2015, 3, 6, 12, 0, 0, 0, time.UTC)
+
+	event := MapStr{}
+	var none *TcpHandshake
+	none.AddFields(event)
+	assert.Equal(t, 0, len(event))
+
+	h := TcpHandshake{
+		Syn:    ts,
+		SynAck: ts.Add(1500 * time.Microsecond),
+		Ack:    ts.Add(1700 * time.Microsecond),
+	}
+	h.AddFields(event)
+	assert.Equal(t, int32(1500), event["rtt_server"])
+	assert.Equal(t, int32(200), event["rtt_client"])
+	assert.Equal(t, int32(1700), event["connect_time"])
+
+	// the SYN wasn't captured
+	event = MapStr{}
+	h.Syn = time.Time{}
+	h.AddFields(event)
+	assert.Equal(t, MapStr{"rtt_client": int32(200)}, event)
+}
@@ -1,6 +1,10 @@
 package config
 
-import "github.com/BurntSushi/toml"
+import (
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
 
 type Config struct {
 	Interfaces InterfacesConfig
@@ -14,24 +18,45 @@ type Config struct {
 	Passwords  Passwords
 	Thrift     Thrift
 	Http       Http
+	Tcp        Tcp
+	Ip         Ip
+	Flows      Flows
 	Geoip      Geoip
 	Udpjson    Udpjson
+	Pcapdir    Pcapdir
+	Dumps      Dumps
 	Filter     map[string]interface{}
 }
 
 type InterfacesConfig struct {
-	Device         string
-	Devices        []string
-	Type           string
-	File           string
-	With_vlans     bool
-	Bpf_filter     string
-	Snaplen        int
-	Buffer_size_mb int
-	TopSpeed       bool
-	Dumpfile       string
-	OneAtATime     bool
-	Loop           int
+	Device             string
+	Devices            []string
+	Type               string
+	File               string
+	With_vlans         bool
+	With_tunnels       bool
+	Bpf_filter         string
+	Replace_bpf_filter bool
+	Snaplen            int
+	Buffer_size_mb     int
+	Fanout             string
+	Fanout_readers     int
+	Fanout_group       int
+	Stats_interval     int
+	Drop_threshold     float64
+	TopSpeed           bool
+	KeepTimestamps     bool
+	Speed              float64
+	StartTime          time.Time
+	EndTime            time.Time
+	Dumpfile           string
+	Dump_rotate_kb     int
+	Dump_interval      int
+	Dump_keep_files    int
+	Dump_snaplen       int
+	Dump_protocols     bool
+	OneAtATime         bool
+	Loop               int
 }
 
 type Input struct {
@@ -57,9 +82,15 @@ type Geoip struct {
 }
 
 type Protocol struct {
-	Ports         []int
-	Send_request  bool
-	Send_response bool
+	Ports               []int
+	Port_ranges         []string
+	Hosts               []string
+	Networks            []string
+	Exclude_hosts       []string
+	Exclude_networks    []string
+	Send_request        bool
+	Send_response       bool
+	Transaction_timeout int
 }
 
 type Http struct {
@@ -70,6 +101,26 @@ type Http struct {
 	Include_body_for []string
 }
 
+type Flows struct {
+	Enabled   bool
+	All_ports bool
+}
+
+type Tcp struct {
+	Reassembly_buffer_kb int
+	Reassembly_timeout   int
+	Workers              int
+	Detect_protocols     bool
+	Detect_max_bytes     int
+	Memory_budget_mb     int
+	Stream_timeout       int
+}
+
+type Ip struct {
+	Defrag_buffer_kb int
+	Defrag_timeout   int
+}
+
 type Thrift struct {
 	String_max_size            int
 	Collection_max_size        int
@@ -127,6 +178,24 @@ type Udpjson struct {
 	Timeout int
 }
 
+type Pcapdir struct {
+	Path           string
+	Pattern        string
+	State_file     string
+	Min_age        int
+	Scan_interval  int
+	Wait_next_file bool
+	Delete         bool
+	Move_to        string
+}
+
+type Dumps struct {
+	Path       string
+	Ring_size  int
+	Keep_files int
+	Conditions []string
+}
+
 // Config Singleton
 var ConfigSingleton Config
 
@@ -0,0 +1,106 @@
+package dumps
+
+import (
+	"fmt"
+	"packetbeat/common"
+	"strconv"
+	"strings"
+)
+
+// A comparison of a field of the events with a value, like
+// "status=Error", "http.code>=500" or "method!=GET". The fields of the
+// nested objects are separated by dots. The values are compared as
+// numbers when both are numbers, and as strings otherwise.
+type Condition struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// Operators, the longer first so that they are matched before their
+// prefixes.
+var conditionOps = []string{"!=", ">=", "<=", "=", ">", "<"}
+
+func ParseCondition(expr string) (*Condition, error) {
+	i := strings.IndexAny(expr, "!=<>")
+	if i > 0 {
+		for _, op := range conditionOps {
+			if strings.HasPrefix(expr[i:], op) {
+				cond := &Condition{
+					Field: strings.TrimSpace(expr[:i]),
+					Op:    op,
+					Value: strings.TrimSpace(expr[i+len(op):]),
+				}
+				if len(cond.Field) > 0 {
+					return cond, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("Invalid condition %q, expected field=value, "+
+		"field!=value, field>value, field>=value, field<value or field<=value", expr)
+}
+
+func (cond *Condition) String() string {
+	return cond.Field + cond.Op + cond.Value
+}
+
+// Returns true if the event has the field and its value satisfies the
+// condition.
+func (cond *Condition) Match(event common.MapStr) bool {
+	value, ok := lookupField(event, cond.Field)
+	if !ok {
+		return false
+	}
+	str := fmt.Sprint(value)
+
+	cmp := 0
+	a, errA := strconv.ParseFloat(str, 64)
+	b, errB := strconv.ParseFloat(cond.Value, 64)
+	if errA == nil && errB == nil {
+		if a < b {
+			cmp = -1
+		} else if a > b {
+			cmp = 1
+		}
+	} else if str < cond.Value {
+		cmp = -1
+	} else if str > cond.Value {
+		cmp = 1
+	}
+
+	switch cond.Op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// Returns the value of the field, looked up in the nested objects of the
+// event for the names with dots.
+func lookupField(event common.MapStr, field string) (interface{}, bool) {
+	var value interface{} = event
+	for _, key := range strings.Split(field, ".") {
+		var ok bool
+		switch m := value.(type) {
+		case common.MapStr:
+			value, ok = m[key]
+		case map[string]interface{}:
+			value, ok = m[key]
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
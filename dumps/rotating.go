@@ -0,0 +1,146 @@
+package dumps
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+	"github.com/packetbeat/gopacket/pcap"
+)
+
+const RotatorMaxFiles = 1000
+
+// Sizes of the headers of the pcap format.
+const (
+	pcapFileHeaderSize   = 24
+	pcapPacketHeaderSize = 16
+)
+
+// Writes the captured packets to a pcap file, which is rotated when it
+// reaches RotateEveryBytes or when its first packet is older than
+// RotateInterval, in capture time. Like with the file output, the
+// current file is Name and the rotated ones are numbered from 1, the
+// highest being the oldest: dump.pcap, dump.1.pcap, dump.2.pcap. At most
+// KeepFiles files are kept, including the current one. A zero
+// RotateEveryBytes or RotateInterval disables the rotation on it.
+type RotatingDumper struct {
+	Path             string
+	Name             string
+	Datalink         layers.LinkType
+	Snaplen          int
+	RotateEveryBytes uint64
+	RotateInterval   time.Duration
+	KeepFiles        int
+
+	current      *pcap.Dumper
+	current_size uint64
+	opened       time.Time
+}
+
+func (dumper *RotatingDumper) CheckIfConfigSane() error {
+	if dumper.KeepFiles < 1 || dumper.KeepFiles >= RotatorMaxFiles {
+		return fmt.Errorf("The number of dump files to keep should be between 1 and %d",
+			RotatorMaxFiles-1)
+	}
+	if dumper.Snaplen <= 0 {
+		return fmt.Errorf("Invalid snaplen of the dump: %d", dumper.Snaplen)
+	}
+	return nil
+}
+
+// Writes the packet, cut to the snaplen of the dump, rotating the file
+// first if needed.
+func (dumper *RotatingDumper) WritePacketData(data []byte, ci gopacket.CaptureInfo) error {
+	if len(data) > dumper.Snaplen {
+		data = data[:dumper.Snaplen]
+	}
+	ci.CaptureLength = len(data)
+
+	if dumper.shouldRotate(ci.Timestamp) {
+		err := dumper.Rotate(ci.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := dumper.current.WritePacketData(data, ci)
+	if err != nil {
+		return err
+	}
+	dumper.current_size += uint64(pcapPacketHeaderSize + len(data))
+	return nil
+}
+
+func (dumper *RotatingDumper) shouldRotate(ts time.Time) bool {
+	if dumper.current == nil {
+		return true
+	}
+	if dumper.RotateEveryBytes > 0 && dumper.current_size >= dumper.RotateEveryBytes {
+		return true
+	}
+	if dumper.RotateInterval > 0 && ts.Sub(dumper.opened) >= dumper.RotateInterval {
+		return true
+	}
+	return false
+}
+
+func (dumper *RotatingDumper) FilePath(file_no int) string {
+	if file_no == 0 {
+		return filepath.Join(dumper.Path, dumper.Name)
+	}
+	ext := filepath.Ext(dumper.Name)
+	filename := strings.Join([]string{strings.TrimSuffix(dumper.Name, ext),
+		strconv.Itoa(file_no)}, ".") + ext
+	return filepath.Join(dumper.Path, filename)
+}
+
+func (dumper *RotatingDumper) FileExists(file_no int) bool {
+	_, err := os.Stat(dumper.FilePath(file_no))
+	return !os.IsNotExist(err)
+}
+
+// Closes the current file, shifts the numbers of the previous ones and
+// starts a new file, whose first packet has the given timestamp.
+func (dumper *RotatingDumper) Rotate(ts time.Time) error {
+	if dumper.current != nil {
+		dumper.current.Close()
+		dumper.current = nil
+	}
+
+	// shift all files from last to first, the last one is
+	// overwritten
+	for file_no := dumper.KeepFiles - 2; file_no >= 0; file_no-- {
+		if !dumper.FileExists(file_no) {
+			continue
+		}
+		err := os.Rename(dumper.FilePath(file_no), dumper.FilePath(file_no+1))
+		if err != nil {
+			return err
+		}
+	}
+
+	handle, err := pcap.OpenDead(dumper.Datalink, int32(dumper.Snaplen))
+	if err != nil {
+		return err
+	}
+	dumper.current, err = handle.NewDumper(dumper.FilePath(0))
+	if err != nil {
+		return err
+	}
+	dumper.current_size = pcapFileHeaderSize
+	dumper.opened = ts
+
+	return nil
+}
+
+func (dumper *RotatingDumper) Close() {
+	if dumper.current != nil {
+		dumper.current.Close()
+		dumper.current = nil
+	}
+}
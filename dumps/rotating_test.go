@@ -0,0 +1,121 @@
+package dumps
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+	"github.com/packetbeat/gopacket/pcap"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRotatingDumper(t *testing.T) (*RotatingDumper, func()) {
+	dir, err := ioutil.TempDir("", "rotating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dumper := &RotatingDumper{
+		Path:      dir,
+		Name:      "dump.pcap",
+		Datalink:  layers.LinkTypeEthernet,
+		Snaplen:   100,
+		KeepFiles: 3,
+	}
+	assert.Nil(t, dumper.CheckIfConfigSane())
+	return dumper, func() { os.RemoveAll(dir) }
+}
+
+// Returns the lengths of the packets of the dump file.
+func testReadDump(t *testing.T, path string) []int {
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+
+	lengths := []int{}
+	for {
+		data, _, err := handle.ReadPacketData()
+		if err == io.EOF {
+			return lengths
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lengths = append(lengths, len(data))
+	}
+}
+
+func TestRotatingDumper_FilePath(t *testing.T) {
+	dumper := RotatingDumper{Path: "/tmp", Name: "dump.pcap"}
+	assert.Equal(t, "/tmp/dump.pcap", dumper.FilePath(0))
+	assert.Equal(t, "/tmp/dump.2.pcap", dumper.FilePath(2))
+
+	dumper.Name = "dump"
+	assert.Equal(t, "/tmp/dump.1", dumper.FilePath(1))
+}
+
+func TestRotatingDumper_rotateBySize(t *testing.T) {
+	dumper, cleanup := testRotatingDumper(t)
+	defer cleanup()
+	// the file header and two packets
+	dumper.RotateEveryBytes = 24 + 2*(16+100)
+
+	ts := time.Now()
+	for i := 0; i < 7; i++ {
+		ci := gopacket.CaptureInfo{Timestamp: ts, Length: 150}
+		err := dumper.WritePacketData(make([]byte, 150), ci)
+		assert.Nil(t, err)
+	}
+	dumper.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dumper.Path, "*"))
+	assert.Equal(t, 3, len(files))
+	assert.Equal(t, []int{100}, testReadDump(t, dumper.FilePath(0)))
+	assert.Equal(t, []int{100, 100}, testReadDump(t, dumper.FilePath(1)))
+	assert.Equal(t, []int{100, 100}, testReadDump(t, dumper.FilePath(2)))
+}
+
+func TestRotatingDumper_rotateByInterval(t *testing.T) {
+	dumper, cleanup := testRotatingDumper(t)
+	defer cleanup()
+	dumper.RotateInterval = time.Minute
+
+	ts := time.Now()
+	for _, offset := range []time.Duration{0, 30, 59, 60, 90, 150} {
+		ci := gopacket.CaptureInfo{Timestamp: ts.Add(offset * time.Second), Length: 10}
+		err := dumper.WritePacketData(make([]byte, 10), ci)
+		assert.Nil(t, err)
+	}
+	dumper.Close()
+
+	assert.Equal(t, []int{10}, testReadDump(t, dumper.FilePath(0)))
+	assert.Equal(t, []int{10, 10}, testReadDump(t, dumper.FilePath(1)))
+	assert.Equal(t, []int{10, 10, 10}, testReadDump(t, dumper.FilePath(2)))
+}
+
+func TestRotatingDumper_previousRun(t *testing.T) {
+	dumper, cleanup := testRotatingDumper(t)
+	defer cleanup()
+
+	ioutil.WriteFile(dumper.FilePath(0), []byte("previous"), 0644)
+	err := dumper.WritePacketData(make([]byte, 10), gopacket.CaptureInfo{Length: 10})
+	assert.Nil(t, err)
+	dumper.Close()
+
+	data, err := ioutil.ReadFile(dumper.FilePath(1))
+	assert.Nil(t, err)
+	assert.Equal(t, "previous", string(data))
+}
+
+func TestRotatingDumper_config(t *testing.T) {
+	dumper := RotatingDumper{KeepFiles: 0, Snaplen: 100}
+	assert.NotNil(t, dumper.CheckIfConfigSane())
+	dumper = RotatingDumper{KeepFiles: 1, Snaplen: 0}
+	assert.NotNil(t, dumper.CheckIfConfigSane())
+}
@@ -0,0 +1,168 @@
+package dumps
+
+import (
+	"fmt"
+	"os"
+	"packetbeat/common"
+	"packetbeat/config"
+	"packetbeat/logp"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+	"github.com/packetbeat/gopacket/pcap"
+)
+
+// Defaults for the frames kept per TCP connection and for the files kept
+// in the dumps directory.
+const DEFAULT_RING_SIZE = 50
+const DEFAULT_KEEP_FILES = 100
+
+// Writes the last frames of a TCP connection to a pcap file when one of
+// its transactions matches a condition, by default when it fails. The
+// files are written in a directory, in which the oldest are deleted to
+// keep at most KeepFiles of them.
+type TriggeredDumper struct {
+	Path       string
+	RingSize   int
+	KeepFiles  int
+	Conditions []*Condition
+
+	// the dumped files, the oldest first
+	files []string
+	count int
+}
+
+var Triggered TriggeredDumper
+
+func (dumper *TriggeredDumper) Init(config *config.Dumps) error {
+	if len(config.Path) == 0 {
+		// disabled
+		return nil
+	}
+	dumper.Path = config.Path
+
+	dumper.RingSize = config.Ring_size
+	if dumper.RingSize <= 0 {
+		dumper.RingSize = DEFAULT_RING_SIZE
+	}
+	dumper.KeepFiles = config.Keep_files
+	if dumper.KeepFiles <= 0 {
+		dumper.KeepFiles = DEFAULT_KEEP_FILES
+	}
+
+	conditions := config.Conditions
+	if len(conditions) == 0 {
+		conditions = []string{"status=" + common.ERROR_STATUS}
+	}
+	dumper.Conditions = nil
+	for _, expr := range conditions {
+		cond, err := ParseCondition(expr)
+		if err != nil {
+			return err
+		}
+		dumper.Conditions = append(dumper.Conditions, cond)
+	}
+
+	err := os.MkdirAll(dumper.Path, 0755)
+	if err != nil {
+		return err
+	}
+
+	// the files of the previous runs count in the files kept
+	dumper.files, err = filepath.Glob(filepath.Join(dumper.Path, "*.pcap"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(dumper.files)
+
+	logp.Info("Dumping the last %d packets of the TCP connections to %s, when %s",
+		dumper.RingSize, dumper.Path, conditions)
+	return nil
+}
+
+// Returns true if the frames of the TCP connections are to be kept.
+func (dumper *TriggeredDumper) Enabled() bool {
+	return dumper.RingSize > 0
+}
+
+// Called by the publisher for each event. Removes the frames added to
+// the event by its TCP tuple and writes them to a file if the event
+// matches one of the conditions. The name of the file is then set in
+// the pcap_file field.
+func (dumper *TriggeredDumper) HandleEvent(event common.MapStr) {
+	frames, ok := event["packet_ring"].(*common.RingFrames)
+	if !ok {
+		return
+	}
+	delete(event, "packet_ring")
+
+	if !dumper.Enabled() || !dumper.Match(event) || len(frames.Frames) == 0 {
+		return
+	}
+
+	path, err := dumper.dump(frames, time.Now())
+	if err != nil {
+		logp.Err("Error dumping the packets of the stream %d: %s", frames.Stream, err)
+		return
+	}
+	event["pcap_file"] = path
+}
+
+// Returns true if the event matches one of the conditions.
+func (dumper *TriggeredDumper) Match(event common.MapStr) bool {
+	for _, cond := range dumper.Conditions {
+		if cond.Match(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the frames to a new file, named after the time and the stream,
+// and deletes the oldest files over KeepFiles. Returns the path of the
+// file.
+func (dumper *TriggeredDumper) dump(frames *common.RingFrames, now time.Time) (string, error) {
+	dumper.count++
+	name := fmt.Sprintf("%s-%d-%d.pcap", now.UTC().Format("20060102-150405.000"),
+		frames.Stream, dumper.count)
+	path := filepath.Join(dumper.Path, name)
+
+	handle, err := pcap.OpenDead(layers.LinkType(frames.Datalink), 65535)
+	if err != nil {
+		return "", err
+	}
+	writer, err := handle.NewDumper(path)
+	if err != nil {
+		return "", err
+	}
+	for _, frame := range frames.Frames {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     frame.Ts,
+			CaptureLength: len(frame.Data),
+			Length:        frame.Length,
+		}
+		err = writer.WritePacketData(frame.Data, ci)
+		if err != nil {
+			writer.Close()
+			os.Remove(path)
+			return "", err
+		}
+	}
+	writer.Close()
+
+	dumper.files = append(dumper.files, path)
+	for len(dumper.files) > dumper.KeepFiles {
+		err = os.Remove(dumper.files[0])
+		if err != nil && !os.IsNotExist(err) {
+			logp.Warn("Error deleting the dump %s: %s", dumper.files[0], err)
+		}
+		dumper.files = dumper.files[1:]
+	}
+
+	logp.Debug("dumps", "Dumped %d packets of the stream %d to %s",
+		len(frames.Frames), frames.Stream, path)
+	return path, nil
+}
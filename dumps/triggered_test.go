@@ -0,0 +1,169 @@
+package dumps
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"packetbeat/common"
+	"packetbeat/config"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/packetbeat/gopacket/layers"
+	"github.com/packetbeat/gopacket/pcap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCondition_parse(t *testing.T) {
+	cond, err := ParseCondition("http.code >= 500")
+	assert.Nil(t, err)
+	assert.Equal(t, &Condition{Field: "http.code", Op: ">=", Value: "500"}, cond)
+
+	cond, err = ParseCondition("method!=GET")
+	assert.Nil(t, err)
+	assert.Equal(t, &Condition{Field: "method", Op: "!=", Value: "GET"}, cond)
+
+	cond, err = ParseCondition("path=/a=b")
+	assert.Nil(t, err)
+	assert.Equal(t, &Condition{Field: "path", Op: "=", Value: "/a=b"}, cond)
+
+	for _, expr := range []string{"status", "=Error", " > 5"} {
+		_, err = ParseCondition(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
+
+func TestCondition_match(t *testing.T) {
+	event := common.MapStr{
+		"status":       common.ERROR_STATUS,
+		"responsetime": int32(1500),
+		"http":         common.MapStr{"code": uint16(503)},
+		"mysql":        map[string]interface{}{"error_code": 1045},
+	}
+
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"status=Error", true},
+		{"status!=Error", false},
+		{"responsetime>1000", true},
+		{"responsetime>=1500", true},
+		{"responsetime<1000", false},
+		{"responsetime=1500.0", true},
+		{"http.code>=500", true},
+		{"http.code<=499", false},
+		{"mysql.error_code=1045", true},
+		{"http.method=GET", false},
+		{"dns.id=1", false},
+	}
+	for _, test := range tests {
+		cond, err := ParseCondition(test.expr)
+		assert.Nil(t, err)
+		assert.Equal(t, test.match, cond.Match(event), test.expr)
+	}
+}
+
+func testDumper(t *testing.T, cfg config.Dumps) (*TriggeredDumper, func()) {
+	dir, err := ioutil.TempDir("", "dumps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Path = filepath.Join(dir, "dumps")
+
+	dumper := new(TriggeredDumper)
+	err = dumper.Init(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dumper, func() { os.RemoveAll(dir) }
+}
+
+func testEvent(status string, stream uint32) common.MapStr {
+	ring := common.NewPacketRing(10, stream)
+	ts := time.Unix(1425211200, 0)
+	for i := 0; i < 3; i++ {
+		ring.Add(ts.Add(time.Duration(i)*time.Second), []byte{1, 2, 3, 4}, 60,
+			int(layers.LinkTypeEthernet))
+	}
+
+	event := common.MapStr{"status": status}
+	tuple := common.TcpTuple{Packets: ring}
+	tuple.AddFields(event)
+	return event
+}
+
+func TestTriggeredDumper_disabled(t *testing.T) {
+	var dumper TriggeredDumper
+	assert.Nil(t, dumper.Init(&config.Dumps{}))
+	assert.False(t, dumper.Enabled())
+
+	event := testEvent(common.ERROR_STATUS, 1)
+	dumper.HandleEvent(event)
+	assert.Equal(t, common.MapStr{"status": common.ERROR_STATUS}, event)
+}
+
+func TestTriggeredDumper_dumpErrors(t *testing.T) {
+	dumper, cleanup := testDumper(t, config.Dumps{})
+	defer cleanup()
+	assert.True(t, dumper.Enabled())
+	assert.Equal(t, DEFAULT_RING_SIZE, dumper.RingSize)
+
+	event := testEvent(common.OK_STATUS, 1)
+	dumper.HandleEvent(event)
+	assert.Equal(t, common.MapStr{"status": common.OK_STATUS}, event)
+
+	event = testEvent(common.ERROR_STATUS, 2)
+	dumper.HandleEvent(event)
+	path, ok := event["pcap_file"].(string)
+	assert.True(t, ok)
+	_, exists := event["packet_ring"]
+	assert.False(t, exists)
+
+	handle, err := pcap.OpenOffline(path)
+	assert.Nil(t, err)
+	defer handle.Close()
+	assert.Equal(t, layers.LinkTypeEthernet, handle.LinkType())
+	count := 0
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{1, 2, 3, 4}, data)
+		assert.Equal(t, 60, ci.Length)
+		assert.Equal(t, int64(1425211200+count), ci.Timestamp.Unix())
+		count++
+	}
+	assert.Equal(t, 3, count)
+}
+
+func TestTriggeredDumper_keepFiles(t *testing.T) {
+	dumper, cleanup := testDumper(t, config.Dumps{
+		Keep_files: 2,
+		Conditions: []string{"status=Error", "status=Timeout"},
+	})
+	defer cleanup()
+
+	paths := []string{}
+	for i := 0; i < 3; i++ {
+		event := testEvent("Timeout", uint32(i))
+		dumper.HandleEvent(event)
+		paths = append(paths, event["pcap_file"].(string))
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dumper.Path, "*.pcap"))
+	assert.Equal(t, paths[1:], files)
+
+	// the files of the previous run are kept in the count
+	cfg := config.Dumps{Path: dumper.Path, Keep_files: 2}
+	dumper = new(TriggeredDumper)
+	assert.Nil(t, dumper.Init(&cfg))
+	event := testEvent(common.ERROR_STATUS, 4)
+	dumper.HandleEvent(event)
+
+	files, _ = filepath.Glob(filepath.Join(dumper.Path, "*.pcap"))
+	assert.Equal(t, []string{paths[2], event["pcap_file"].(string)}, files)
+}
@@ -22,11 +22,13 @@ type Input int
 const (
 	SnifferInput Input = iota
 	UdpjsonInput
+	PcapdirInput
 )
 
 var InputPluginNames = []string{
 	"sniffer",
 	"udpjson",
+	"pcapdir",
 }
 
 func (input Input) String() string {
@@ -9,7 +9,8 @@ import (
 func TestInputNames(t *testing.T) {
 	assert.Equal(t, "udpjson", UdpjsonInput.String())
 	assert.Equal(t, "sniffer", SnifferInput.String())
-	assert.Equal(t, "impossible", Input(2).String())
+	assert.Equal(t, "pcapdir", PcapdirInput.String())
+	assert.Equal(t, "impossible", Input(3).String())
 }
 
 func TestIsInList(t *testing.T) {
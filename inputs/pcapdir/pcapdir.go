@@ -0,0 +1,392 @@
+package pcapdir
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"packetbeat/common"
+	"packetbeat/config"
+	"packetbeat/inputs"
+	"packetbeat/logp"
+	"packetbeat/protos/tcp"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/packetbeat/gopacket/layers"
+	"github.com/packetbeat/gopacket/pcap"
+)
+
+type Config struct {
+	Path         string
+	Pattern      string
+	StateFile    string
+	MinAge       time.Duration
+	ScanInterval time.Duration
+	WaitNextFile bool
+	Delete       bool
+	MoveTo       string
+}
+
+// Input reading the pcap files written in a directory, for example by
+// tcpdump -G. The files are processed in the order of their names, once
+// they are complete, and the names of the processed files are kept in a
+// state file, together with the number of packets already read from the
+// file that was being processed.
+type PcapDir struct {
+	Config
+
+	isAlive bool
+
+	// names of the processed files still in the directory, and the
+	// number of packets read from the files partly processed
+	processed map[string]bool
+	partial   map[string]int
+
+	// decoders by link type, kept from one file to the next
+	decoders map[layers.LinkType]*tcp.DecoderStruct
+}
+
+func (input *PcapDir) setFromConfig(cfg *config.Pcapdir) error {
+	if len(cfg.Path) == 0 {
+		return fmt.Errorf("The path of the pcapdir input is not set")
+	}
+	input.Path = cfg.Path
+
+	if len(cfg.Pattern) > 0 {
+		input.Pattern = cfg.Pattern
+	} else {
+		input.Pattern = "*.pcap"
+	}
+	if len(cfg.State_file) > 0 {
+		input.StateFile = cfg.State_file
+	} else {
+		input.StateFile = filepath.Join(cfg.Path, ".packetbeat_pcapdir")
+	}
+	if cfg.Min_age > 0 {
+		input.MinAge = time.Duration(cfg.Min_age) * time.Millisecond
+	} else {
+		input.MinAge = 5 * time.Second
+	}
+	if cfg.Scan_interval > 0 {
+		input.ScanInterval = time.Duration(cfg.Scan_interval) * time.Millisecond
+	} else {
+		input.ScanInterval = time.Second
+	}
+	input.WaitNextFile = cfg.Wait_next_file
+	input.Delete = cfg.Delete
+	input.MoveTo = cfg.Move_to
+
+	if input.Delete && len(input.MoveTo) > 0 {
+		return fmt.Errorf("The pcapdir files can't be both deleted and moved")
+	}
+	return nil
+}
+
+func (input *PcapDir) Init(test_mode bool, events chan common.MapStr) error {
+	if !test_mode {
+		// the packets are passed to the same TCP workers and
+		// UDP plugins as the packets of the sniffer
+		if inputs.SnifferInput.IsInList(config.ConfigSingleton.Input.Inputs) {
+			return fmt.Errorf("The pcapdir input can't be enabled with the sniffer input")
+		}
+
+		err := input.setFromConfig(&config.ConfigSingleton.Pcapdir)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := input.loadState()
+	if err != nil {
+		return fmt.Errorf("Error loading the state file: %s", err)
+	}
+	input.decoders = make(map[layers.LinkType]*tcp.DecoderStruct)
+	input.isAlive = true
+
+	logp.Info("Pcapdir input reading the %s files of %s", input.Pattern, input.Path)
+
+	return nil
+}
+
+func (input *PcapDir) Run() error {
+	for input.isAlive {
+		files, err := input.completedFiles(time.Now())
+		if err != nil {
+			return err
+		}
+
+		failed := false
+		for _, name := range files {
+			if !input.isAlive {
+				break
+			}
+			complete, err := input.processFile(name)
+			if err != nil {
+				// the file and the following ones are retried
+				// on the next scan
+				logp.Err("Error reading %s: %s", name, err)
+				failed = true
+				break
+			}
+			if !complete {
+				// stopped in the middle of the file
+				break
+			}
+			err = input.done(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		if input.isAlive && (len(files) == 0 || failed) {
+			time.Sleep(input.ScanInterval)
+		}
+	}
+
+	// wait for the TCP workers to process what was read
+	tcp.Flush()
+
+	return nil
+}
+
+// Returns the names of the files to process, in order. The files that
+// were modified less than MinAge ago may still be written, so neither
+// them nor the following files are returned. With WaitNextFile, the
+// newest file is also held back until a later file exists, for the
+// writers that may leave a file unmodified for a while before it is
+// complete.
+func (input *PcapDir) completedFiles(now time.Time) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(input.Path, input.Pattern))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	present := make(map[string]bool, len(paths))
+	names := []string{}
+	mtimes := []time.Time{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			// removed since the glob
+			continue
+		}
+		if info.IsDir() || path == input.StateFile {
+			continue
+		}
+		name := filepath.Base(path)
+		present[name] = true
+		names = append(names, name)
+		mtimes = append(mtimes, info.ModTime())
+	}
+
+	files := []string{}
+	for i, name := range names {
+		if input.processed[name] {
+			continue
+		}
+		if input.WaitNextFile && i == len(names)-1 {
+			break
+		}
+		if now.Sub(mtimes[i]) < input.MinAge {
+			break
+		}
+		files = append(files, name)
+	}
+
+	// forget the files that were removed
+	pruned := false
+	for name := range input.processed {
+		if !present[name] {
+			delete(input.processed, name)
+			pruned = true
+		}
+	}
+	for name := range input.partial {
+		if !present[name] {
+			delete(input.partial, name)
+			pruned = true
+		}
+	}
+	if pruned {
+		err = input.saveState()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// Passes the packets of the file to the decoder, skipping those passed
+// by a previous read of the file. Returns true once the end of the file
+// is reached, false if the input was stopped before. When the input is
+// stopped or the file can't be read up to its end, the number of packets
+// passed is saved, so that the next read continues from there.
+func (input *PcapDir) processFile(name string) (bool, error) {
+	path := filepath.Join(input.Path, name)
+	logp.Debug("pcapdir", "Reading %s", path)
+
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return false, err
+	}
+	defer handle.Close()
+
+	decoder, err := input.decoder(handle.LinkType())
+	if err != nil {
+		return false, err
+	}
+
+	skip := input.partial[name]
+	counter := 0
+	for input.isAlive {
+		data, ci, err := handle.ReadPacketData()
+		if err == io.EOF {
+			logp.Info("Processed %d packets of %s", counter, path)
+			return true, nil
+		}
+		if err != nil {
+			if counter > skip {
+				saveErr := input.readUpTo(name, counter)
+				if saveErr != nil {
+					return false, saveErr
+				}
+			}
+			return false, fmt.Errorf("after %d packets: %s", counter, err)
+		}
+		counter++
+
+		if counter <= skip {
+			continue
+		}
+		decoder.DecodePacketData(data, &ci)
+	}
+	return false, input.readUpTo(name, counter)
+}
+
+func (input *PcapDir) decoder(datalink layers.LinkType) (*tcp.DecoderStruct, error) {
+	decoder, exists := input.decoders[datalink]
+	if !exists {
+		var err error
+		decoder, err = tcp.CreateDecoder(datalink)
+		if err != nil {
+			return nil, err
+		}
+		input.decoders[datalink] = decoder
+	}
+	return decoder, nil
+}
+
+// Records the number of packets of the file that were passed to the
+// decoder.
+func (input *PcapDir) readUpTo(name string, packets int) error {
+	// the state is saved once the workers have processed the packets
+	tcp.Flush()
+
+	input.partial[name] = packets
+	return input.saveState()
+}
+
+// Records the file as processed, then deletes it or moves it if
+// configured.
+func (input *PcapDir) done(name string) error {
+	// the state is saved once the workers have processed the packets
+	tcp.Flush()
+
+	delete(input.partial, name)
+	input.processed[name] = true
+	err := input.saveState()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(input.Path, name)
+	if input.Delete {
+		err = os.Remove(path)
+	} else if len(input.MoveTo) > 0 {
+		err = os.Rename(path, filepath.Join(input.MoveTo, name))
+	}
+	if err != nil {
+		logp.Err("Error deleting or moving %s: %s", path, err)
+	}
+	return nil
+}
+
+// Reads the state file. It has one line per file: the name of the
+// processed files, or for a partly processed file, its name followed by
+// a tab and the number of packets read from it.
+func (input *PcapDir) loadState() error {
+	input.processed = make(map[string]bool)
+	input.partial = make(map[string]int)
+
+	f, err := os.Open(input.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) == 1 {
+			input.processed[line] = true
+			continue
+		}
+		packets, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil {
+			return fmt.Errorf("Invalid line %q: %s", line, err)
+		}
+		input.partial[strings.Join(fields[:len(fields)-1], "\t")] = packets
+	}
+	return scanner.Err()
+}
+
+// Writes the state file. It is replaced atomically, so that it is
+// never left half written.
+func (input *PcapDir) saveState() error {
+	names := make([]string, 0, len(input.processed)+len(input.partial))
+	for name := range input.processed {
+		names = append(names, name+"\n")
+	}
+	for name, packets := range input.partial {
+		names = append(names, fmt.Sprintf("%s\t%d\n", name, packets))
+	}
+	sort.Strings(names)
+
+	tmp := input.StateFile + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(strings.Join(names, "")), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing the state file: %s", err)
+	}
+	err = os.Rename(tmp, input.StateFile)
+	if err != nil {
+		return fmt.Errorf("Error writing the state file: %s", err)
+	}
+	return nil
+}
+
+func (input *PcapDir) Stop() error {
+	input.isAlive = false
+	return nil
+}
+
+func (input *PcapDir) Close() error {
+	return nil
+}
+
+func (input *PcapDir) IsAlive() bool {
+	return input.isAlive
+}
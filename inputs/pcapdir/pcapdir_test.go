@@ -0,0 +1,213 @@
+package pcapdir
+
+import (
+	"io/ioutil"
+	"os"
+	"packetbeat/config"
+	"packetbeat/protos/tcp"
+	"packetbeat/protos/udp"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testInput(t *testing.T) (*PcapDir, func()) {
+	dir, err := ioutil.TempDir("", "pcapdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := new(PcapDir)
+	input.Config = Config{
+		Path:         dir,
+		Pattern:      "*.pcap",
+		StateFile:    filepath.Join(dir, "state"),
+		MinAge:       time.Minute,
+		ScanInterval: 10 * time.Millisecond,
+	}
+	return input, func() { os.RemoveAll(dir) }
+}
+
+// Copies the pcap file to the directory, modified at the given time.
+func testCopyPcap(t *testing.T, dir string, name string, mtime time.Time) {
+	testWritePcap(t, dir, name, mtime, 0)
+}
+
+// Same as testCopyPcap, with the last bytes of the file cut.
+func testWritePcap(t *testing.T, dir string, name string, mtime time.Time, cut int) {
+	data, err := ioutil.ReadFile("../../tests/pcaps/http_minitwit.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, data[:len(data)-cut], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, mtime, mtime)
+}
+
+func TestPcapDir_completedFiles(t *testing.T) {
+	input, cleanup := testInput(t)
+	defer cleanup()
+
+	now := time.Now()
+	testCopyPcap(t, input.Path, "trace-01.pcap", now.Add(-time.Hour))
+	testCopyPcap(t, input.Path, "trace-02.pcap", now.Add(-time.Hour))
+	testCopyPcap(t, input.Path, "trace-03.pcap", now)
+	testCopyPcap(t, input.Path, "trace-04.pcap", now.Add(-time.Hour))
+	testCopyPcap(t, input.Path, "notes.txt", now.Add(-time.Hour))
+
+	assert.Nil(t, input.Init(true, nil))
+	input.processed["trace-01.pcap"] = true
+	input.processed["trace-00.pcap"] = true
+
+	// trace-03.pcap is still written, trace-04.pcap waits for it
+	files, err := input.completedFiles(now)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"trace-02.pcap"}, files)
+
+	// the files no longer in the directory are forgotten
+	assert.Equal(t, map[string]bool{"trace-01.pcap": true}, input.processed)
+
+	files, err = input.completedFiles(now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"trace-02.pcap", "trace-03.pcap", "trace-04.pcap"}, files)
+
+	// trace-04.pcap is the newest file
+	input.WaitNextFile = true
+	files, err = input.completedFiles(now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"trace-02.pcap", "trace-03.pcap"}, files)
+}
+
+func TestPcapDir_truncatedLastFile(t *testing.T) {
+	assert.Nil(t, tcp.TcpInit(map[string]config.Protocol{}, nil))
+	assert.Nil(t, udp.UdpInit(map[string]config.Protocol{}))
+
+	input, cleanup := testInput(t)
+	defer cleanup()
+	input.WaitNextFile = true
+	input.Delete = true
+
+	// not modified for a while, but tcpdump didn't flush the end of it
+	old := time.Now().Add(-time.Hour)
+	testWritePcap(t, input.Path, "trace-01.pcap", old, 10)
+	assert.Nil(t, input.Init(true, nil))
+
+	files, err := input.completedFiles(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, files)
+
+	// read anyway, the packets before the cut are passed and the file
+	// is kept
+	complete, err := input.processFile("trace-01.pcap")
+	assert.False(t, complete)
+	assert.NotNil(t, err)
+	assert.Equal(t, map[string]int{"trace-01.pcap": 103}, input.partial)
+	_, err = os.Stat(filepath.Join(input.Path, "trace-01.pcap"))
+	assert.Nil(t, err)
+
+	// once complete, it is read from where it stopped
+	testCopyPcap(t, input.Path, "trace-01.pcap", old)
+	testCopyPcap(t, input.Path, "trace-02.pcap", old)
+	files, err = input.completedFiles(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"trace-01.pcap"}, files)
+
+	complete, err = input.processFile("trace-01.pcap")
+	assert.True(t, complete)
+	assert.Nil(t, err)
+	assert.Nil(t, input.done("trace-01.pcap"))
+	assert.Equal(t, map[string]int{}, input.partial)
+}
+
+func TestPcapDir_unreadableFile(t *testing.T) {
+	input, cleanup := testInput(t)
+	defer cleanup()
+	input.Delete = true
+
+	path := filepath.Join(input.Path, "trace-01.pcap")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("not a pcap file"), 0644))
+	assert.Nil(t, input.Init(true, nil))
+
+	complete, err := input.processFile("trace-01.pcap")
+	assert.False(t, complete)
+	assert.NotNil(t, err)
+
+	// it is neither recorded nor deleted
+	assert.Equal(t, map[string]bool{}, input.processed)
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
+
+func TestPcapDir_state(t *testing.T) {
+	input, cleanup := testInput(t)
+	defer cleanup()
+
+	assert.Nil(t, input.Init(true, nil))
+	assert.Equal(t, map[string]bool{}, input.processed)
+
+	input.processed["b.pcap"] = true
+	input.processed["a.pcap"] = true
+	assert.Nil(t, input.saveState())
+
+	data, err := ioutil.ReadFile(input.StateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "a.pcap\nb.pcap\n", string(data))
+
+	// the number of packets read from the file being processed
+	input.partial["c.pcap"] = 12
+	assert.Nil(t, input.saveState())
+	data, err = ioutil.ReadFile(input.StateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "a.pcap\nb.pcap\nc.pcap\t12\n", string(data))
+
+	input.processed = nil
+	input.partial = nil
+	assert.Nil(t, input.loadState())
+	assert.Equal(t, map[string]bool{"a.pcap": true, "b.pcap": true}, input.processed)
+	assert.Equal(t, map[string]int{"c.pcap": 12}, input.partial)
+}
+
+func TestPcapDir_processFiles(t *testing.T) {
+	assert.Nil(t, tcp.TcpInit(map[string]config.Protocol{}, nil))
+	assert.Nil(t, udp.UdpInit(map[string]config.Protocol{}))
+
+	input, cleanup := testInput(t)
+	defer cleanup()
+	input.MoveTo = filepath.Join(input.Path, "done")
+	assert.Nil(t, os.Mkdir(input.MoveTo, 0755))
+
+	testCopyPcap(t, input.Path, "trace-01.pcap", time.Now().Add(-time.Hour))
+	testCopyPcap(t, input.Path, "trace-02.pcap", time.Now().Add(-time.Hour))
+	testCopyPcap(t, input.Path, "trace-03.pcap", time.Now())
+	assert.Nil(t, input.Init(true, nil))
+
+	files, err := input.completedFiles(time.Now())
+	assert.Nil(t, err)
+	for _, name := range files {
+		complete, err := input.processFile(name)
+		assert.True(t, complete)
+		assert.Nil(t, err)
+		assert.Nil(t, input.done(name))
+	}
+	data, err := ioutil.ReadFile(input.StateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "trace-01.pcap\ntrace-02.pcap\n", string(data))
+
+	moved, _ := filepath.Glob(filepath.Join(input.MoveTo, "*.pcap"))
+	assert.Equal(t, 2, len(moved))
+	left, _ := filepath.Glob(filepath.Join(input.Path, "*.pcap"))
+	assert.Equal(t, 1, len(left))
+
+	// moved files are forgotten on the next scan
+	files, err = input.completedFiles(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, files)
+	data, err = ioutil.ReadFile(input.StateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "", string(data))
+}
@@ -3,6 +3,7 @@
 package sniffer
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/packetbeat/gopacket"
@@ -45,6 +46,37 @@ func (h *AfpacketHandle) SetBPFFilter(expr string) (_ error) {
 	return h.TPacket.SetBPFFilter(expr)
 }
 
+// Joins the socket to the fanout group of the given ID. The packets of
+// the device are spread between the sockets of the group by the hash of
+// their flow ("hash"), by the CPU they arrived on ("cpu"), or in round
+// robin ("lb").
+func (h *AfpacketHandle) SetFanout(mode string, id uint16) error {
+	var fanout afpacket.FanoutType
+	switch mode {
+	case "hash":
+		// the IP fragments are reassembled before being hashed, so
+		// that all the fragments of a datagram go to the same socket
+		fanout = afpacket.FanoutHash | afpacket.FanoutHashWithDefrag
+	case "cpu":
+		fanout = afpacket.FanoutCPU
+	case "lb":
+		fanout = afpacket.FanoutLoadBalance
+	default:
+		return fmt.Errorf("Unknown fanout mode: %s", mode)
+	}
+	return h.TPacket.SetFanout(fanout, id)
+}
+
+// Returns the number of packets received and dropped by the socket
+// since it was opened.
+func (h *AfpacketHandle) Stats() (received uint, dropped uint, err error) {
+	stats, statsV3, err := h.TPacket.SocketStats()
+	if err != nil {
+		return 0, 0, err
+	}
+	return stats.Packets() + statsV3.Packets(), stats.Drops() + statsV3.Drops(), nil
+}
+
 func (h *AfpacketHandle) Close() {
 	h.TPacket.Close()
 }
@@ -26,5 +26,13 @@ func (h *AfpacketHandle) SetBPFFilter(expr string) (_ error) {
 	return fmt.Errorf("Afpacket MMAP sniffing is only available on Linux")
 }
 
+func (h *AfpacketHandle) SetFanout(mode string, id uint16) error {
+	return fmt.Errorf("Afpacket MMAP sniffing is only available on Linux")
+}
+
+func (h *AfpacketHandle) Stats() (received uint, dropped uint, err error) {
+	return 0, 0, fmt.Errorf("Afpacket MMAP sniffing is only available on Linux")
+}
+
 func (h *AfpacketHandle) Close() {
 }
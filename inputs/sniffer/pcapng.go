@@ -0,0 +1,322 @@
+package sniffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+)
+
+// Block types of the pcapng format.
+const (
+	pcapngSectionHeader        = 0x0a0d0d0a
+	pcapngInterfaceDescription = 1
+	pcapngObsoletePacket       = 2
+	pcapngSimplePacket         = 3
+	pcapngEnhancedPacket       = 6
+)
+
+// Options of the interface description blocks.
+const (
+	pcapngOptEnd        = 0
+	pcapngOptIfName     = 2
+	pcapngOptIfTsresol  = 9
+	pcapngOptIfTsoffset = 14
+)
+
+const (
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngMaxBlockLength = 16 * 1024 * 1024
+)
+
+// An interface of a pcapng file.
+type pcapngInterface struct {
+	Id       int // in the order of the interface blocks in the file
+	Name     string
+	LinkType layers.LinkType
+
+	tsUnits  uint64 // per second
+	tsOffset int64  // seconds
+}
+
+// Reads the packets of a pcapng file, which can have several sections
+// and several interfaces of different link types.
+type pcapngReader struct {
+	file  *os.File // nil for the streams
+	r     *bufio.Reader
+	order binary.ByteOrder
+
+	// interfaces of all the sections, and of the current one
+	interfaces []*pcapngInterface
+	section    []*pcapngInterface
+}
+
+// Returns true if the file starts with a pcapng section header.
+func isPcapngFile(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	_, err = io.ReadFull(f, magic[:])
+	if err != nil {
+		// too short to be anything, let the pcap reader complain
+		return false, nil
+	}
+	return binary.BigEndian.Uint32(magic[:]) == pcapngSectionHeader, nil
+}
+
+// Opens the pcapng file and reads its blocks up to the first interface
+// description, so that the link type of the first interface is known.
+func openPcapng(name string) (*pcapngReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newPcapngReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	reader.file = f
+	return reader, nil
+}
+
+// Returns a reader of the pcapng data, which can be a stream, after
+// reading its blocks up to the first interface description.
+func newPcapngReader(r *bufio.Reader) (*pcapngReader, error) {
+	reader := &pcapngReader{r: r}
+
+	for len(reader.interfaces) == 0 {
+		blockType, body, err := reader.readBlock()
+		if err == nil && isPcapngPacket(blockType) {
+			err = errors.New("Packet block before any interface description")
+		}
+		if err == io.EOF {
+			err = errors.New("No interface description in the file")
+		}
+		if err == nil {
+			err = reader.handleBlock(blockType, body)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reader, nil
+}
+
+// Closes the file of the reader. The streams are closed by the sniffer.
+func (reader *pcapngReader) Close() {
+	if reader.file != nil {
+		reader.file.Close()
+	}
+}
+
+func isPcapngPacket(blockType uint32) bool {
+	return blockType == pcapngEnhancedPacket || blockType == pcapngSimplePacket ||
+		blockType == pcapngObsoletePacket
+}
+
+// Returns the next packet, with the interface it was captured on.
+func (reader *pcapngReader) ReadPacketData() ([]byte, gopacket.CaptureInfo,
+	*pcapngInterface, error) {
+
+	for {
+		blockType, body, err := reader.readBlock()
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, nil, err
+		}
+		if !isPcapngPacket(blockType) {
+			err = reader.handleBlock(blockType, body)
+			if err != nil {
+				return nil, gopacket.CaptureInfo{}, nil, err
+			}
+			continue
+		}
+		return reader.parsePacket(blockType, body)
+	}
+}
+
+// Reads the next block. Returns its type and its body, without the
+// block header and the trailing length.
+func (reader *pcapngReader) readBlock() (uint32, []byte, error) {
+	var header [12]byte
+	_, err := io.ReadFull(reader.r, header[:8])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	headerLen := 8
+	if binary.BigEndian.Uint32(header[:4]) == pcapngSectionHeader {
+		// the byte order of the section is given by its header
+		_, err = io.ReadFull(reader.r, header[8:12])
+		if err != nil {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		switch {
+		case binary.BigEndian.Uint32(header[8:12]) == pcapngByteOrderMagic:
+			reader.order = binary.BigEndian
+		case binary.LittleEndian.Uint32(header[8:12]) == pcapngByteOrderMagic:
+			reader.order = binary.LittleEndian
+		default:
+			return 0, nil, errors.New("Invalid byte order magic")
+		}
+		headerLen = 12
+	} else if reader.order == nil {
+		return 0, nil, errors.New("Not starting with a section header")
+	}
+
+	blockType := reader.order.Uint32(header[:4])
+	length := int(reader.order.Uint32(header[4:8]))
+	if length < headerLen+4 || length%4 != 0 || length > pcapngMaxBlockLength {
+		return 0, nil, fmt.Errorf("Invalid length %d of block type %d", length, blockType)
+	}
+
+	block := make([]byte, length-8)
+	copy(block, header[8:headerLen])
+	_, err = io.ReadFull(reader.r, block[headerLen-8:])
+	if err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return blockType, block[:len(block)-4], nil
+}
+
+// Handles the section headers and the interface descriptions, the other
+// blocks are ignored.
+func (reader *pcapngReader) handleBlock(blockType uint32, body []byte) error {
+	switch blockType {
+	case pcapngSectionHeader:
+		// byte order magic, version and section length
+		if len(body) < 16 {
+			return errors.New("Section header too short")
+		}
+		// the interface IDs start again in every section
+		reader.section = nil
+
+	case pcapngInterfaceDescription:
+		if len(body) < 8 {
+			return errors.New("Interface description too short")
+		}
+		// gopacket stores the link types in a byte
+		iface := &pcapngInterface{
+			Id:       len(reader.interfaces),
+			LinkType: layers.LinkType(reader.order.Uint16(body[0:2])),
+			tsUnits:  1e6, // microseconds by default
+		}
+		reader.parseInterfaceOptions(iface, body[8:])
+
+		reader.interfaces = append(reader.interfaces, iface)
+		reader.section = append(reader.section, iface)
+	}
+	return nil
+}
+
+func (reader *pcapngReader) parseInterfaceOptions(iface *pcapngInterface, options []byte) {
+	for len(options) >= 4 {
+		code := reader.order.Uint16(options[0:2])
+		length := int(reader.order.Uint16(options[2:4]))
+		if code == pcapngOptEnd || 4+length > len(options) {
+			return
+		}
+		value := options[4 : 4+length]
+
+		switch {
+		case code == pcapngOptIfName:
+			iface.Name = string(value)
+		case code == pcapngOptIfTsresol && length == 1:
+			// a negative power of 2 or of 10, ignored if it doesn't fit
+			// in the 64 bits of the timestamps
+			exp := value[0] & 0x7f
+			if value[0]&0x80 != 0 && exp < 64 {
+				iface.tsUnits = 1 << exp
+			} else if value[0]&0x80 == 0 && exp < 20 {
+				iface.tsUnits = 1
+				for i := byte(0); i < exp; i++ {
+					iface.tsUnits *= 10
+				}
+			}
+		case code == pcapngOptIfTsoffset && length == 8:
+			iface.tsOffset = int64(reader.order.Uint64(value))
+		}
+
+		// the options are padded to 32 bits
+		next := 4 + (length+3)&^3
+		if next > len(options) {
+			return
+		}
+		options = options[next:]
+	}
+}
+
+func (reader *pcapngReader) parsePacket(blockType uint32, body []byte) ([]byte,
+	gopacket.CaptureInfo, *pcapngInterface, error) {
+
+	var ci gopacket.CaptureInfo
+	var ifaceId int
+	var tsHigh, tsLow uint32
+	var data []byte
+
+	switch blockType {
+	case pcapngEnhancedPacket, pcapngObsoletePacket:
+		if len(body) < 20 {
+			return nil, ci, nil, errors.New("Packet block too short")
+		}
+		if blockType == pcapngEnhancedPacket {
+			ifaceId = int(reader.order.Uint32(body[0:4]))
+		} else {
+			ifaceId = int(reader.order.Uint16(body[0:2]))
+		}
+		tsHigh = reader.order.Uint32(body[4:8])
+		tsLow = reader.order.Uint32(body[8:12])
+		ci.CaptureLength = int(reader.order.Uint32(body[12:16]))
+		ci.Length = int(reader.order.Uint32(body[16:20]))
+		if ci.CaptureLength > len(body)-20 {
+			return nil, ci, nil, errors.New("Packet data longer than its block")
+		}
+		data = body[20 : 20+ci.CaptureLength]
+
+	case pcapngSimplePacket:
+		if len(body) < 4 {
+			return nil, ci, nil, errors.New("Packet block too short")
+		}
+		ci.Length = int(reader.order.Uint32(body[0:4]))
+		data = body[4:]
+		if len(data) > ci.Length {
+			data = data[:ci.Length]
+		}
+		ci.CaptureLength = len(data)
+	}
+
+	if ifaceId >= len(reader.section) {
+		return nil, ci, nil, fmt.Errorf("Packet of the unknown interface %d", ifaceId)
+	}
+	iface := reader.section[ifaceId]
+
+	if blockType != pcapngSimplePacket {
+		ci.Timestamp = iface.timestamp(uint64(tsHigh)<<32 | uint64(tsLow))
+	}
+	return data, ci, iface, nil
+}
+
+// Converts the timestamp of a packet of the interface to a time.
+func (iface *pcapngInterface) timestamp(ts uint64) time.Time {
+	secs := int64(ts/iface.tsUnits) + iface.tsOffset
+	frac := ts % iface.tsUnits
+
+	var nsecs int64
+	if iface.tsUnits <= 1e9 {
+		nsecs = int64(frac * 1e9 / iface.tsUnits)
+	} else {
+		nsecs = int64(float64(frac) * 1e9 / float64(iface.tsUnits))
+	}
+	return time.Unix(secs, nsecs).UTC()
+}
@@ -0,0 +1,229 @@
+package sniffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"packetbeat/config"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/packetbeat/gopacket/layers"
+)
+
+// Writes the blocks of a pcapng file in the given byte order.
+type testPcapng struct {
+	buf   bytes.Buffer
+	order binary.ByteOrder
+}
+
+func (w *testPcapng) block(blockType uint32, body []byte) {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(12 + len(body))
+	binary.Write(&w.buf, w.order, blockType)
+	binary.Write(&w.buf, w.order, length)
+	w.buf.Write(body)
+	binary.Write(&w.buf, w.order, length)
+}
+
+func (w *testPcapng) option(body *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(body, w.order, code)
+	binary.Write(body, w.order, uint16(len(value)))
+	body.Write(value)
+	for body.Len()%4 != 0 {
+		body.WriteByte(0)
+	}
+}
+
+func (w *testPcapng) section() {
+	var body bytes.Buffer
+	binary.Write(&body, w.order, uint32(pcapngByteOrderMagic))
+	binary.Write(&body, w.order, uint16(1))
+	binary.Write(&body, w.order, uint16(0))
+	binary.Write(&body, w.order, int64(-1))
+	w.option(&body, 1, []byte("a comment"))
+	w.option(&body, pcapngOptEnd, nil)
+	w.block(pcapngSectionHeader, body.Bytes())
+}
+
+func (w *testPcapng) iface(linkType uint16, name string, tsresol byte) {
+	var body bytes.Buffer
+	binary.Write(&body, w.order, linkType)
+	binary.Write(&body, w.order, uint16(0))
+	binary.Write(&body, w.order, uint32(65535))
+	w.option(&body, pcapngOptIfName, []byte(name))
+	if tsresol != 0 {
+		w.option(&body, pcapngOptIfTsresol, []byte{tsresol})
+	}
+	w.option(&body, pcapngOptEnd, nil)
+	w.block(pcapngInterfaceDescription, body.Bytes())
+}
+
+func (w *testPcapng) packet(iface uint32, ts uint64, data []byte) {
+	var body bytes.Buffer
+	binary.Write(&body, w.order, iface)
+	binary.Write(&body, w.order, uint32(ts>>32))
+	binary.Write(&body, w.order, uint32(ts))
+	binary.Write(&body, w.order, uint32(len(data)))
+	binary.Write(&body, w.order, uint32(len(data)))
+	body.Write(data)
+	w.block(pcapngEnhancedPacket, body.Bytes())
+}
+
+// IPv4 header and UDP header of a DNS query, without payload.
+var testIPv4Udp = []byte{
+	0x45, 0, 0, 28, 0, 1, 0, 0, 64, 17, 0, 0,
+	192, 168, 0, 1, 192, 168, 0, 2,
+	0x30, 0x39, 0, 53, 0, 8, 0, 0,
+}
+
+// Returns a pcapng file with two sections in different byte orders, the
+// first one with an Ethernet and a raw IP interface.
+func testPcapngFile() []byte {
+	eth := append([]byte{
+		0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 1, 0x08, 0x00,
+	}, testIPv4Udp...)
+
+	w := &testPcapng{order: binary.LittleEndian}
+	w.section()
+	w.iface(uint16(layers.LinkTypeEthernet), "eth0", 0)
+	w.iface(uint16(layers.LinkTypeRaw), "tun0", 9)
+	w.packet(0, 1425211200000000, eth)
+	w.packet(1, 1425211201500000000, testIPv4Udp)
+	w.block(5, []byte{0, 0, 0, 0}) // interface statistics, ignored
+
+	data := w.buf.Bytes()
+	w = &testPcapng{order: binary.BigEndian}
+	w.section()
+	w.iface(uint16(layers.LinkTypeFDDI), "fddi0", 0)
+	w.iface(uint16(layers.LinkTypeEthernet), "eth1", 0)
+	w.packet(0, 1425211202000000, []byte{1, 2, 3})
+	w.packet(1, 1425211203000000, eth)
+	return append(data, w.buf.Bytes()...)
+}
+
+func testWritePcapng(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "test.pcapng")
+	err = ioutil.WriteFile(name, testPcapngFile(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name, func() { os.RemoveAll(dir) }
+}
+
+func TestPcapng_read(t *testing.T) {
+	name, cleanup := testWritePcapng(t)
+	defer cleanup()
+
+	isPcapng, err := isPcapngFile(name)
+	if err != nil || !isPcapng {
+		t.Fatal("Expected a pcapng file", err)
+	}
+
+	reader, err := openPcapng(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if len(reader.interfaces) != 1 {
+		t.Error("Expected the first interface only", len(reader.interfaces))
+	}
+
+	expected := []struct {
+		iface int
+		name  string
+		ts    time.Time
+		len   int
+	}{
+		{0, "eth0", time.Unix(1425211200, 0), 42},
+		{1, "tun0", time.Unix(1425211201, 500000000), 28},
+		{2, "fddi0", time.Unix(1425211202, 0), 3},
+		{3, "eth1", time.Unix(1425211203, 0), 42},
+	}
+	for _, exp := range expected {
+		data, ci, iface, err := reader.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if iface.Id != exp.iface || iface.Name != exp.name {
+			t.Error("Bad interface", iface.Id, iface.Name)
+		}
+		if !ci.Timestamp.Equal(exp.ts) {
+			t.Error("Bad timestamp", ci.Timestamp)
+		}
+		if len(data) != exp.len || ci.CaptureLength != exp.len || ci.Length != exp.len {
+			t.Error("Bad length", len(data), ci.CaptureLength, ci.Length)
+		}
+	}
+
+	_, _, _, err = reader.ReadPacketData()
+	if err != io.EOF {
+		t.Error("Expected EOF", err)
+	}
+}
+
+func TestPcapng_notPcapng(t *testing.T) {
+	isPcapng, err := isPcapngFile("../../tests/pcaps/http_minitwit.pcap")
+	if err != nil || isPcapng {
+		t.Error("Expected a pcap file", err)
+	}
+
+	name, cleanup := testWritePcapng(t)
+	defer cleanup()
+	data := testPcapngFile()
+	ioutil.WriteFile(name, data[:30], 0644)
+	_, err = openPcapng(name)
+	if err == nil {
+		t.Error("Expected an error for a truncated file")
+	}
+}
+
+func TestSniffer_pcapngDevices(t *testing.T) {
+	name, cleanup := testWritePcapng(t)
+	defer cleanup()
+
+	config.ConfigSingleton.Interfaces = config.InterfacesConfig{File: name}
+	defer func() { config.ConfigSingleton.Interfaces = config.InterfacesConfig{} }()
+
+	var sniffer SnifferSetup
+	err := sniffer.Init(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sniffer.Close()
+
+	devices := []string{}
+	for {
+		dev, _, _, err := sniffer.readPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices = append(devices, dev.name)
+		if dev.name == "fddi0" {
+			if dev.Decoder != nil {
+				t.Error("Expected no decoder for FDDI")
+			}
+		} else if dev.Decoder == nil || dev.Decoder.Device != dev.name {
+			t.Error("Bad decoder of", dev.name)
+		}
+	}
+
+	if len(devices) != 4 || devices[1] != "tun0" || devices[3] != "eth1" {
+		t.Error("Bad devices", devices)
+	}
+	if len(sniffer.devices) != 4 || sniffer.devices[1].Datalink() != layers.LinkTypeRaw {
+		t.Error("Bad devices", len(sniffer.devices))
+	}
+}
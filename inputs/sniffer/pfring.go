@@ -45,6 +45,15 @@ func (h *PfringHandle) Enable() (_ error) {
 	return h.Ring.Enable()
 }
 
+// Returns the packets received and dropped by the ring.
+func (h *PfringHandle) Stats() (received uint, dropped uint, err error) {
+	stats, err := h.Ring.Stats()
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint(stats.Received), uint(stats.Dropped), nil
+}
+
 func (h *PfringHandle) Close() {
 	h.Ring.Close()
 }
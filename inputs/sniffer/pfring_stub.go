@@ -28,5 +28,9 @@ func (h *PfringHandle) Enable() (_ error) {
 	return fmt.Errorf("Pfring sniffing is not compiled in")
 }
 
+func (h *PfringHandle) Stats() (received uint, dropped uint, err error) {
+	return 0, 0, fmt.Errorf("Pfring sniffing is not compiled in")
+}
+
 func (h *PfringHandle) Close() {
 }
@@ -0,0 +1,95 @@
+package sniffer
+
+import (
+	"packetbeat/config"
+	"packetbeat/logp"
+	"time"
+)
+
+// Time between the last packet of a loop over the file and the first
+// packet of the next one. It is longer than the default timeouts, so
+// the streams and the transactions of a loop expire before the next one
+// starts.
+const REPLAY_LOOP_GAP = time.Minute
+
+// Paces the packets read from a file and shifts their timestamps. The
+// timestamps of each loop over the file follow those of the previous
+// loop.
+type replayer struct {
+	speed          float64 // zero to read at top speed
+	start, end     time.Time
+	keepTimestamps bool
+
+	shift   time.Duration
+	started bool
+
+	// timestamps in the file of the first and of the last packets read
+	// in the current loop
+	first, last time.Time
+}
+
+func newReplayer(interfaces *config.InterfacesConfig) *replayer {
+	r := &replayer{
+		speed:          interfaces.Speed,
+		start:          interfaces.StartTime,
+		end:            interfaces.EndTime,
+		keepTimestamps: interfaces.KeepTimestamps,
+	}
+	if r.speed <= 0 {
+		r.speed = 1
+	}
+	if interfaces.TopSpeed {
+		r.speed = 0
+	}
+	return r
+}
+
+// Returns true if the packet is before the start of the time window.
+func (r *replayer) beforeStart(ts time.Time) bool {
+	return !r.start.IsZero() && ts.Before(r.start)
+}
+
+// Returns true if the packet is after the end of the time window. The
+// packets of the file are expected to be in order, so the rest of the
+// file is after the end as well.
+func (r *replayer) afterEnd(ts time.Time) bool {
+	return !r.end.IsZero() && ts.After(r.end)
+}
+
+// Returns how long to wait before processing the packet, and its
+// shifted timestamp.
+func (r *replayer) packet(ts time.Time) (time.Duration, time.Time) {
+	var wait time.Duration
+
+	if r.first.IsZero() {
+		r.first = ts
+		if !r.started && !r.keepTimestamps {
+			// the first packet of the file is seen as arriving now
+			r.shift = time.Now().Sub(ts)
+		}
+		r.started = true
+	} else if r.speed > 0 {
+		wait = time.Duration(float64(ts.Sub(r.last)) / r.speed)
+		if wait < 0 {
+			logp.Warn("Time in pcap went backwards: %d", wait)
+			wait = 0
+		}
+	}
+	r.last = ts
+
+	// Shift what we get from the pcap rather than using the current
+	// time, so that the timeouts are the same as when the file was
+	// captured, also at top speed or at another speed.
+	return wait, ts.Add(r.shift)
+}
+
+// Called when the file is read again, so that the timestamps of the
+// next loop continue after those of this one.
+func (r *replayer) rewind() {
+	if r.first.IsZero() {
+		return
+	}
+	r.shift += r.last.Sub(r.first) + REPLAY_LOOP_GAP
+	r.first = time.Time{}
+	r.last = time.Time{}
+}
@@ -0,0 +1,84 @@
+package sniffer
+
+import (
+	"packetbeat/config"
+	"testing"
+	"time"
+)
+
+var replayTs = time.Date(2015, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+func TestReplay_speed(t *testing.T) {
+	r := newReplayer(&config.InterfacesConfig{Speed: 4, KeepTimestamps: true})
+
+	wait, ts := r.packet(replayTs)
+	if wait != 0 || !ts.Equal(replayTs) {
+		t.Error("Bad first packet", wait, ts)
+	}
+	wait, ts = r.packet(replayTs.Add(2 * time.Second))
+	if wait != 500*time.Millisecond || !ts.Equal(replayTs.Add(2*time.Second)) {
+		t.Error("Bad second packet", wait, ts)
+	}
+	wait, _ = r.packet(replayTs.Add(time.Second))
+	if wait != 0 {
+		t.Error("Expected no wait going backwards", wait)
+	}
+
+	r = newReplayer(&config.InterfacesConfig{Speed: 4, TopSpeed: true})
+	r.packet(replayTs)
+	wait, _ = r.packet(replayTs.Add(2 * time.Second))
+	if wait != 0 {
+		t.Error("Expected no wait at top speed", wait)
+	}
+}
+
+func TestReplay_shift(t *testing.T) {
+	r := newReplayer(&config.InterfacesConfig{TopSpeed: true})
+
+	before := time.Now()
+	_, ts := r.packet(replayTs)
+	if ts.Before(before) || ts.After(time.Now()) {
+		t.Error("The first packet should be shifted to now", ts)
+	}
+	_, last := r.packet(replayTs.Add(3 * time.Second))
+	if last.Sub(ts) != 3*time.Second {
+		t.Error("Bad shift of the second packet", last, ts)
+	}
+
+	r.rewind()
+	_, next := r.packet(replayTs)
+	if next.Sub(last) != REPLAY_LOOP_GAP {
+		t.Error("Bad shift of the second loop", next, last)
+	}
+}
+
+func TestReplay_keepTimestampsLoop(t *testing.T) {
+	r := newReplayer(&config.InterfacesConfig{TopSpeed: true, KeepTimestamps: true})
+
+	r.packet(replayTs)
+	_, last := r.packet(replayTs.Add(time.Second))
+	r.rewind()
+	_, ts := r.packet(replayTs)
+	if !ts.Equal(last.Add(REPLAY_LOOP_GAP)) {
+		t.Error("Bad timestamp of the second loop", ts)
+	}
+}
+
+func TestReplay_window(t *testing.T) {
+	r := newReplayer(&config.InterfacesConfig{
+		StartTime: replayTs,
+		EndTime:   replayTs.Add(time.Minute),
+	})
+
+	if !r.beforeStart(replayTs.Add(-time.Second)) || r.beforeStart(replayTs) {
+		t.Error("Bad start of the window")
+	}
+	if r.afterEnd(replayTs.Add(time.Minute)) || !r.afterEnd(replayTs.Add(2*time.Minute)) {
+		t.Error("Bad end of the window")
+	}
+
+	r = newReplayer(&config.InterfacesConfig{})
+	if r.beforeStart(replayTs) || r.afterEnd(replayTs) {
+		t.Error("Expected no window")
+	}
+}
@@ -6,26 +6,76 @@ import (
 	"os"
 	"packetbeat/common"
 	"packetbeat/config"
+	"packetbeat/dumps"
 	"packetbeat/logp"
 	"packetbeat/protos/tcp"
+	"packetbeat/protos/udp"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/packetbeat/gopacket"
 	"github.com/packetbeat/gopacket/layers"
 	"github.com/packetbeat/gopacket/pcap"
+	"github.com/packetbeat/gopacket/pcapgo"
 )
 
+// Number of packets read on the devices that can be queued before
+// their reader goroutines block, when sniffing on more than one device.
+const SNIFFER_QUEUE_SIZE = 1024
+
 type SnifferSetup struct {
+	config *config.InterfacesConfig
+	dumper *dumps.RotatingDumper
+	filter string
+	replay *replayer
+	stats  *statsReporter
+
+	// set atomically, Stop is called from another goroutine than Run
+	isAlive int32
+
+	// packets of the configured protocols, when only they are dumped
+	dumpFilter *pcap.BPF
+
+	// the devices to sniff on, or the file to read, or the interfaces
+	// of the pcapng file in the order of their description blocks
+	devices []*captureDevice
+	pcapng  *pcapngReader
+
+	// the standard input or the named pipe read as a stream
+	stream *os.File
+
+	// packets of all the devices, when there is more than one
+	packets chan capturedPacket
+	done    chan struct{}
+}
+
+// A device, or a file, with the handle reading its packets and the
+// decoder of its link type.
+type captureDevice struct {
+	name           string
 	pcapHandle     *pcap.Handle
 	afpacketHandle *AfpacketHandle
 	pfringHandle   *PfringHandle
-	config         *config.InterfacesConfig
-	isAlive        bool
-	dumper         *pcap.Dumper
+	pcapngIface    *pcapngInterface
+	streamReader   *pcapgo.Reader
+
+	// index of the socket in the fanout group of the device
+	reader int
 
-	Decoder    *tcp.DecoderStruct
 	DataSource gopacket.PacketDataSource
+	Decoder    *tcp.DecoderStruct
+}
+
+// A packet, or a read error, passed by the reader goroutine of a device.
+type capturedPacket struct {
+	device *captureDevice
+	data   []byte
+	ci     gopacket.CaptureInfo
+	err    error
 }
 
 // Computes the block_size and the num_blocks in such a way that the
@@ -53,8 +103,6 @@ func afpacketComputeSize(target_size_mb int, snaplen int, page_size int) (
 }
 
 func (sniffer *SnifferSetup) setFromConfig(config *config.InterfacesConfig) error {
-	var err error
-
 	sniffer.config = config
 
 	if len(sniffer.config.File) > 0 {
@@ -76,10 +124,11 @@ func (sniffer *SnifferSetup) setFromConfig(config *config.InterfacesConfig) erro
 		}
 	}
 	if sniffer.config.Snaplen == 0 {
-		if sniffer.config.Devices[0] == "any" || sniffer.config.Devices[0] == "lo" {
-			sniffer.config.Snaplen = 16436
-		} else {
-			sniffer.config.Snaplen = 1514
+		sniffer.config.Snaplen = 1514
+		for _, device := range sniffer.config.Devices {
+			if device == "any" || device == "lo" {
+				sniffer.config.Snaplen = 16436
+			}
 		}
 	}
 
@@ -89,127 +138,230 @@ func (sniffer *SnifferSetup) setFromConfig(config *config.InterfacesConfig) erro
 
 	logp.Debug("sniffer", "Sniffer type: %s devices: %s", sniffer.config.Type, sniffer.config.Devices)
 
-	switch sniffer.config.Type {
-	case "pcap":
-		if len(sniffer.config.File) > 0 {
-			sniffer.pcapHandle, err = pcap.OpenOffline(sniffer.config.File)
-			if err != nil {
-				return err
-			}
-		} else {
-			if len(sniffer.config.Devices) > 1 {
-				return fmt.Errorf("Pcap sniffer only supports one device. You can use 'any' if you want")
+	if len(sniffer.config.File) > 0 {
+		stream, err := isStream(sniffer.config.File)
+		if err != nil {
+			return err
+		}
+		if stream {
+			if sniffer.config.OneAtATime && sniffer.config.File == "-" {
+				return fmt.Errorf("The packets of the standard input can't be " +
+					"read one at a time")
 			}
-			sniffer.pcapHandle, err = pcap.OpenLive(
-				sniffer.config.Devices[0],
-				int32(sniffer.config.Snaplen),
-				true,
-				500*time.Millisecond)
+			return sniffer.openStream(sniffer.config.File)
+		}
+
+		pcapng, err := isPcapngFile(sniffer.config.File)
+		if err != nil {
+			return err
+		}
+		if pcapng {
+			sniffer.pcapng, err = openPcapng(sniffer.config.File)
+			return err
+		}
+
+		handle, err := pcap.OpenOffline(sniffer.config.File)
+		if err != nil {
+			return err
+		}
+		sniffer.devices = []*captureDevice{{
+			pcapHandle: handle,
+			DataSource: gopacket.PacketDataSource(handle),
+		}}
+		return nil
+	}
+
+	readers := 1
+	if len(sniffer.config.Fanout) > 0 {
+		if sniffer.config.Type != "af_packet" {
+			return fmt.Errorf("Fanout is only supported by the af_packet sniffer")
+		}
+		switch sniffer.config.Fanout {
+		case "hash", "cpu", "lb":
+		default:
+			return fmt.Errorf("Unknown fanout mode: %s", sniffer.config.Fanout)
+		}
+		if sniffer.config.Fanout_readers <= 0 {
+			sniffer.config.Fanout_readers = runtime.NumCPU()
+		}
+		if sniffer.config.Fanout_group <= 0 {
+			// not shared with another packetbeat by default
+			sniffer.config.Fanout_group = os.Getpid() & 0xffff
+		}
+		readers = sniffer.config.Fanout_readers
+	}
+
+	for i, name := range sniffer.config.Devices {
+		for reader := 0; reader < readers; reader++ {
+			dev, err := sniffer.openDevice(name)
 			if err != nil {
-				return err
+				sniffer.Close()
+				return fmt.Errorf("%s: %s", name, err)
 			}
-			err = sniffer.pcapHandle.SetBPFFilter(sniffer.config.Bpf_filter)
-			if err != nil {
-				return err
+			sniffer.devices = append(sniffer.devices, dev)
+
+			if len(sniffer.config.Fanout) > 0 {
+				// the sockets of a fanout group must be bound to
+				// the same device
+				dev.reader = reader
+				group := uint16(sniffer.config.Fanout_group + i)
+				err = dev.afpacketHandle.SetFanout(sniffer.config.Fanout, group)
+				if err != nil {
+					sniffer.Close()
+					return fmt.Errorf("%s: SetFanout failed: %s", name, err)
+				}
 			}
 		}
+	}
 
-		sniffer.DataSource = gopacket.PacketDataSource(sniffer.pcapHandle)
+	return nil
+}
+
+// Opens the capture handle of the device, with the BPF filter set.
+func (sniffer *SnifferSetup) openDevice(name string) (*captureDevice, error) {
+	var err error
+	dev := &captureDevice{name: name}
+
+	switch sniffer.config.Type {
+	case "pcap":
+		dev.pcapHandle, err = pcap.OpenLive(
+			name,
+			int32(sniffer.config.Snaplen),
+			true,
+			500*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+
+		err = dev.pcapHandle.SetBPFFilter(sniffer.filter)
+		if err != nil {
+			dev.pcapHandle.Close()
+			return nil, fmt.Errorf("SetBPFFilter failed: %s", err)
+		}
+
+		dev.DataSource = gopacket.PacketDataSource(dev.pcapHandle)
 
 	case "af_packet":
 		if sniffer.config.Buffer_size_mb == 0 {
 			sniffer.config.Buffer_size_mb = 24
 		}
 
-		if len(sniffer.config.Devices) > 1 {
-			return fmt.Errorf("Afpacket sniffer only supports one device. You can use 'any' if you want")
-		}
-
 		frame_size, block_size, num_blocks, err := afpacketComputeSize(
 			sniffer.config.Buffer_size_mb,
 			sniffer.config.Snaplen,
 			os.Getpagesize())
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		sniffer.afpacketHandle, err = NewAfpacketHandle(
-			sniffer.config.Devices[0],
+		dev.afpacketHandle, err = NewAfpacketHandle(
+			name,
 			frame_size,
 			block_size,
 			num_blocks,
 			500*time.Millisecond)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		err = sniffer.afpacketHandle.SetBPFFilter(sniffer.config.Bpf_filter)
+		err = dev.afpacketHandle.SetBPFFilter(sniffer.filter)
 		if err != nil {
-			return fmt.Errorf("SetBPFFilter failed: %s", err)
+			dev.afpacketHandle.Close()
+			return nil, fmt.Errorf("SetBPFFilter failed: %s", err)
 		}
 
-		sniffer.DataSource = gopacket.PacketDataSource(sniffer.afpacketHandle)
-	case "pfring":
-		if len(sniffer.config.Devices) > 1 {
-			return fmt.Errorf("Afpacket sniffer only supports one device. You can use 'any' if you want")
-		}
+		dev.DataSource = gopacket.PacketDataSource(dev.afpacketHandle)
 
-		sniffer.pfringHandle, err = NewPfringHandle(
-			sniffer.config.Devices[0],
+	case "pfring":
+		dev.pfringHandle, err = NewPfringHandle(
+			name,
 			sniffer.config.Snaplen,
 			true)
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		err = sniffer.pfringHandle.SetBPFFilter(sniffer.config.Bpf_filter)
+		err = dev.pfringHandle.SetBPFFilter(sniffer.filter)
 		if err != nil {
-			return fmt.Errorf("SetBPFFilter failed: %s", err)
+			dev.pfringHandle.Close()
+			return nil, fmt.Errorf("SetBPFFilter failed: %s", err)
 		}
 
-		err = sniffer.pfringHandle.Enable()
+		err = dev.pfringHandle.Enable()
 		if err != nil {
-			return fmt.Errorf("Enable failed: %s", err)
+			dev.pfringHandle.Close()
+			return nil, fmt.Errorf("Enable failed: %s", err)
 		}
 
-		sniffer.DataSource = gopacket.PacketDataSource(sniffer.pfringHandle)
+		dev.DataSource = gopacket.PacketDataSource(dev.pfringHandle)
 
 	default:
-		return fmt.Errorf("Unknown sniffer type: %s", sniffer.config.Type)
+		return nil, fmt.Errorf("Unknown sniffer type: %s", sniffer.config.Type)
 	}
 
-	return nil
+	return dev, nil
 }
 
 func (sniffer *SnifferSetup) Reopen() error {
-	var err error
-
 	if sniffer.config.Type != "pcap" || sniffer.config.File == "" {
 		return fmt.Errorf("Reopen is only possible for files")
 	}
 
-	sniffer.pcapHandle.Close()
-	sniffer.pcapHandle, err = pcap.OpenOffline(sniffer.config.File)
+	if sniffer.pcapng != nil {
+		sniffer.pcapng.Close()
+		pcapng, err := openPcapng(sniffer.config.File)
+		if err != nil {
+			return err
+		}
+		sniffer.pcapng = pcapng
+		return nil
+	}
+
+	dev := sniffer.devices[0]
+	dev.pcapHandle.Close()
+	handle, err := pcap.OpenOffline(sniffer.config.File)
 	if err != nil {
 		return err
 	}
-
-	sniffer.DataSource = gopacket.PacketDataSource(sniffer.pcapHandle)
+	dev.pcapHandle = handle
+	dev.DataSource = gopacket.PacketDataSource(handle)
 
 	return nil
 }
 
-func (sniffer *SnifferSetup) Datalink() layers.LinkType {
-	if sniffer.config.Type == "pcap" {
-		return sniffer.pcapHandle.LinkType()
+func (dev *captureDevice) Datalink() layers.LinkType {
+	if dev.pcapHandle != nil {
+		return dev.pcapHandle.LinkType()
+	}
+	if dev.pcapngIface != nil {
+		return dev.pcapngIface.LinkType
+	}
+	if dev.streamReader != nil {
+		return dev.streamReader.LinkType()
 	}
 	return layers.LinkTypeEthernet
 }
 
+func (dev *captureDevice) Close() {
+	switch {
+	case dev.pcapHandle != nil:
+		dev.pcapHandle.Close()
+	case dev.afpacketHandle != nil:
+		dev.afpacketHandle.Close()
+	case dev.pfringHandle != nil:
+		dev.pfringHandle.Close()
+	}
+}
+
 func (sniffer *SnifferSetup) Init(test_mode bool, events chan common.MapStr) error {
-	config.ConfigSingleton.Interfaces.Bpf_filter =
-		tcp.ConfigToFilter(config.ConfigSingleton.Protocols)
+	sniffer.filter = bpfFilter(&config.ConfigSingleton.Interfaces,
+		config.ConfigSingleton.Protocols)
+	if len(sniffer.filter) > 0 {
+		logp.Info("BPF filter: %s", sniffer.filter)
+	} else {
+		logp.Info("No BPF filter, capturing all the traffic")
+	}
 
 	var err error
 	if !test_mode {
@@ -217,25 +369,65 @@ func (sniffer *SnifferSetup) Init(test_mode bool, events chan common.MapStr) err
 		if err != nil {
 			return fmt.Errorf("Error creating sniffer: %v", err)
 		}
+
+		// The filter isn't set when reading from a file, compile it
+		// anyway so that the configuration errors show up.
+		for _, dev := range sniffer.devices {
+			if len(sniffer.filter) == 0 {
+				break
+			}
+			_, err = pcap.CompileBPFFilter(dev.Datalink(),
+				sniffer.config.Snaplen, sniffer.filter)
+			if err != nil {
+				return fmt.Errorf("Invalid BPF filter %q: %v", sniffer.filter, err)
+			}
+		}
+
+		if sniffer.stream != nil {
+			// the packets are processed as they arrive, with their
+			// timestamps
+			sniffer.replay = newReplayer(sniffer.config)
+			sniffer.replay.speed = 0
+			sniffer.replay.keepTimestamps = true
+			if sniffer.config.Loop != 1 || sniffer.config.TopSpeed ||
+				sniffer.config.Speed > 0 && sniffer.config.Speed != 1 {
+				logp.Warn("The loop and speed options are ignored for the streams")
+			}
+		} else if len(sniffer.config.File) > 0 {
+			sniffer.replay = newReplayer(sniffer.config)
+		} else if sniffer.config.Stats_interval >= 0 {
+			sniffer.stats = newStatsReporter(sniffer.config, events)
+		}
 	}
 
-	sniffer.Decoder, err = tcp.CreateDecoder(sniffer.Datalink())
-	if err != nil {
-		return fmt.Errorf("Error creating decoder: %v", err)
+	for _, dev := range sniffer.devices {
+		dev.Decoder, err = tcp.CreateDecoder(dev.Datalink())
+		if err != nil {
+			return fmt.Errorf("Error creating decoder: %v", err)
+		}
+		dev.Decoder.Device = dev.name
+	}
+	if sniffer.pcapng != nil {
+		sniffer.pcapngDevice(len(sniffer.pcapng.interfaces) - 1)
 	}
 
 	if sniffer.config.Dumpfile != "" {
-		p, err := pcap.OpenDead(sniffer.Datalink(), 65535)
-		if err != nil {
-			return err
+		datalink := sniffer.devices[0].Datalink()
+		for _, dev := range sniffer.devices {
+			if dev.Datalink() != datalink {
+				return fmt.Errorf("Can't dump the packets of devices with "+
+					"different link types: %s is %s, %s is %s",
+					sniffer.devices[0].name, datalink, dev.name, dev.Datalink())
+			}
 		}
-		sniffer.dumper, err = p.NewDumper(sniffer.config.Dumpfile)
+
+		sniffer.dumper, err = sniffer.newDumper(datalink)
 		if err != nil {
 			return err
 		}
 	}
 
-	sniffer.isAlive = true
+	atomic.StoreInt32(&sniffer.isAlive, 1)
 
 	return nil
 }
@@ -243,30 +435,60 @@ func (sniffer *SnifferSetup) Init(test_mode bool, events chan common.MapStr) err
 func (sniffer *SnifferSetup) Run() error {
 	counter := 0
 	loopCount := 1
-	var lastPktTime *time.Time = nil
 	var ret_error error
 
-	for sniffer.isAlive {
+	if len(sniffer.devices) > 1 {
+		sniffer.startReaders()
+		defer close(sniffer.done)
+	}
+
+	for sniffer.IsAlive() {
 		if sniffer.config.OneAtATime {
 			fmt.Println("Press enter to read packet")
 			fmt.Scanln()
 		}
 
-		data, ci, err := sniffer.DataSource.ReadPacketData()
+		dev, data, ci, err := sniffer.readPacket()
+
+		if sniffer.stats != nil {
+			sniffer.stats.tick(time.Now(), sniffer.devices)
+		}
+
+		if err == nil && sniffer.replay != nil {
+			if sniffer.replay.beforeStart(ci.Timestamp) {
+				continue
+			}
+			if sniffer.replay.afterEnd(ci.Timestamp) {
+				logp.Debug("sniffer", "End of the time window")
+				err = io.EOF
+			}
+		}
 
 		if err == pcap.NextErrorTimeoutExpired || err == syscall.EINTR {
 			logp.Debug("sniffer", "Interrupted")
+			sniffer.idle()
 			continue
 		}
 
+		if err == io.ErrUnexpectedEOF && sniffer.stream != nil {
+			logp.Warn("The stream ended in the middle of a packet")
+			err = io.EOF
+		}
+
 		if err == io.EOF {
 			logp.Debug("sniffer", "End of file")
 			loopCount += 1
-			if sniffer.config.Loop > 0 && loopCount > sniffer.config.Loop {
+			// a stream ends when its writer closes it, it can't be
+			// read again
+			if sniffer.stream != nil ||
+				sniffer.config.Loop > 0 && loopCount > sniffer.config.Loop {
+				// wait for the TCP workers to process what was read
+				tcp.Flush()
+
 				// give a bit of time to the publish goroutine
 				// to flush
 				time.Sleep(300 * time.Millisecond)
-				sniffer.isAlive = false
+				atomic.StoreInt32(&sniffer.isAlive, 0)
 				continue
 			}
 
@@ -274,49 +496,96 @@ func (sniffer *SnifferSetup) Run() error {
 			err = sniffer.Reopen()
 			if err != nil {
 				ret_error = fmt.Errorf("Error reopening file: %s", err)
-				sniffer.isAlive = false
+				atomic.StoreInt32(&sniffer.isAlive, 0)
 				continue
 			}
-			lastPktTime = nil
+			sniffer.replay.rewind()
+			continue
+		}
+
+		if err != nil && sniffer.stream != nil && !sniffer.IsAlive() {
+			// the stream was closed by Stop
 			continue
 		}
 
 		if err != nil {
 			ret_error = fmt.Errorf("Sniffing error: %s", err)
-			sniffer.isAlive = false
+			atomic.StoreInt32(&sniffer.isAlive, 0)
 			continue
 		}
 
 		if len(data) == 0 {
 			// Empty packet, probably timeout from afpacket
+			sniffer.idle()
 			continue
 		}
 
-		if sniffer.config.File != "" {
-			if lastPktTime != nil && !sniffer.config.TopSpeed {
-				sleep := ci.Timestamp.Sub(*lastPktTime)
-				if sleep > 0 {
-					time.Sleep(sleep)
-				} else {
-					logp.Warn("Time in pcap went backwards: %d", sleep)
-				}
+		if dev.Decoder == nil {
+			// interface of a pcapng file with an unsupported link type
+			continue
+		}
+
+		if sniffer.replay != nil {
+			var wait time.Duration
+			wait, ci.Timestamp = sniffer.replay.packet(ci.Timestamp)
+			if wait > 0 {
+				time.Sleep(wait)
 			}
-			_lastPktTime := ci.Timestamp
-			lastPktTime = &_lastPktTime
-			ci.Timestamp = time.Now() // overwrite what we get from the pcap
 		}
 		counter++
 
-		if sniffer.dumper != nil {
-			sniffer.dumper.WritePacketData(data, ci)
+		if sniffer.dumper != nil && (sniffer.dumpFilter == nil ||
+			sniffer.dumpFilter.Matches(ci, data)) {
+
+			err = sniffer.dumper.WritePacketData(data, ci)
+			if err != nil {
+				logp.Err("Error writing the dump, stopping it: %s", err)
+				sniffer.dumper.Close()
+				sniffer.dumper = nil
+			}
 		}
 		logp.Debug("sniffer", "Packet number: %d", counter)
 
-		sniffer.Decoder.DecodePacketData(data, &ci)
+		dev.Decoder.DecodePacketData(data, &ci)
 	}
 
 	logp.Info("Input finish. Processed %d packets. Have a nice day!", counter)
 
+	for _, dev := range sniffer.devices {
+		counters, err := dev.Stats()
+		if err != nil {
+			continue
+		}
+		name := dev.name
+		if len(sniffer.config.Fanout) > 0 {
+			name = fmt.Sprintf("Socket %d of %s", dev.reader, dev.name)
+		}
+		logp.Info("%s: %d packets received, %d dropped by the kernel, "+
+			"%d by the interface, %d decoding errors", name, counters.Received,
+			counters.Dropped, counters.IfDropped, counters.DecodingErrors)
+	}
+
+	memory := tcp.GetMemoryStats()
+	if memory.EvictedStreams > 0 {
+		logp.Info("TCP streams evicted over the memory budget: %d, holding %d bytes",
+			memory.EvictedStreams, memory.EvictedBytes)
+	}
+
+	var defrag tcp.DefragStats
+	for _, dev := range sniffer.devices {
+		if dev.Decoder == nil {
+			continue
+		}
+		stats := dev.Decoder.DefragStats()
+		defrag.Fragments += stats.Fragments
+		defrag.Reassembled += stats.Reassembled
+		defrag.Failed += stats.Failed
+	}
+	if defrag.Fragments > 0 {
+		logp.Info("IP fragments: %d, reassembled datagrams: %d, failed datagrams: %d",
+			defrag.Fragments, defrag.Reassembled, defrag.Failed)
+	}
+
 	if sniffer.dumper != nil {
 		sniffer.dumper.Close()
 	}
@@ -324,23 +593,222 @@ func (sniffer *SnifferSetup) Run() error {
 	return ret_error
 }
 
+// Returns the writer of the dump files, with the filter of the
+// protocols traffic if only this one is dumped.
+func (sniffer *SnifferSetup) newDumper(datalink layers.LinkType) (*dumps.RotatingDumper, error) {
+	dumper := &dumps.RotatingDumper{
+		Path:             filepath.Dir(sniffer.config.Dumpfile),
+		Name:             filepath.Base(sniffer.config.Dumpfile),
+		Datalink:         datalink,
+		Snaplen:          sniffer.config.Dump_snaplen,
+		RotateEveryBytes: uint64(sniffer.config.Dump_rotate_kb) * 1024,
+		RotateInterval:   time.Duration(sniffer.config.Dump_interval) * time.Millisecond,
+		KeepFiles:        sniffer.config.Dump_keep_files,
+	}
+	if dumper.Snaplen == 0 {
+		// the packets of the files can be longer than the snaplen of
+		// the live capture
+		dumper.Snaplen = sniffer.config.Snaplen
+		if len(sniffer.config.File) > 0 {
+			dumper.Snaplen = 65535
+		}
+	}
+	if dumper.RotateEveryBytes == 0 {
+		dumper.RotateEveryBytes = 10 * 1024 * 1024
+	}
+	if dumper.KeepFiles == 0 {
+		dumper.KeepFiles = 7
+	}
+	err := dumper.CheckIfConfigSane()
+	if err != nil {
+		return nil, err
+	}
+
+	if sniffer.config.Dump_protocols {
+		filter := configToFilter(sniffer.config, config.ConfigSingleton.Protocols)
+		if len(filter) > 0 {
+			handle, err := pcap.OpenDead(datalink, int32(dumper.Snaplen))
+			if err != nil {
+				return nil, err
+			}
+			sniffer.dumpFilter, err = handle.NewBPF(filter)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid filter of the dump %q: %v", filter, err)
+			}
+		}
+	}
+
+	logp.Info("Dumping the packets to %s", sniffer.config.Dumpfile)
+	return dumper, nil
+}
+
+// Starts a goroutine per device, reading its packets into the queue of
+// the sniffer until the sniffer stops. With fanout, each socket is a
+// device of its own. Only the reads are parallel: the packets are
+// decoded by the loop of Run, as the UDP plugins and the handshake
+// tracking of the TCP layer aren't safe for concurrent use, and the
+// protocols are then parsed in parallel by the TCP workers.
+func (sniffer *SnifferSetup) startReaders() {
+	sniffer.packets = make(chan capturedPacket, SNIFFER_QUEUE_SIZE)
+	sniffer.done = make(chan struct{})
+
+	for _, dev := range sniffer.devices {
+		go func(dev *captureDevice) {
+			for {
+				data, ci, err := dev.DataSource.ReadPacketData()
+				select {
+				case sniffer.packets <- capturedPacket{dev, data, ci, err}:
+				case <-sniffer.done:
+					return
+				}
+				if err != nil && err != pcap.NextErrorTimeoutExpired &&
+					err != syscall.EINTR {
+					return
+				}
+			}
+		}(dev)
+	}
+}
+
+// Returns the next packet and the device it was read from. The packets
+// of more than one device are taken from the queue, in the order they
+// were read.
+func (sniffer *SnifferSetup) readPacket() (*captureDevice, []byte,
+	gopacket.CaptureInfo, error) {
+
+	if sniffer.pcapng != nil {
+		data, ci, iface, err := sniffer.pcapng.ReadPacketData()
+		if err != nil {
+			return nil, nil, ci, err
+		}
+		return sniffer.pcapngDevice(iface.Id), data, ci, nil
+	}
+
+	if sniffer.packets == nil {
+		dev := sniffer.devices[0]
+		data, ci, err := dev.DataSource.ReadPacketData()
+		return dev, data, ci, err
+	}
+
+	p := <-sniffer.packets
+	if p.err != nil && p.err != pcap.NextErrorTimeoutExpired && p.err != syscall.EINTR {
+		p.err = fmt.Errorf("%s: %s", p.device.name, p.err)
+	}
+	return p.device, p.data, p.ci, p.err
+}
+
+// Returns the device of the interface of the pcapng file. The devices
+// are created, with their decoder, up to the interface, as their
+// description blocks are read.
+func (sniffer *SnifferSetup) pcapngDevice(id int) *captureDevice {
+	for len(sniffer.devices) <= id {
+		iface := sniffer.pcapng.interfaces[len(sniffer.devices)]
+		dev := &captureDevice{name: iface.Name, pcapngIface: iface}
+
+		var err error
+		dev.Decoder, err = tcp.CreateDecoder(iface.LinkType)
+		if err != nil {
+			logp.Warn("Ignoring the packets of the interface %d (%s) of the file: %s",
+				iface.Id, iface.Name, err)
+		} else {
+			dev.Decoder.Device = dev.name
+		}
+		sniffer.devices = append(sniffer.devices, dev)
+	}
+	return sniffer.devices[id]
+}
+
+// Called when no packet arrived before the read timeout, so that the
+// streams and transactions expire also without traffic.
+func (sniffer *SnifferSetup) idle() {
+	if sniffer.config.File == "" {
+		tcp.Tick(time.Now())
+		udp.Tick(time.Now())
+	}
+}
+
+// Returns the BPF filter of the sniffer: the bpf_filter option AND-ed
+// with the filter generated from the protocols, or the bpf_filter option
+// alone if it replaces the generated filter.
+func bpfFilter(interfaces *config.InterfacesConfig,
+	protocols map[string]config.Protocol) string {
+
+	filter := strings.TrimSpace(interfaces.Bpf_filter)
+	if interfaces.Replace_bpf_filter {
+		return filter
+	}
+
+	generated := configToFilter(interfaces, protocols)
+	if len(filter) == 0 {
+		return generated
+	}
+	if len(generated) == 0 {
+		return filter
+	}
+	// The user filter comes first, so that a vlan keyword in it moves
+	// the offsets of the generated filter after the tag.
+	return fmt.Sprintf("(%s) and (%s)", filter, generated)
+}
+
+// Returns the BPF filter matching the TCP and the UDP traffic of the
+// configured protocols.
+func configToFilter(interfaces *config.InterfacesConfig,
+	protocols map[string]config.Protocol) string {
+
+	filters := []string{}
+	for _, filter := range []string{
+		tcp.ConfigToFilter(protocols),
+		udp.ConfigToFilter(protocols),
+	} {
+		if len(filter) > 0 {
+			filters = append(filters, filter)
+		}
+	}
+	if len(filters) == 0 {
+		return ""
+	}
+
+	if interfaces.With_tunnels {
+		// the packets inside GRE and VXLAN tunnels can't be
+		// filtered on their ports
+		filters = append(filters, "ip proto gre", "udp port 4789")
+	}
+	filter := strings.Join(filters, " or ")
+
+	if interfaces.With_vlans {
+		// The vlan keyword moves the offsets used by the rest of the
+		// expression after the tag, so the second vlan matches the
+		// inner tag of the QinQ packets.
+		filter = fmt.Sprintf("%s or (vlan and (%s)) or (vlan and (%s))",
+			filter, filter, filter)
+	}
+
+	return filter
+}
+
 func (sniffer *SnifferSetup) Close() error {
-	switch sniffer.config.Type {
-	case "pcap":
-		sniffer.pcapHandle.Close()
-	case "af_packet":
-		sniffer.afpacketHandle.Close()
-	case "pfring":
-		sniffer.pfringHandle.Close()
+	for _, dev := range sniffer.devices {
+		dev.Close()
+	}
+	if sniffer.pcapng != nil {
+		sniffer.pcapng.Close()
+	}
+	if sniffer.stream != nil {
+		sniffer.stream.Close()
 	}
 	return nil
 }
 
 func (sniffer *SnifferSetup) Stop() error {
-	sniffer.isAlive = false
+	atomic.StoreInt32(&sniffer.isAlive, 0)
+	if sniffer.stream != nil {
+		// unblocks the read waiting for the writer, the stream is
+		// read through the runtime poller, see openStream
+		sniffer.stream.Close()
+	}
 	return nil
 }
 
 func (sniffer *SnifferSetup) IsAlive() bool {
-	return sniffer.isAlive
+	return atomic.LoadInt32(&sniffer.isAlive) != 0
 }
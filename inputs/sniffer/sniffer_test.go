@@ -1,7 +1,13 @@
 package sniffer
 
 import (
+	"errors"
+	"packetbeat/config"
 	"testing"
+	"time"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
 )
 
 func TestSniffer_afpacketComputeSize(t *testing.T) {
@@ -49,3 +55,168 @@ func TestSniffer_afpacketComputeSize(t *testing.T) {
 		t.Error("Bad result", frame_size, block_size, num_blocks)
 	}
 }
+
+func TestSniffer_configToFilter(t *testing.T) {
+	protocols := map[string]config.Protocol{
+		"http": config.Protocol{Ports: []int{80}},
+	}
+
+	filter := configToFilter(&config.InterfacesConfig{}, protocols)
+	if filter != "port 80" {
+		t.Error("Bad filter", filter)
+	}
+
+	filter = configToFilter(&config.InterfacesConfig{With_vlans: true}, protocols)
+	if filter != "port 80 or (vlan and (port 80)) or (vlan and (port 80))" {
+		t.Error("Bad filter", filter)
+	}
+
+	filter = configToFilter(&config.InterfacesConfig{With_tunnels: true}, protocols)
+	if filter != "port 80 or ip proto gre or udp port 4789" {
+		t.Error("Bad filter", filter)
+	}
+
+	filter = configToFilter(&config.InterfacesConfig{With_vlans: true}, nil)
+	if filter != "" {
+		t.Error("Bad filter", filter)
+	}
+}
+
+func TestSniffer_bpfFilter(t *testing.T) {
+	protocols := map[string]config.Protocol{
+		"http": config.Protocol{Ports: []int{80}},
+	}
+
+	filter := bpfFilter(&config.InterfacesConfig{}, protocols)
+	if filter != "port 80" {
+		t.Error("Bad filter", filter)
+	}
+
+	filter = bpfFilter(&config.InterfacesConfig{
+		Bpf_filter: " not host 10.0.0.1 "}, protocols)
+	if filter != "(not host 10.0.0.1) and (port 80)" {
+		t.Error("Bad filter", filter)
+	}
+
+	filter = bpfFilter(&config.InterfacesConfig{
+		Bpf_filter: "vlan 100", Replace_bpf_filter: true}, protocols)
+	if filter != "vlan 100" {
+		t.Error("Bad filter", filter)
+	}
+
+	filter = bpfFilter(&config.InterfacesConfig{
+		Bpf_filter: "not host 10.0.0.1"}, nil)
+	if filter != "not host 10.0.0.1" {
+		t.Error("Bad filter", filter)
+	}
+}
+
+// Data source returning its packets and then an error.
+type testDataSource struct {
+	packets [][]byte
+}
+
+func (s *testDataSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(s.packets) == 0 {
+		return nil, gopacket.CaptureInfo{}, errors.New("closed")
+	}
+	data := s.packets[0]
+	s.packets = s.packets[1:]
+	return data, gopacket.CaptureInfo{Length: len(data)}, nil
+}
+
+func TestSniffer_readPacket_devices(t *testing.T) {
+	sniffer := SnifferSetup{devices: []*captureDevice{
+		{name: "eth0", DataSource: &testDataSource{[][]byte{{1}, {2}}}},
+		{name: "eth1", DataSource: &testDataSource{[][]byte{{3}}}},
+	}}
+	sniffer.startReaders()
+	defer close(sniffer.done)
+
+	read := map[string][]byte{}
+	closed := 0
+	for closed < 2 {
+		dev, data, _, err := sniffer.readPacket()
+		if err != nil {
+			if err.Error() != dev.name+": closed" {
+				t.Error("Bad error", err)
+			}
+			closed++
+			continue
+		}
+		read[dev.name] = append(read[dev.name], data...)
+	}
+
+	if string(read["eth0"]) != "\x01\x02" || string(read["eth1"]) != "\x03" {
+		t.Error("Bad packets", read)
+	}
+}
+
+func TestSniffer_fanoutConfig(t *testing.T) {
+	var sniffer SnifferSetup
+
+	err := sniffer.setFromConfig(&config.InterfacesConfig{
+		Type: "pcap", Devices: []string{"eth0"}, Fanout: "hash"})
+	if err == nil {
+		t.Error("Expected an error for fanout without af_packet")
+	}
+
+	err = sniffer.setFromConfig(&config.InterfacesConfig{
+		Type: "af_packet", Devices: []string{"eth0"}, Fanout: "rollover"})
+	if err == nil {
+		t.Error("Expected an error for an unknown fanout mode")
+	}
+	if len(sniffer.devices) != 0 {
+		t.Error("No device should be opened")
+	}
+}
+
+func TestSniffer_newDumper(t *testing.T) {
+	var sniffer SnifferSetup
+	sniffer.config = &config.InterfacesConfig{
+		Dumpfile: "/var/lib/packetbeat/dump.pcap",
+		Snaplen:  1514,
+	}
+
+	dumper, err := sniffer.newDumper(layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dumper.Path != "/var/lib/packetbeat" || dumper.Name != "dump.pcap" {
+		t.Error("Bad dump file", dumper.Path, dumper.Name)
+	}
+	if dumper.Snaplen != 1514 || dumper.KeepFiles != 7 ||
+		dumper.RotateEveryBytes != 10*1024*1024 || dumper.RotateInterval != 0 {
+		t.Error("Bad defaults", dumper)
+	}
+	if sniffer.dumpFilter != nil {
+		t.Error("Unexpected dump filter")
+	}
+
+	// the packets of a file are dumped whole, and only the packets of
+	// the protocols
+	sniffer.config.File = "trace.pcap"
+	sniffer.config.Dump_interval = 60000
+	sniffer.config.Dump_protocols = true
+	config.ConfigSingleton.Protocols = map[string]config.Protocol{
+		"http": {Ports: []int{80}},
+	}
+	defer func() { config.ConfigSingleton.Protocols = nil }()
+
+	dumper, err = sniffer.newDumper(layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dumper.Snaplen != 65535 || dumper.RotateInterval != time.Minute {
+		t.Error("Bad settings", dumper)
+	}
+	if sniffer.dumpFilter == nil {
+		t.Error("Expected a dump filter")
+	}
+
+	sniffer.config.Dump_keep_files = 1000
+	_, err = sniffer.newDumper(layers.LinkTypeEthernet)
+	if err == nil {
+		t.Error("Expected an error for too many files")
+	}
+}
@@ -0,0 +1,186 @@
+package sniffer
+
+import (
+	"fmt"
+	"packetbeat/common"
+	"packetbeat/config"
+	"packetbeat/logp"
+	"packetbeat/protos/tcp"
+	"time"
+)
+
+// Counters of a capture device, since it was opened.
+type captureCounters struct {
+	Received       uint64 // packets received by the capture handle
+	Dropped        uint64 // dropped by the kernel, for lack of buffer space
+	IfDropped      uint64 // dropped by the network interface or its driver
+	DecodingErrors uint64 // packets whose layers couldn't be decoded
+}
+
+// Returns the counters of the device. The error is set for the capture
+// handles that don't count the packets, the decoding errors are counted
+// anyway.
+func (dev *captureDevice) Stats() (captureCounters, error) {
+	var counters captureCounters
+	if dev.Decoder != nil {
+		counters.DecodingErrors = dev.Decoder.DecodingErrors()
+	}
+
+	switch {
+	case dev.pcapHandle != nil && dev.name != "":
+		stats, err := dev.pcapHandle.Stats()
+		if err != nil {
+			return counters, err
+		}
+		counters.Received = uint64(stats.PacketsReceived)
+		counters.Dropped = uint64(stats.PacketsDropped)
+		counters.IfDropped = uint64(stats.PacketsIfDropped)
+
+	case dev.afpacketHandle != nil:
+		received, dropped, err := dev.afpacketHandle.Stats()
+		if err != nil {
+			return counters, err
+		}
+		counters.Received = uint64(received)
+		counters.Dropped = uint64(dropped)
+
+	case dev.pfringHandle != nil:
+		received, dropped, err := dev.pfringHandle.Stats()
+		if err != nil {
+			return counters, err
+		}
+		counters.Received = uint64(received)
+		counters.Dropped = uint64(dropped)
+
+	default:
+		return counters, fmt.Errorf("No statistics for this capture handle")
+	}
+	return counters, nil
+}
+
+// Publishes the counters of the capture devices every interval, as
+// events of type capture_stats when an interval is configured, and warns
+// when the share of dropped packets exceeds the threshold. The use of
+// the memory budget of the TCP streams is logged at the same interval.
+type statsReporter struct {
+	interval  time.Duration
+	threshold float64 // percentage of the received packets
+	fanout    bool
+	events    chan common.MapStr
+
+	next       time.Time
+	last       map[*captureDevice]captureCounters
+	lastMemory tcp.MemoryStats
+}
+
+func newStatsReporter(config *config.InterfacesConfig,
+	events chan common.MapStr) *statsReporter {
+
+	reporter := &statsReporter{
+		interval:  60 * time.Second,
+		threshold: 1,
+		fanout:    len(config.Fanout) > 0,
+		last:      make(map[*captureDevice]captureCounters),
+	}
+	if config.Stats_interval > 0 {
+		reporter.interval = time.Duration(config.Stats_interval) * time.Millisecond
+		reporter.events = events
+	}
+	if config.Drop_threshold > 0 {
+		reporter.threshold = config.Drop_threshold
+	}
+	reporter.next = time.Now().Add(reporter.interval)
+	return reporter
+}
+
+// Reports the counters of the devices if the interval elapsed.
+func (reporter *statsReporter) tick(now time.Time, devices []*captureDevice) {
+	if now.Before(reporter.next) {
+		return
+	}
+	reporter.next = now.Add(reporter.interval)
+
+	for _, dev := range devices {
+		reporter.report(now, dev)
+	}
+	reporter.reportMemory()
+}
+
+// Logs the memory held by the TCP streams, and warns when streams were
+// evicted over the budget during the interval.
+func (reporter *statsReporter) reportMemory() {
+	memory := tcp.GetMemoryStats()
+	last := reporter.lastMemory
+	reporter.lastMemory = memory
+
+	evicted := memory.EvictedStreams - last.EvictedStreams
+	if evicted > 0 {
+		logp.Warn("%d TCP streams holding %d bytes evicted over the memory budget "+
+			"in the last %v, %d of %d bytes used", evicted,
+			memory.EvictedBytes-last.EvictedBytes, reporter.interval,
+			memory.Used, memory.Budget)
+		return
+	}
+	logp.Info("TCP streams memory: %d of %d bytes used, %d streams evicted "+
+		"holding %d bytes since the start", memory.Used, memory.Budget,
+		memory.EvictedStreams, memory.EvictedBytes)
+}
+
+// Publishes the counters of the device over the last interval.
+func (reporter *statsReporter) report(now time.Time, dev *captureDevice) {
+	counters, err := dev.Stats()
+	last := reporter.last[dev]
+	reporter.last[dev] = counters
+
+	stats := common.MapStr{
+		"interval":        int64(reporter.interval / time.Millisecond),
+		"decoding_errors": increase(counters.DecodingErrors, last.DecodingErrors),
+	}
+	if reporter.fanout {
+		stats["socket"] = dev.reader
+	}
+	if err != nil {
+		logp.Debug("sniffer", "No capture statistics for %s: %s", dev.name, err)
+	} else {
+		received := increase(counters.Received, last.Received)
+		dropped := increase(counters.Dropped, last.Dropped)
+		ifDropped := increase(counters.IfDropped, last.IfDropped)
+		stats["received"] = received
+		stats["dropped"] = dropped
+		stats["if_dropped"] = ifDropped
+
+		lost := dropped + ifDropped
+		if lost > 0 && float64(lost)*100 > reporter.threshold*float64(received) {
+			logp.Warn("%s: %d packets dropped by the kernel and %d by the interface "+
+				"in the last %v, for %d received", dev.name, dropped, ifDropped,
+				reporter.interval, received)
+		}
+	}
+
+	if reporter.events == nil {
+		return
+	}
+	event := common.MapStr{}
+	event["type"] = "capture_stats"
+	event["@timestamp"] = common.Time(now)
+	if len(dev.name) > 0 {
+		event["device"] = dev.name
+	}
+	event["capture_stats"] = stats
+
+	// the decoding of the packets doesn't wait for the output
+	select {
+	case reporter.events <- event:
+	default:
+		logp.Warn("Dropping the capture statistics of %s, the output is busy", dev.name)
+	}
+}
+
+// Returns the increase of a counter. The 32 bits counters of pcap wrap
+// around, in which case the counter is taken from 0.
+func increase(counter uint64, last uint64) uint64 {
+	if counter < last {
+		return counter
+	}
+	return counter - last
+}
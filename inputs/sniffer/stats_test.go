@@ -0,0 +1,103 @@
+package sniffer
+
+import (
+	"packetbeat/common"
+	"packetbeat/config"
+	"packetbeat/protos/tcp"
+	"testing"
+	"time"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+)
+
+func TestStats_increase(t *testing.T) {
+	if increase(15, 10) != 5 {
+		t.Error("Bad increase")
+	}
+	// wrapped around
+	if increase(3, 1<<32-2) != 3 {
+		t.Error("Bad increase after wrapping")
+	}
+}
+
+func TestStats_report(t *testing.T) {
+	decoder, err := tcp.CreateDecoder(layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &captureDevice{name: "eth0", reader: 2, Decoder: decoder}
+
+	// Ethernet header of an IPv4 packet cut after a few bytes
+	truncated := []byte{
+		0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 1, 0x08, 0x00, 0x45, 0,
+	}
+	ci := gopacket.CaptureInfo{Timestamp: time.Now()}
+	dev.Decoder.DecodePacketData(truncated, &ci)
+	dev.Decoder.DecodePacketData(truncated, &ci)
+
+	events := make(chan common.MapStr, 10)
+	reporter := newStatsReporter(&config.InterfacesConfig{
+		Fanout:         "hash",
+		Stats_interval: 5000,
+	}, events)
+	if reporter.interval != 5*time.Second || reporter.threshold != 1 {
+		t.Error("Bad reporter settings", reporter.interval, reporter.threshold)
+	}
+
+	// nothing before the end of the interval
+	now := time.Now()
+	reporter.tick(now, []*captureDevice{dev})
+	if len(events) != 0 {
+		t.Fatal("Unexpected event")
+	}
+
+	now = now.Add(6 * time.Second)
+	reporter.tick(now, []*captureDevice{dev})
+	if len(events) != 1 {
+		t.Fatal("Expected an event", len(events))
+	}
+	event := <-events
+	if event["type"] != "capture_stats" || event["device"] != "eth0" ||
+		event["@timestamp"] != common.Time(now) {
+		t.Error("Bad event", event)
+	}
+	stats := event["capture_stats"].(common.MapStr)
+	if stats["decoding_errors"] != uint64(2) || stats["socket"] != 2 ||
+		stats["interval"] != int64(5000) {
+		t.Error("Bad stats", stats)
+	}
+	// the device has no capture handle to count the packets
+	if _, exists := stats["received"]; exists {
+		t.Error("Unexpected received packets", stats)
+	}
+
+	// the counters are reported for each interval
+	dev.Decoder.DecodePacketData(truncated, &ci)
+	reporter.tick(now.Add(6*time.Second), []*captureDevice{dev})
+	stats = (<-events)["capture_stats"].(common.MapStr)
+	if stats["decoding_errors"] != uint64(1) {
+		t.Error("Bad stats", stats)
+	}
+}
+
+func TestStats_eventsDisabled(t *testing.T) {
+	dev := &captureDevice{name: "eth0"}
+	events := make(chan common.MapStr, 1)
+
+	// the counters are checked, but not published, by default
+	reporter := newStatsReporter(&config.InterfacesConfig{}, events)
+	now := time.Now()
+	reporter.tick(now.Add(time.Hour), []*captureDevice{dev})
+	if len(events) != 0 {
+		t.Error("Unexpected event")
+	}
+
+	// a busy output doesn't block the reporter
+	reporter = newStatsReporter(&config.InterfacesConfig{Stats_interval: 1000}, events)
+	reporter.tick(now.Add(time.Hour), []*captureDevice{dev})
+	reporter.tick(now.Add(2*time.Hour), []*captureDevice{dev})
+	if len(events) != 1 {
+		t.Error("Expected one event", len(events))
+	}
+}
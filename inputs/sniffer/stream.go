@@ -0,0 +1,72 @@
+package sniffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/pcapgo"
+)
+
+// Returns true if the file to read is the standard input, given as "-",
+// or a named pipe. These are read as streams, as the packets are written
+// to them, for example by tcpdump -U -w -.
+func isStream(name string) (bool, error) {
+	if name == "-" {
+		return true, nil
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return false, err
+	}
+	return info.Mode()&os.ModeNamedPipe != 0, nil
+}
+
+// Opens the stream, in the pcap or in the pcapng format. Opening a named
+// pipe waits for its writer, and reading the headers waits for the
+// writer to send them.
+func (sniffer *SnifferSetup) openStream(name string) error {
+	if name == "-" {
+		// The standard input is blocking, its reads couldn't be
+		// interrupted. Once non-blocking, it is read through the
+		// runtime poller like the named pipes, and closing it
+		// unblocks the read waiting for the writer.
+		err := syscall.SetNonblock(syscall.Stdin, true)
+		if err != nil {
+			return fmt.Errorf("Error reading the stream: %s", err)
+		}
+		sniffer.stream = os.NewFile(uintptr(syscall.Stdin), "/dev/stdin")
+	} else {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		sniffer.stream = f
+	}
+	r := bufio.NewReader(sniffer.stream)
+
+	magic, err := r.Peek(4)
+	if err != nil {
+		return fmt.Errorf("Error reading the stream: %s", err)
+	}
+	if binary.BigEndian.Uint32(magic) == pcapngSectionHeader {
+		sniffer.pcapng, err = newPcapngReader(r)
+		if err != nil {
+			return fmt.Errorf("Error reading the stream: %s", err)
+		}
+		return nil
+	}
+
+	reader, err := pcapgo.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("Error reading the stream: %s", err)
+	}
+	sniffer.devices = []*captureDevice{{
+		streamReader: reader,
+		DataSource:   gopacket.PacketDataSource(reader),
+	}}
+	return nil
+}
@@ -0,0 +1,221 @@
+// +build !windows
+
+package sniffer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"packetbeat/config"
+	"packetbeat/protos/tcp"
+	"packetbeat/protos/udp"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Creates a named pipe and writes the data to it from a goroutine, then
+// closes it.
+func testWriteFifo(t *testing.T, data []byte) (string, func()) {
+	dir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "fifo")
+	err = syscall.Mkfifo(name, 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	go func() {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		f.Write(data)
+		f.Close()
+	}()
+	return name, func() { os.RemoveAll(dir) }
+}
+
+func testStreamSniffer(t *testing.T, name string) *SnifferSetup {
+	config.ConfigSingleton.Interfaces = config.InterfacesConfig{File: name, Loop: 1}
+
+	sniffer := new(SnifferSetup)
+	err := sniffer.Init(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sniffer
+}
+
+func TestSniffer_isStream(t *testing.T) {
+	stream, err := isStream("-")
+	if err != nil || !stream {
+		t.Error("Expected the standard input to be a stream", err)
+	}
+	stream, err = isStream("../../tests/pcaps/http_minitwit.pcap")
+	if err != nil || stream {
+		t.Error("Expected a file", err)
+	}
+
+	name, cleanup := testWriteFifo(t, nil)
+	defer cleanup()
+	stream, err = isStream(name)
+	if err != nil || !stream {
+		t.Error("Expected the named pipe to be a stream", err)
+	}
+	// let the writer go
+	f, _ := os.Open(name)
+	f.Close()
+}
+
+func TestSniffer_readStream(t *testing.T) {
+	data, err := ioutil.ReadFile("../../tests/pcaps/http_minitwit.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, cleanup := testWriteFifo(t, data)
+	defer cleanup()
+	defer func() { config.ConfigSingleton.Interfaces = config.InterfacesConfig{} }()
+
+	sniffer := testStreamSniffer(t, name)
+	defer sniffer.Close()
+
+	if sniffer.stream == nil || len(sniffer.devices) != 1 {
+		t.Fatal("Expected a stream")
+	}
+	if !sniffer.replay.keepTimestamps || sniffer.replay.speed != 0 {
+		t.Error("Expected the stream to keep its pace and its timestamps")
+	}
+
+	count := 0
+	for {
+		_, _, _, err := sniffer.readPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 104 {
+		t.Error("Bad number of packets", count)
+	}
+}
+
+func TestSniffer_readPcapngStream(t *testing.T) {
+	name, cleanup := testWriteFifo(t, testPcapngFile())
+	defer cleanup()
+	defer func() { config.ConfigSingleton.Interfaces = config.InterfacesConfig{} }()
+
+	sniffer := testStreamSniffer(t, name)
+	defer sniffer.Close()
+
+	if sniffer.pcapng == nil {
+		t.Fatal("Expected a pcapng stream")
+	}
+	count := 0
+	for {
+		_, _, _, err := sniffer.readPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 4 {
+		t.Error("Bad number of packets", count)
+	}
+}
+
+func TestSniffer_stopStream(t *testing.T) {
+	data, err := ioutil.ReadFile("../../tests/pcaps/http_minitwit.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "fifo")
+	err = syscall.Mkfifo(name, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { config.ConfigSingleton.Interfaces = config.InterfacesConfig{} }()
+
+	// the writer sends the file header, then nothing
+	writer := make(chan *os.File, 1)
+	go func() {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			writer <- nil
+			return
+		}
+		f.Write(data[:24])
+		writer <- f
+	}()
+
+	err = tcp.TcpInit(map[string]config.Protocol{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sniffer := testStreamSniffer(t, name)
+	defer sniffer.Close()
+	if f := <-writer; f != nil {
+		defer f.Close()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- sniffer.Run() }()
+	time.Sleep(100 * time.Millisecond)
+	sniffer.Stop()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Stop to interrupt the read of the stream")
+	}
+}
+
+func TestSniffer_runStream(t *testing.T) {
+	data, err := ioutil.ReadFile("../../tests/pcaps/http_minitwit.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cut in the middle of the last packet
+	name, cleanup := testWriteFifo(t, data[:len(data)-10])
+	defer cleanup()
+	defer func() { config.ConfigSingleton.Interfaces = config.InterfacesConfig{} }()
+
+	err = tcp.TcpInit(map[string]config.Protocol{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = udp.UdpInit(map[string]config.Protocol{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sniffer := testStreamSniffer(t, name)
+	defer sniffer.Close()
+
+	// the stream ends when the writer closes it
+	err = sniffer.Run()
+	if err != nil {
+		t.Error(err)
+	}
+	if sniffer.IsAlive() {
+		t.Error("Expected the sniffer to stop")
+	}
+}
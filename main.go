@@ -16,21 +16,25 @@ import (
 	"packetbeat/common"
 	"packetbeat/common/droppriv"
 	"packetbeat/config"
+	"packetbeat/dumps"
 	"packetbeat/filters"
 	"packetbeat/filters/nop"
 	"packetbeat/inputs"
+	"packetbeat/inputs/pcapdir"
 	"packetbeat/inputs/sniffer"
 	"packetbeat/inputs/udpjson"
 	"packetbeat/logp"
 	"packetbeat/outputs"
 	"packetbeat/procs"
 	"packetbeat/protos"
+	"packetbeat/protos/dns"
 	"packetbeat/protos/http"
 	"packetbeat/protos/mysql"
 	"packetbeat/protos/pgsql"
 	"packetbeat/protos/redis"
 	"packetbeat/protos/tcp"
 	"packetbeat/protos/thrift"
+	"packetbeat/protos/udp"
 
 	"github.com/BurntSushi/toml"
 )
@@ -43,11 +47,13 @@ var EnabledProtocolPlugins map[protos.Protocol]protos.ProtocolPlugin = map[proto
 	protos.PgsqlProtocol:  new(pgsql.Pgsql),
 	protos.RedisProtocol:  new(redis.Redis),
 	protos.ThriftProtocol: new(thrift.Thrift),
+	protos.DnsProtocol:    new(dns.Dns),
 }
 
 var EnabledInputPlugins map[inputs.Input]inputs.InputPlugin = map[inputs.Input]inputs.InputPlugin{
 	inputs.SnifferInput: new(sniffer.SnifferSetup),
 	inputs.UdpjsonInput: new(udpjson.Udpjson),
+	inputs.PcapdirInput: new(pcapdir.PcapDir),
 }
 
 var EnabledFilterPlugins map[filters.Filter]filters.FilterPlugin = map[filters.Filter]filters.FilterPlugin{
@@ -79,18 +85,22 @@ func main() {
 	var cmdLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
 	configfile := cmdLine.String("c", "packetbeat.conf", "Configuration file")
-	file := cmdLine.String("I", "", "file")
+	file := cmdLine.String("I", "", "Read packets from this file, a named pipe, or - for the standard input")
 	loop := cmdLine.Int("l", 1, "Loop file. 0 - loop forever")
 	debugSelectorsStr := cmdLine.String("d", "", "Enable certain debug selectors")
 	oneAtAtime := cmdLine.Bool("O", false, "Read packets one at a time (press Enter)")
 	toStderr := cmdLine.Bool("e", false, "Output to stdout instead of syslog")
 	topSpeed := cmdLine.Bool("t", false, "Read packets as fast as possible, without sleeping")
+	keepTimestamps := cmdLine.Bool("T", false, "Keep the timestamps of the packets read from the file")
+	speed := cmdLine.Float64("speed", 0, "Read packets this many times faster than they were captured")
+	startTime := cmdLine.String("start", "", "Skip the packets of the file before this time (RFC 3339)")
+	endTime := cmdLine.String("end", "", "Stop reading the file after this time (RFC 3339)")
 	publishDisabled := cmdLine.Bool("N", false, "Disable actual publishing for testing")
 	verbose := cmdLine.Bool("v", false, "Log at INFO level")
 	printVersion := cmdLine.Bool("version", false, "Print version and exit")
 	memprofile := cmdLine.String("memprofile", "", "Write memory profile to this file")
 	cpuprofile := cmdLine.String("cpuprofile", "", "Write cpu profile to file")
-	dumpfile := cmdLine.String("dump", "", "Write all captured packets to this libpcap file.")
+	dumpfile := cmdLine.String("dump", "", "Write the captured packets to this libpcap file, rotated by size.")
 
 	cmdLine.Parse(os.Args[1:])
 
@@ -130,6 +140,30 @@ func main() {
 	if *topSpeed {
 		config.ConfigSingleton.Interfaces.TopSpeed = true
 	}
+	if *keepTimestamps {
+		config.ConfigSingleton.Interfaces.KeepTimestamps = true
+	}
+	if *speed < 0 {
+		fmt.Printf("Invalid speed %g, it must be positive. Exiting.\n", *speed)
+		return
+	}
+	if *speed > 0 {
+		config.ConfigSingleton.Interfaces.Speed = *speed
+	}
+	if len(*startTime) > 0 {
+		config.ConfigSingleton.Interfaces.StartTime, err = time.Parse(time.RFC3339, *startTime)
+		if err != nil {
+			fmt.Printf("Invalid start time %s: %s. Exiting.\n", *startTime, err)
+			return
+		}
+	}
+	if len(*endTime) > 0 {
+		config.ConfigSingleton.Interfaces.EndTime, err = time.Parse(time.RFC3339, *endTime)
+		if err != nil {
+			fmt.Printf("Invalid end time %s: %s. Exiting.\n", *endTime, err)
+			return
+		}
+	}
 	if len(*file) > 0 {
 		config.ConfigSingleton.Interfaces.File = *file
 	}
@@ -150,6 +184,11 @@ func main() {
 		return
 	}
 
+	if err = dumps.Triggered.Init(&config.ConfigSingleton.Dumps); err != nil {
+		logp.Critical(err.Error())
+		return
+	}
+
 	outputs.LoadGeoIPData()
 
 	logp.Debug("main", "Initializing protocol plugins")
@@ -162,7 +201,11 @@ func main() {
 		protos.Protos.Register(proto, plugin)
 	}
 
-	if err = tcp.TcpInit(config.ConfigSingleton.Protocols); err != nil {
+	if err = tcp.TcpInit(config.ConfigSingleton.Protocols, outputs.Publisher.Queue); err != nil {
+		logp.Critical(err.Error())
+		return
+	}
+	if err = udp.UdpInit(config.ConfigSingleton.Protocols); err != nil {
 		logp.Critical(err.Error())
 		return
 	}
@@ -277,8 +320,8 @@ func main() {
 	inputs.Inputs.CloseAll()
 
 	if *memprofile != "" {
-		// wait for all TCP streams to expire
-		time.Sleep(tcp.TCP_STREAM_EXPIRY * 1.2)
+		// expire all TCP streams
+		tcp.ExpireAll()
 		tcp.PrintTcpMap()
 		runtime.GC()
 
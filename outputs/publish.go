@@ -7,6 +7,7 @@ import (
 	"os"
 	"packetbeat/common"
 	"packetbeat/config"
+	"packetbeat/dumps"
 	"packetbeat/logp"
 	"strings"
 	"time"
@@ -118,6 +119,9 @@ func (publisher *PublisherType) publishEvent(event common.MapStr) error {
 		return nil
 	}
 
+	// the frames of the failing transactions are written to a file
+	dumps.Triggered.HandleEvent(event)
+
 	event["agent"] = publisher.name
 	if len(publisher.tags) > 0 {
 		event["tags"] = publisher.tags
@@ -16,6 +16,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -49,6 +50,9 @@ type ProcessesWatcher struct {
 	Processes     []*Process
 	LocalAddrs    []net.IP
 
+	// protects PortProcMap, as the lookups come from all TCP workers
+	mutex sync.Mutex
+
 	// config
 	ReadFromProc    bool
 	MaxReadFreq     time.Duration
@@ -207,6 +211,9 @@ func (proc *ProcessesWatcher) FindProc(port uint16) (procname string) {
 	procname = ""
 	defer logp.Recover("FindProc exception")
 
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+
 	p, exists := proc.PortProcMap[port]
 	if exists {
 		return p.Proc.Name
@@ -0,0 +1,538 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"packetbeat/common"
+	"packetbeat/logp"
+	"packetbeat/procs"
+	"packetbeat/protos"
+	"packetbeat/protos/tcp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TransactionsHashSize = 1 << 16
+	TransactionTimeout   = 10 * 1e9
+)
+
+// Size of the fixed header of the DNS messages.
+const DNS_HEADER_SIZE = 12
+
+// Maximum number of compression pointers followed to read a name.
+const DNS_MAX_POINTERS = 16
+
+// Transport protocols on which DNS runs.
+const (
+	TransportUdp = "udp"
+	TransportTcp = "tcp"
+)
+
+var (
+	errTooShort   = errors.New("DNS message too short")
+	errBadName    = errors.New("Invalid name in DNS message")
+	errNoQuestion = errors.New("DNS message without question")
+)
+
+var opcodeNames = map[uint8]string{
+	0: "QUERY",
+	1: "IQUERY",
+	2: "STATUS",
+	4: "NOTIFY",
+	5: "UPDATE",
+}
+
+var rcodeNames = map[uint8]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+var typeNames = map[uint16]string{
+	1:   "A",
+	2:   "NS",
+	5:   "CNAME",
+	6:   "SOA",
+	12:  "PTR",
+	13:  "HINFO",
+	15:  "MX",
+	16:  "TXT",
+	28:  "AAAA",
+	33:  "SRV",
+	35:  "NAPTR",
+	41:  "OPT",
+	43:  "DS",
+	46:  "RRSIG",
+	47:  "NSEC",
+	48:  "DNSKEY",
+	99:  "SPF",
+	251: "IXFR",
+	252: "AXFR",
+	255: "ANY",
+}
+
+var classNames = map[uint16]string{
+	1:   "IN",
+	3:   "CH",
+	4:   "HS",
+	254: "NONE",
+	255: "ANY",
+}
+
+type DnsMessage struct {
+	Ts           time.Time
+	Tuple        common.IpPortTuple
+	CmdlineTuple *common.CmdlineTuple
+	Transport    string
+	Handshake    *common.TcpHandshake
+	Size         int
+
+	Id         uint16
+	IsResponse bool
+	Opcode     uint8
+	Rcode      uint8
+
+	QuestionName  string
+	QuestionType  uint16
+	QuestionClass uint16
+
+	AnswersCount     uint16
+	AuthoritiesCount uint16
+	AdditionalsCount uint16
+}
+
+// Transactions are matched on the message ID and the tuple in the
+// direction of the query.
+type DnsTransactionKey struct {
+	tuple common.HashableIpPortTuple
+	id    uint16
+}
+
+type DnsTransaction struct {
+	key          DnsTransactionKey
+	ts           time.Time
+	Src          common.Endpoint
+	Dst          common.Endpoint
+	Transport    string
+	ResponseTime int32
+
+	Request  *DnsMessage
+	Response *DnsMessage
+
+	timer *protos.Timer
+}
+
+type DnsStream struct {
+	data []byte
+}
+
+type dnsPrivateData struct {
+	Data [2]*DnsStream
+}
+
+type Dns struct {
+	transactionsMap    map[DnsTransactionKey]*DnsTransaction
+	timers             *protos.Timers
+	transactionTimeout time.Duration
+
+	results chan common.MapStr
+}
+
+func (dns *Dns) Init(test_mode bool, results chan common.MapStr) error {
+	dns.transactionsMap = make(map[DnsTransactionKey]*DnsTransaction, TransactionsHashSize)
+	dns.timers = protos.NewTimers()
+	dns.transactionTimeout = protos.DnsProtocol.TransactionTimeout(TransactionTimeout)
+	dns.results = results
+
+	return nil
+}
+
+func (dns *Dns) New(timers *protos.Timers) protos.ProtocolPlugin {
+	instance := *dns
+	instance.transactionsMap = make(map[DnsTransactionKey]*DnsTransaction, TransactionsHashSize)
+	instance.timers = timers
+	return &instance
+}
+
+// Reads the name starting at offset, following the compression
+// pointers. Returns the name and the offset right after it.
+func readName(data []byte, offset int) (string, int, error) {
+	labels := []string{}
+	end := -1
+	pointers := 0
+
+	for {
+		if offset >= len(data) {
+			return "", 0, errBadName
+		}
+		length := int(data[offset])
+
+		switch {
+		case length == 0:
+			offset += 1
+			if end < 0 {
+				end = offset
+			}
+			if len(labels) == 0 {
+				// the root
+				return ".", end, nil
+			}
+			return strings.Join(labels, "."), end, nil
+
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(data) || pointers >= DNS_MAX_POINTERS {
+				return "", 0, errBadName
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = (length&0x3f)<<8 | int(data[offset+1])
+			pointers += 1
+
+		case length&0xc0 == 0:
+			if offset+1+length > len(data) {
+				return "", 0, errBadName
+			}
+			labels = append(labels, string(data[offset+1:offset+1+length]))
+			offset += 1 + length
+
+		default:
+			// extended label types are obsolete
+			return "", 0, errBadName
+		}
+	}
+}
+
+// Decodes the header and the first question of a DNS message. The
+// resource records are only counted.
+func decodeDnsMessage(data []byte) (*DnsMessage, error) {
+	if len(data) < DNS_HEADER_SIZE {
+		return nil, errTooShort
+	}
+
+	m := &DnsMessage{Size: len(data)}
+	m.Id = uint16(data[0])<<8 | uint16(data[1])
+	m.IsResponse = data[2]&0x80 != 0
+	m.Opcode = (data[2] >> 3) & 0x0f
+	m.Rcode = data[3] & 0x0f
+
+	questions := uint16(data[4])<<8 | uint16(data[5])
+	m.AnswersCount = uint16(data[6])<<8 | uint16(data[7])
+	m.AuthoritiesCount = uint16(data[8])<<8 | uint16(data[9])
+	m.AdditionalsCount = uint16(data[10])<<8 | uint16(data[11])
+
+	if questions == 0 {
+		return nil, errNoQuestion
+	}
+
+	name, offset, err := readName(data, DNS_HEADER_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	if offset+4 > len(data) {
+		return nil, errTooShort
+	}
+	m.QuestionName = name
+	m.QuestionType = uint16(data[offset])<<8 | uint16(data[offset+1])
+	m.QuestionClass = uint16(data[offset+2])<<8 | uint16(data[offset+3])
+
+	return m, nil
+}
+
+func opcodeName(opcode uint8) string {
+	name, exists := opcodeNames[opcode]
+	if !exists {
+		return strconv.Itoa(int(opcode))
+	}
+	return name
+}
+
+func rcodeName(rcode uint8) string {
+	name, exists := rcodeNames[rcode]
+	if !exists {
+		return strconv.Itoa(int(rcode))
+	}
+	return name
+}
+
+func typeName(typ uint16) string {
+	name, exists := typeNames[typ]
+	if !exists {
+		return fmt.Sprintf("TYPE%d", typ)
+	}
+	return name
+}
+
+func className(class uint16) string {
+	name, exists := classNames[class]
+	if !exists {
+		return fmt.Sprintf("CLASS%d", class)
+	}
+	return name
+}
+
+func (dns *Dns) ParseUdp(pkt *protos.Packet) {
+	defer logp.Recover("ParseDnsUdp exception")
+
+	m, err := decodeDnsMessage(pkt.Payload)
+	if err != nil {
+		logp.Debug("dns", "Ignoring DNS datagram: %s", err)
+		return
+	}
+	m.Ts = pkt.Ts
+	m.Tuple = pkt.Tuple
+	m.Transport = TransportUdp
+
+	dns.handleDns(m)
+}
+
+// Over TCP, each message is preceded by its length on two bytes.
+func (dns *Dns) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+
+	defer logp.Recover("ParseDns exception")
+
+	priv := dnsPrivateData{}
+	if private != nil {
+		var ok bool
+		priv, ok = private.(dnsPrivateData)
+		if !ok {
+			priv = dnsPrivateData{}
+		}
+	}
+
+	if priv.Data[dir] == nil {
+		priv.Data[dir] = &DnsStream{data: pkt.Payload}
+	} else {
+		// concatenate bytes
+		priv.Data[dir].data = append(priv.Data[dir].data, pkt.Payload...)
+		if len(priv.Data[dir].data) > tcp.TCP_MAX_DATA_IN_STREAM {
+			logp.Debug("dns", "Stream data too large, dropping TCP stream")
+			priv.Data[dir] = nil
+			return priv
+		}
+	}
+
+	stream := priv.Data[dir]
+	for len(stream.data) >= 2 {
+		length := int(stream.data[0])<<8 | int(stream.data[1])
+		if len(stream.data) < 2+length {
+			// wait for more data
+			break
+		}
+
+		m, err := decodeDnsMessage(stream.data[2 : 2+length])
+		if err != nil {
+			// drop this tcp stream. Will retry parsing with the next
+			// segment in it
+			logp.Debug("dns", "Ignore DNS message: %s. Drop tcp stream.", err)
+			priv.Data[dir] = nil
+			return priv
+		}
+		m.Ts = pkt.Ts
+		m.Tuple = *tcptuple.IpPort()
+		if dir == tcp.TcpDirectionReverse {
+			m.Tuple = common.NewIpPortTuple(tcptuple.Ip_length,
+				tcptuple.Dst_ip, tcptuple.Dst_port,
+				tcptuple.Src_ip, tcptuple.Src_port)
+			m.Tuple.Vlan = tcptuple.Vlan
+			m.Tuple.Device = tcptuple.Device
+			m.Tuple.ComputeHashebles()
+		}
+		m.Transport = TransportTcp
+		m.Handshake = tcptuple.Handshake
+
+		dns.handleDns(m)
+
+		stream.data = stream.data[2+length:]
+	}
+
+	return priv
+}
+
+func (dns *Dns) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+// A message missing bytes can't be decoded, the stream is dropped.
+func (dns *Dns) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	priv, ok := private.(dnsPrivateData)
+	if !ok {
+		return private
+	}
+	priv.Data[dir] = nil
+	return priv
+}
+
+func (dns *Dns) ReceivedRst(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	return nil
+}
+
+// The queries left without response are published by their timers.
+func (dns *Dns) ConnectionExpired(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+}
+
+// Returns the bytes buffered for the stream. The transactions are small
+// and expire quickly, they aren't counted.
+func (dns *Dns) StreamMemory(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) int {
+
+	size := 0
+	if priv, ok := private.(dnsPrivateData); ok {
+		for _, stream := range priv.Data {
+			if stream != nil {
+				size += len(stream.data)
+			}
+		}
+	}
+	return size
+}
+
+// The queries of the evicted stream are left to time out.
+func (dns *Dns) DropStream(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+}
+
+func (dns *Dns) handleDns(m *DnsMessage) {
+	m.CmdlineTuple = procs.ProcWatcher.FindProcessesTuple(&m.Tuple)
+
+	if m.IsResponse {
+		dns.receivedDnsResponse(m)
+	} else {
+		dns.receivedDnsRequest(m)
+	}
+}
+
+func (dns *Dns) receivedDnsRequest(msg *DnsMessage) {
+	key := DnsTransactionKey{tuple: msg.Tuple.Hashable(), id: msg.Id}
+
+	trans := dns.transactionsMap[key]
+	if trans != nil {
+		// a retransmitted query, the response time is measured
+		// from the first one
+		logp.Debug("dns", "Query %d for %s sent again", msg.Id, msg.QuestionName)
+		return
+	}
+
+	trans = &DnsTransaction{key: key, ts: msg.Ts, Transport: msg.Transport, Request: msg}
+	trans.Src = common.Endpoint{
+		Ip:   msg.Tuple.Src_ip.String(),
+		Port: msg.Tuple.Src_port,
+		Proc: string(msg.CmdlineTuple.Src),
+	}
+	trans.Dst = common.Endpoint{
+		Ip:   msg.Tuple.Dst_ip.String(),
+		Port: msg.Tuple.Dst_port,
+		Proc: string(msg.CmdlineTuple.Dst),
+	}
+	dns.transactionsMap[key] = trans
+
+	trans.timer = dns.timers.AfterFunc(dns.transactionTimeout, func() { dns.expireTransaction(trans) })
+}
+
+func (dns *Dns) receivedDnsResponse(msg *DnsMessage) {
+	key := DnsTransactionKey{tuple: msg.Tuple.RevHashable(), id: msg.Id}
+
+	trans := dns.transactionsMap[key]
+	if trans == nil {
+		logp.Debug("dns", "Response %d for %s from unknown transaction. Ignoring.",
+			msg.Id, msg.QuestionName)
+		return
+	}
+
+	trans.Response = msg
+	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
+
+	dns.publishTransaction(trans)
+
+	logp.Debug("dns", "DNS transaction completed: %d %s %s", msg.Id,
+		msg.QuestionName, rcodeName(msg.Rcode))
+
+	// remove from map
+	delete(dns.transactionsMap, key)
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+}
+
+// Queries without an answer are published as timeouts.
+func (dns *Dns) expireTransaction(trans *DnsTransaction) {
+	logp.Debug("dns", "DNS query %d for %s timed out", trans.Request.Id,
+		trans.Request.QuestionName)
+
+	dns.publishTransaction(trans)
+
+	// remove from map
+	delete(dns.transactionsMap, trans.key)
+}
+
+func (dns *Dns) publishTransaction(t *DnsTransaction) {
+
+	if dns.results == nil {
+		return
+	}
+
+	req := t.Request
+	dnsEvent := common.MapStr{
+		"id":        req.Id,
+		"op_code":   opcodeName(req.Opcode),
+		"transport": t.Transport,
+		"question": common.MapStr{
+			"name":  req.QuestionName,
+			"type":  typeName(req.QuestionType),
+			"class": className(req.QuestionClass),
+		},
+	}
+
+	event := common.MapStr{}
+	event["type"] = "dns"
+	event["method"] = opcodeName(req.Opcode)
+	event["path"] = req.QuestionName
+	event["query"] = fmt.Sprintf("class %s, type %s, %s", className(req.QuestionClass),
+		typeName(req.QuestionType), req.QuestionName)
+	event["bytes_in"] = uint64(req.Size)
+
+	if resp := t.Response; resp != nil {
+		if resp.Rcode == 0 {
+			event["status"] = common.OK_STATUS
+		} else {
+			event["status"] = common.ERROR_STATUS
+		}
+		event["responsetime"] = t.ResponseTime
+		event["bytes_out"] = uint64(resp.Size)
+
+		dnsEvent["response_code"] = rcodeName(resp.Rcode)
+		dnsEvent["answers_count"] = resp.AnswersCount
+		dnsEvent["authorities_count"] = resp.AuthoritiesCount
+		dnsEvent["additionals_count"] = resp.AdditionalsCount
+	} else {
+		event["status"] = common.ERROR_STATUS
+		dnsEvent["error"] = "Response timed out"
+	}
+	req.Tuple.AddFields(event)
+	req.Handshake.AddFields(event)
+	event["dns"] = dnsEvent
+
+	event["@timestamp"] = common.Time(t.ts)
+	event["src"] = &t.Src
+	event["dst"] = &t.Dst
+
+	dns.results <- event
+}
@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"encoding/hex"
+	"net"
+	"packetbeat/common"
+	"packetbeat/protos"
+	"packetbeat/protos/tcp"
+	"testing"
+	"time"
+)
+
+// Query for the A record of example.com.
+const testQuery = "123401000001000000000000076578616d706c6503636f6d0000010001"
+
+// NXDOMAIN response to the query, with the SOA record of the zone in
+// the authority section.
+const testResponse = "123481830001000000010000076578616d706c6503636f6d0000010001" +
+	"c00c0006000100000e10000c" + "0161c00c" + "0162c00c" + "00000001"
+
+var testTs = time.Date(2015, 3, 6, 12, 0, 0, 0, time.UTC)
+
+func DnsModForTests() (*Dns, chan common.MapStr) {
+	results := make(chan common.MapStr, 10)
+	var dns Dns
+	dns.Init(true, results)
+	dns.timers.Advance(testTs)
+	return &dns, results
+}
+
+func testDatagram(hexData string, fromClient bool, ts time.Time) *protos.Packet {
+	payload, err := hex.DecodeString(hexData)
+	if err != nil {
+		panic(err)
+	}
+	tuple := common.NewIpPortTuple(4,
+		net.IPv4(192, 168, 0, 1), 34000,
+		net.IPv4(192, 168, 0, 2), 53)
+	if !fromClient {
+		tuple = common.NewIpPortTuple(4,
+			net.IPv4(192, 168, 0, 2), 53,
+			net.IPv4(192, 168, 0, 1), 34000)
+	}
+	return &protos.Packet{Ts: ts, Tuple: tuple, Payload: payload}
+}
+
+func TestDnsParser_query(t *testing.T) {
+	data, err := hex.DecodeString(testQuery)
+	if err != nil {
+		t.Error("Failed to decode hex string")
+	}
+
+	m, err := decodeDnsMessage(data)
+	if err != nil {
+		t.Fatalf("Failed to decode the query: %s", err)
+	}
+	if m.Id != 0x1234 || m.IsResponse {
+		t.Errorf("Failed to decode the header: %d %v", m.Id, m.IsResponse)
+	}
+	if m.QuestionName != "example.com" {
+		t.Errorf("Wrong question name: %s", m.QuestionName)
+	}
+	if typeName(m.QuestionType) != "A" || className(m.QuestionClass) != "IN" {
+		t.Errorf("Wrong question type or class: %d %d", m.QuestionType, m.QuestionClass)
+	}
+}
+
+func TestDnsParser_response(t *testing.T) {
+	data, err := hex.DecodeString(testResponse)
+	if err != nil {
+		t.Error("Failed to decode hex string")
+	}
+
+	m, err := decodeDnsMessage(data)
+	if err != nil {
+		t.Fatalf("Failed to decode the response: %s", err)
+	}
+	if !m.IsResponse || rcodeName(m.Rcode) != "NXDOMAIN" {
+		t.Errorf("Failed to decode the header: %v %d", m.IsResponse, m.Rcode)
+	}
+	if m.AnswersCount != 0 || m.AuthoritiesCount != 1 || m.AdditionalsCount != 0 {
+		t.Errorf("Wrong counts: %d %d %d", m.AnswersCount, m.AuthoritiesCount,
+			m.AdditionalsCount)
+	}
+}
+
+func TestDnsParser_compressedName(t *testing.T) {
+	data, err := hex.DecodeString(testResponse)
+	if err != nil {
+		t.Error("Failed to decode hex string")
+	}
+
+	// the mname of the SOA record is a.example.com, pointing to the
+	// question
+	name, offset, err := readName(data, 41)
+	if err != nil || name != "a.example.com" || offset != 45 {
+		t.Errorf("Failed to read the compressed name: %s %d %v", name, offset, err)
+	}
+
+	// a pointer to itself
+	_, _, err = readName([]byte{0xc0, 0x00}, 0)
+	if err == nil {
+		t.Error("Expecting an error on a pointer loop")
+	}
+}
+
+func TestDns_udpTransaction(t *testing.T) {
+	dns, results := DnsModForTests()
+
+	dns.ParseUdp(testDatagram(testQuery, true, testTs))
+	dns.ParseUdp(testDatagram(testResponse, false, testTs.Add(20*time.Millisecond)))
+
+	if len(results) != 1 {
+		t.Fatalf("Expecting one transaction, got %d", len(results))
+	}
+	event := <-results
+	if event["status"] != common.ERROR_STATUS {
+		t.Errorf("Wrong status: %v", event["status"])
+	}
+	if event["responsetime"] != int32(20) {
+		t.Errorf("Wrong response time: %v", event["responsetime"])
+	}
+	dnsEvent := event["dns"].(common.MapStr)
+	if dnsEvent["response_code"] != "NXDOMAIN" {
+		t.Errorf("Wrong response code: %v", dnsEvent["response_code"])
+	}
+	if dnsEvent["authorities_count"] != uint16(1) {
+		t.Errorf("Wrong authorities count: %v", dnsEvent["authorities_count"])
+	}
+	question := dnsEvent["question"].(common.MapStr)
+	if question["name"] != "example.com" || question["type"] != "A" ||
+		question["class"] != "IN" {
+
+		t.Errorf("Wrong question: %v", question)
+	}
+	if len(dns.transactionsMap) != 0 {
+		t.Error("Transaction not removed")
+	}
+}
+
+func TestDns_responseFromOtherTuple(t *testing.T) {
+	dns, results := DnsModForTests()
+
+	dns.ParseUdp(testDatagram(testQuery, true, testTs))
+	response := testDatagram(testResponse, false, testTs)
+	response.Tuple = common.NewIpPortTuple(4,
+		net.IPv4(192, 168, 0, 3), 53,
+		net.IPv4(192, 168, 0, 1), 34000)
+	dns.ParseUdp(response)
+
+	if len(results) != 0 {
+		t.Errorf("Not expecting a transaction")
+	}
+}
+
+func TestDns_timeout(t *testing.T) {
+	dns, results := DnsModForTests()
+
+	dns.ParseUdp(testDatagram(testQuery, true, testTs))
+	dns.timers.Advance(testTs.Add(TransactionTimeout / 2))
+	if len(results) != 0 {
+		t.Fatalf("Not expecting a transaction before the timeout")
+	}
+
+	dns.timers.Advance(testTs.Add(TransactionTimeout))
+	if len(results) != 1 {
+		t.Fatalf("Expecting the query to be published on timeout")
+	}
+	event := <-results
+	if event["status"] != common.ERROR_STATUS {
+		t.Errorf("Wrong status: %v", event["status"])
+	}
+	if _, exists := event["responsetime"]; exists {
+		t.Errorf("Not expecting a response time")
+	}
+	if len(dns.transactionsMap) != 0 {
+		t.Error("Transaction not removed")
+	}
+}
+
+func TestDns_tcpLengthPrefix(t *testing.T) {
+	dns, results := DnsModForTests()
+
+	client := testDatagram(testQuery, true, testTs).Tuple
+	tuple := common.TcpTupleFromIpPort(&client, 1)
+
+	// the query is split after the length, the response comes in
+	// one segment
+	query, _ := hex.DecodeString("001d" + testQuery)
+	response, _ := hex.DecodeString("0035" + testResponse)
+
+	var private protos.ProtocolData
+	private = dns.Parse(&protos.Packet{Ts: testTs, Payload: query[:2]},
+		&tuple, tcp.TcpDirectionOriginal, private)
+	private = dns.Parse(&protos.Packet{Ts: testTs, Payload: query[2:]},
+		&tuple, tcp.TcpDirectionOriginal, private)
+	if len(dns.transactionsMap) != 1 {
+		t.Fatalf("Failed to parse the query")
+	}
+
+	dns.Parse(&protos.Packet{Ts: testTs, Payload: response},
+		&tuple, tcp.TcpDirectionReverse, private)
+	if len(results) != 1 {
+		t.Fatalf("Expecting one transaction, got %d", len(results))
+	}
+	event := <-results
+	if event["dns"].(common.MapStr)["transport"] != TransportTcp {
+		t.Errorf("Wrong transport: %v", event["dns"])
+	}
+}
@@ -93,7 +93,7 @@ type HttpTransaction struct {
 	Request_raw  string
 	Response_raw string
 
-	timer *time.Timer
+	timer *protos.Timer
 }
 
 type Http struct {
@@ -106,7 +106,9 @@ type Http struct {
 	Split_cookie      bool
 	Real_ip_header    string
 
-	transactionsMap map[common.HashableTcpTuple]*HttpTransaction
+	transactionsMap    map[common.HashableTcpTuple]*HttpTransaction
+	timers             *protos.Timers
+	transactionTimeout time.Duration
 
 	results chan common.MapStr
 }
@@ -162,6 +164,8 @@ func (http *Http) Init(test_mode bool, results chan common.MapStr) error {
 	}
 
 	http.transactionsMap = make(map[common.HashableTcpTuple]*HttpTransaction, TransactionsHashSize)
+	http.timers = protos.NewTimers()
+	http.transactionTimeout = protos.HttpProtocol.TransactionTimeout(TransactionTimeout)
 
 	logp.Debug("http", "transactionsMap: %p http: %p", http.transactionsMap, &http)
 
@@ -170,6 +174,29 @@ func (http *Http) Init(test_mode bool, results chan common.MapStr) error {
 	return nil
 }
 
+func (http *Http) New(timers *protos.Timers) protos.ProtocolPlugin {
+	instance := *http
+	instance.transactionsMap = make(map[common.HashableTcpTuple]*HttpTransaction, TransactionsHashSize)
+	instance.timers = timers
+	return &instance
+}
+
+var detectPrefixes = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("HEAD "), []byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "),
+	[]byte("CONNECT "), []byte("HTTP/1."),
+}
+
+// Detect recognizes a request line or a status line.
+func (http *Http) Detect(payload []byte, dir uint8) bool {
+	for _, prefix := range detectPrefixes {
+		if bytes.HasPrefix(payload, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func parseVersion(s []byte) (uint8, uint8, error) {
 	if len(s) < 3 {
 		return 0, 0, errors.New("Invalid version")
@@ -568,29 +595,87 @@ func (http *Http) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	if !ok {
 		return private
 	}
-	if httpData.Data[dir] == nil {
-		return httpData
+
+	http.flushMessage(tcptuple, dir, httpData.Data[dir])
+
+	return httpData
+}
+
+// Sends whatever data we got so far in the stream as a complete message.
+// This is needed for the HTTP/1.0 without Content-Length situation.
+func (http *Http) flushMessage(tcptuple *common.TcpTuple, dir uint8, stream *HttpStream) {
+	if stream == nil || stream.message == nil ||
+		len(stream.data[stream.message.start:]) == 0 {
+		return
 	}
 
-	stream := httpData.Data[dir]
+	logp.Debug("httpdetailed", "Publish something on connection close")
 
-	// send whatever data we got so far as complete. This
-	// is needed for the HTTP/1.0 without Content-Length situation.
-	if stream.message != nil &&
-		len(stream.data[stream.message.start:]) > 0 {
+	msg := stream.data[stream.message.start:]
+	http.censorPasswords(stream.message, msg)
 
-		logp.Debug("httpdetailed", "Publish something on connection FIN")
+	http.handleHttp(stream.message, tcptuple, dir, msg)
 
-		msg := stream.data[stream.message.start:]
-		http.censorPasswords(stream.message, msg)
+	// and reset message. Probably not needed, just to be sure.
+	stream.PrepareForNewMessage()
+}
 
-		http.handleHttp(stream.message, tcptuple, dir, msg)
+func (http *Http) ReceivedRst(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
 
-		// and reset message. Probably not needed, just to be sure.
-		stream.PrepareForNewMessage()
+	http.flushConnection(tcptuple, private)
+	return nil
+}
+
+func (http *Http) ConnectionExpired(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	http.flushConnection(tcptuple, private)
+}
+
+// Returns the bytes buffered for the stream and held by its transaction.
+func (http *Http) StreamMemory(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) int {
+
+	size := 0
+	if priv, ok := private.(httpPrivateData); ok {
+		for _, stream := range priv.Data {
+			if stream != nil {
+				size += len(stream.data)
+			}
+		}
+	}
+	trans := http.transactionsMap[tcptuple.Hashable()]
+	if trans != nil {
+		size += protos.TransactionOverhead +
+			len(trans.Request_raw) + len(trans.Response_raw)
 	}
+	return size
+}
 
-	return httpData
+// Drops the pending transaction of the evicted stream.
+func (http *Http) DropStream(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	trans := http.transactionsMap[tcptuple.Hashable()]
+	if trans != nil {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		delete(http.transactionsMap, tcptuple.Hashable())
+	}
+}
+
+// Flushes both directions of a closed connection, the request first.
+func (http *Http) flushConnection(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	httpData, ok := private.(httpPrivateData)
+	if !ok {
+		return
+	}
+	http.flushMessage(tcptuple, tcp.TcpDirectionOriginal, httpData.Data[tcp.TcpDirectionOriginal])
+	http.flushMessage(tcptuple, tcp.TcpDirectionReverse, httpData.Data[tcp.TcpDirectionReverse])
 }
 
 func (http *Http) GapInStream(tcptuple *common.TcpTuple, dir uint8,
@@ -678,7 +763,7 @@ func (http *Http) receivedHttpRequest(msg *HttpMessage) {
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
-	trans.timer = time.AfterFunc(TransactionTimeout, func() { http.expireTransaction(trans) })
+	trans.timer = http.timers.AfterFunc(http.transactionTimeout, func() { http.expireTransaction(trans) })
 
 }
 
@@ -764,6 +849,7 @@ func (http *Http) PublishTransaction(t *HttpTransaction) {
 		event["status"] = common.ERROR_STATUS
 	}
 	event["responsetime"] = t.ResponseTime
+	t.tuple.AddFields(event)
 	if http.Send_request {
 		event["request_raw"] = t.Request_raw
 	}
@@ -2,7 +2,10 @@ package http
 
 import (
 	"bytes"
+	"packetbeat/common"
 	"packetbeat/logp"
+	"packetbeat/protos"
+	"packetbeat/protos/tcp"
 	"strconv"
 	"testing"
 	"time"
@@ -843,3 +846,86 @@ func TestEatBodyChunkedWaitCRLF(t *testing.T) {
 		t.Error("Wrong message end", message.end)
 	}
 }
+
+func TestHttp_Detect(t *testing.T) {
+	var http Http
+
+	if !http.Detect([]byte("GET /index.html HTTP/1.1\r\n"), 1) {
+		t.Error("Request not detected")
+	}
+	if !http.Detect([]byte("HTTP/1.1 200 OK\r\n"), 0) {
+		t.Error("Response not detected")
+	}
+	if http.Detect([]byte("GETTING"), 1) || http.Detect([]byte("*1\r\n$4\r\nPING\r\n"), 1) {
+		t.Error("Not HTTP detected as HTTP")
+	}
+}
+
+func TestHttp_ReceivedRst(t *testing.T) {
+	results := make(chan common.MapStr, 10)
+	var http Http
+	http.Init(true, results)
+
+	request := protos.Packet{Ts: time.Now(), Payload: []byte(
+		"GET / HTTP/1.0\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n")}
+	response := protos.Packet{Ts: time.Now(), Payload: []byte(
+		"HTTP/1.0 200 OK\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"\r\n" +
+			"test")}
+
+	var tuple common.TcpTuple
+	private := http.Parse(&request, &tuple, tcp.TcpDirectionOriginal, nil)
+	private = http.Parse(&response, &tuple, tcp.TcpDirectionReverse, private)
+	if len(results) != 0 {
+		t.Errorf("Not expecting a transaction before the end of the connection")
+	}
+
+	private = http.ReceivedRst(&tuple, tcp.TcpDirectionReverse, private)
+	if private != nil {
+		t.Errorf("Expecting the private data to be dropped")
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expecting the transaction to be published on RST")
+	}
+	event := <-results
+	if event["http"].(common.MapStr)["content_length"] != 4 {
+		t.Errorf("Wrong content length: %v", event["http"])
+	}
+}
+
+func TestHttp_StreamMemory(t *testing.T) {
+	results := make(chan common.MapStr, 10)
+	var http Http
+	http.Init(true, results)
+
+	request := protos.Packet{Ts: time.Now(), Payload: []byte(
+		"GET / HTTP/1.1\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n")}
+	response := protos.Packet{Ts: time.Now(), Payload: []byte(
+		"HTTP/1.1 200 OK\r\n" +
+			"Content-Length: 10\r\n" +
+			"\r\n" +
+			"test")}
+
+	var tuple common.TcpTuple
+	private := http.Parse(&request, &tuple, tcp.TcpDirectionOriginal, nil)
+	private = http.Parse(&response, &tuple, tcp.TcpDirectionReverse, private)
+
+	// the incomplete response and the transaction of the request
+	size := http.StreamMemory(&tuple, private)
+	if size < len(response.Payload)+protos.TransactionOverhead {
+		t.Errorf("Wrong stream memory: %d", size)
+	}
+
+	http.DropStream(&tuple, private)
+	if len(http.transactionsMap) != 0 {
+		t.Errorf("Expecting the transaction to be dropped")
+	}
+	if len(results) != 0 {
+		t.Errorf("Not expecting a transaction to be published")
+	}
+}
@@ -1,6 +1,7 @@
 package mysql
 
 import (
+	"bytes"
 	"fmt"
 	"packetbeat/common"
 	"packetbeat/logp"
@@ -68,7 +69,7 @@ type MysqlTransaction struct {
 	Request_raw  string
 	Response_raw string
 
-	timer *time.Timer
+	timer *protos.Timer
 }
 
 type MysqlStream struct {
@@ -96,7 +97,9 @@ const (
 )
 
 type Mysql struct {
-	transactionsMap map[common.HashableTcpTuple]*MysqlTransaction
+	transactionsMap    map[common.HashableTcpTuple]*MysqlTransaction
+	timers             *protos.Timers
+	transactionTimeout time.Duration
 
 	results chan common.MapStr
 
@@ -107,12 +110,39 @@ type Mysql struct {
 
 func (mysql *Mysql) Init(test_mode bool, results chan common.MapStr) error {
 	mysql.transactionsMap = make(map[common.HashableTcpTuple]*MysqlTransaction, TransactionsHashSize)
+	mysql.timers = protos.NewTimers()
+	mysql.transactionTimeout = protos.MysqlProtocol.TransactionTimeout(TransactionTimeout)
 	mysql.handleMysql = handleMysql
 	mysql.results = results
 
 	return nil
 }
 
+func (mysql *Mysql) New(timers *protos.Timers) protos.ProtocolPlugin {
+	instance := *mysql
+	instance.transactionsMap = make(map[common.HashableTcpTuple]*MysqlTransaction, TransactionsHashSize)
+	instance.timers = timers
+	return &instance
+}
+
+// Detect recognizes the greeting packet that the server sends first,
+// for the protocol version 10.
+func (mysql *Mysql) Detect(payload []byte, dir uint8) bool {
+	if len(payload) < 6 {
+		return false
+	}
+
+	length := int(payload[0]) | int(payload[1])<<8 | int(payload[2])<<16
+	seq := payload[3]
+	version := payload[4]
+	if length+4 != len(payload) || seq != 0 || version != 10 {
+		return false
+	}
+
+	// followed by the null terminated server version
+	return bytes.IndexByte(payload[5:], 0) > 0
+}
+
 func (stream *MysqlStream) PrepareForNewMessage() {
 	stream.data = stream.data[stream.message.end:]
 	stream.parseState = MysqlStateStart
@@ -409,6 +439,86 @@ func (mysql *Mysql) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	return private
 }
 
+func (mysql *Mysql) ReceivedRst(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	mysql.flushConnection(tcptuple, private)
+	return nil
+}
+
+func (mysql *Mysql) ConnectionExpired(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	mysql.flushConnection(tcptuple, private)
+}
+
+// Returns the bytes buffered for the stream and held by its transaction.
+func (mysql *Mysql) StreamMemory(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) int {
+
+	size := 0
+	if priv, ok := private.(mysqlPrivateData); ok {
+		for _, stream := range priv.Data {
+			if stream != nil {
+				size += len(stream.data)
+			}
+		}
+	}
+	trans := mysql.transactionsMap[tcptuple.Hashable()]
+	if trans != nil {
+		size += protos.TransactionOverhead +
+			len(trans.Request_raw) + len(trans.Response_raw)
+	}
+	return size
+}
+
+// Drops the pending transaction of the evicted stream.
+func (mysql *Mysql) DropStream(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	trans := mysql.transactionsMap[tcptuple.Hashable()]
+	if trans != nil {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		delete(mysql.transactionsMap, tcptuple.Hashable())
+	}
+}
+
+// Publishes the response being received on a closed connection, marked
+// as truncated, with the rows read so far.
+func (mysql *Mysql) flushConnection(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	defer logp.Recover("FlushMysql exception")
+
+	priv, ok := private.(mysqlPrivateData)
+	if !ok {
+		return
+	}
+
+	for dir, stream := range priv.Data {
+		if stream == nil || stream.message == nil ||
+			stream.parseState != MysqlStateEatRows {
+			continue
+		}
+
+		m := stream.message
+		if m.end == 0 {
+			m.end = stream.parseOffset
+		}
+		m.IsTruncated = true
+		m.Size = uint64(stream.parseOffset - m.start)
+		if !m.IsError {
+			m.IsOK = true
+		}
+
+		logp.Debug("mysql", "Connection closed, publishing truncated response")
+		mysql.handleMysql(mysql, m, tcptuple, uint8(dir), stream.data[m.start:m.end])
+		stream.PrepareForNewMessage()
+	}
+}
+
 func handleMysql(mysql *Mysql, m *MysqlMessage, tcptuple *common.TcpTuple,
 	dir uint8, raw_msg []byte) {
 
@@ -478,7 +588,7 @@ func (mysql *Mysql) receivedMysqlRequest(msg *MysqlMessage) {
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
-	trans.timer = time.AfterFunc(TransactionTimeout, func() { mysql.expireTransaction(trans) })
+	trans.timer = mysql.timers.AfterFunc(mysql.transactionTimeout, func() { mysql.expireTransaction(trans) })
 }
 
 func (mysql *Mysql) receivedMysqlResponse(msg *MysqlMessage) {
@@ -657,6 +767,7 @@ func (mysql *Mysql) publishMysqlTransaction(t *MysqlTransaction) {
 	}
 
 	event["responsetime"] = t.ResponseTime
+	t.tuple.AddFields(event)
 	event["request_raw"] = t.Request_raw
 	event["response_raw"] = t.Response_raw
 	event["method"] = t.Method
@@ -424,3 +424,77 @@ func TestParseMySQL_splitResponse(t *testing.T) {
 		t.Errorf("handleMysql not called on the second run")
 	}
 }
+
+func TestMysql_Detect(t *testing.T) {
+	var mysql Mysql
+
+	greeting, _ := hex.DecodeString("440000000a352e352e33382d307562756e7475302e31342e30342e310010000000" +
+		"2a2f2b3c4e4c2e6100fff70802007f80150000000000000000000074406a4f5f" +
+		"3c583c2f4a4c00")
+	if !mysql.Detect(greeting, 0) {
+		t.Error("Greeting not detected")
+	}
+	if mysql.Detect(greeting[:20], 0) {
+		t.Error("Detected on an incomplete greeting")
+	}
+	if mysql.Detect([]byte("GET / HTTP/1.1\r\n"), 1) {
+		t.Error("Not MySQL detected as MySQL")
+	}
+}
+
+func TestParseMySQL_truncatedResponseOnRst(t *testing.T) {
+	mysql := MysqlModForTests()
+
+	// the connection is reset after the second row
+	data, err := hex.DecodeString(
+		"0100000105" +
+			"2f00000203646566086d696e697477697404706f737404706f737407706f73745f69640269640c3f000b000000030342000000" +
+			"3b00000303646566086d696e697477697404706f737404706f73740d706f73745f757365726e616d6508757365726e616d650c2100f0000000fd0000000000" +
+			"3500000403646566086d696e697477697404706f737404706f73740a706f73745f7469746c65057469746c650c2100f0000000fd0000000000" +
+			"3300000503646566086d696e697477697404706f737404706f737409706f73745f626f647904626f64790c2100fdff0200fc1000000000" +
+			"3b00000603646566086d696e697477697404706f737404706f73740d706f73745f7075625f64617465087075625f646174650c3f00130000000c8000000000" +
+			"05000007fe00002100" +
+			"2e000008013109416e6f6e796d6f75730474657374086461736461730d0a13323031332d30372d32322031373a33343a3032" +
+			"46000009013209416e6f6e796d6f757312506f737465617a6120544f444f206c6973741270656e7472752063756d706172617475726913323031332d30372d32322031383a32393a3330" +
+			"2a00000a013309416e6f6e")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	pkt := protos.Packet{
+		Payload: data,
+		Ts:      time.Now(),
+	}
+	var tuple common.TcpTuple
+
+	var truncated *MysqlMessage
+	var raw []byte
+	mysql.handleMysql = func(mysql *Mysql, m *MysqlMessage, tcptuple *common.TcpTuple,
+		dir uint8, raw_msg []byte) {
+
+		truncated = m
+		raw = raw_msg
+	}
+
+	private := mysql.Parse(&pkt, &tuple, 0, nil)
+	if truncated != nil {
+		t.Errorf("handleMysql called before the end of the response")
+	}
+
+	private = mysql.ReceivedRst(&tuple, 1, private)
+	if private != nil {
+		t.Errorf("Expecting the private data to be dropped")
+	}
+	if truncated == nil {
+		t.Fatalf("handleMysql not called on RST")
+	}
+	if !truncated.IsTruncated {
+		t.Errorf("Expecting the response to be marked as truncated")
+	}
+	if truncated.NumberOfRows != 2 {
+		t.Errorf("Wrong number of rows: %d", truncated.NumberOfRows)
+	}
+	fields, rows := parseMysqlResponse(raw)
+	if len(fields) != 5 || len(rows) != 2 {
+		t.Errorf("Failed to parse the truncated response: %v %v", fields, rows)
+	}
+}
@@ -56,7 +56,7 @@ type PgsqlTransaction struct {
 	Request_raw  string
 	Response_raw string
 
-	timer *time.Timer
+	timer *protos.Timer
 }
 
 type PgsqlStream struct {
@@ -89,8 +89,10 @@ const (
 )
 
 type Pgsql struct {
-	transactionsMap map[common.HashableTcpTuple][]*PgsqlTransaction
-	results         chan common.MapStr
+	transactionsMap    map[common.HashableTcpTuple][]*PgsqlTransaction
+	timers             *protos.Timers
+	transactionTimeout time.Duration
+	results            chan common.MapStr
 
 	// function pointer for mocking
 	handlePgsql func(pgsql *Pgsql, m *PgsqlMessage, tcp *common.TcpTuple,
@@ -99,12 +101,39 @@ type Pgsql struct {
 
 func (pgsql *Pgsql) Init(test_mode bool, results chan common.MapStr) error {
 	pgsql.transactionsMap = make(map[common.HashableTcpTuple][]*PgsqlTransaction, TransactionsHashSize)
+	pgsql.timers = protos.NewTimers()
+	pgsql.transactionTimeout = protos.PgsqlProtocol.TransactionTimeout(TransactionTimeout)
 	pgsql.handlePgsql = handlePgsql
 	pgsql.results = results
 
 	return nil
 }
 
+func (pgsql *Pgsql) New(timers *protos.Timers) protos.ProtocolPlugin {
+	instance := *pgsql
+	instance.transactionsMap = make(map[common.HashableTcpTuple][]*PgsqlTransaction, TransactionsHashSize)
+	instance.timers = timers
+	return &instance
+}
+
+// Detect recognizes the startup message or the SSL request that the
+// client sends first.
+func (pgsql *Pgsql) Detect(payload []byte, dir uint8) bool {
+	if len(payload) < 8 {
+		return false
+	}
+
+	length := int(common.Bytes_Ntohl(payload[0:4]))
+	code := common.Bytes_Ntohl(payload[4:8])
+	switch code {
+	case 80877103: // SSL request
+		return length == 8
+	case 196608: // startup message, protocol version 3.0
+		return length == len(payload)
+	}
+	return false
+}
+
 func (stream *PgsqlStream) PrepareForNewMessage() {
 	stream.data = stream.data[stream.message.end:]
 	stream.parseState = PgsqlStartState
@@ -673,26 +702,28 @@ func (pgsql *Pgsql) GapInStream(tcptuple *common.TcpTuple, dir uint8,
 	if !ok {
 		return private
 	}
-	if pgsqlData.Data[dir] == nil {
-		return pgsqlData
+
+	pgsql.flushMessage(tcptuple, dir, pgsqlData.Data[dir])
+	return pgsqlData
+}
+
+// If enough data was received, send it to the
+// next layer but mark it as incomplete.
+func (pgsql *Pgsql) flushMessage(tcptuple *common.TcpTuple, dir uint8, stream *PgsqlStream) {
+	if stream == nil || !messageHasEnoughData(stream.message) {
+		return
 	}
 
-	// If enough data was received, send it to the
-	// next layer but mark it as incomplete.
-	stream := pgsqlData.Data[dir]
-	if messageHasEnoughData(stream.message) {
-		logp.Debug("pgsql", "Message not complete, but sending to the next layer")
-		stream.message.toExport = true
-		stream.message.end = stream.parseOffset
-		stream.message.Incomplete = true
+	logp.Debug("pgsql", "Message not complete, but sending to the next layer")
+	stream.message.toExport = true
+	stream.message.end = stream.parseOffset
+	stream.message.Incomplete = true
 
-		msg := stream.data[stream.message.start:stream.message.end]
-		pgsql.handlePgsql(pgsql, stream.message, tcptuple, dir, msg)
+	msg := stream.data[stream.message.start:stream.message.end]
+	pgsql.handlePgsql(pgsql, stream.message, tcptuple, dir, msg)
 
-		// and reset message
-		stream.PrepareForNewMessage()
-	}
-	return pgsqlData
+	// and reset message
+	stream.PrepareForNewMessage()
 }
 
 func (pgsql *Pgsql) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
@@ -702,6 +733,66 @@ func (pgsql *Pgsql) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	return private
 }
 
+func (pgsql *Pgsql) ReceivedRst(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	pgsql.flushConnection(tcptuple, private)
+	return nil
+}
+
+func (pgsql *Pgsql) ConnectionExpired(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	pgsql.flushConnection(tcptuple, private)
+}
+
+// Returns the bytes buffered for the stream and held by its pipelined
+// transactions.
+func (pgsql *Pgsql) StreamMemory(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) int {
+
+	size := 0
+	if priv, ok := private.(pgsqlPrivateData); ok {
+		for _, stream := range priv.Data {
+			if stream != nil {
+				size += len(stream.data)
+			}
+		}
+	}
+	for _, trans := range pgsql.transactionsMap[tcptuple.Hashable()] {
+		size += protos.TransactionOverhead +
+			len(trans.Request_raw) + len(trans.Response_raw)
+	}
+	return size
+}
+
+// Drops the pending transactions of the evicted stream.
+func (pgsql *Pgsql) DropStream(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	for _, trans := range pgsql.transactionsMap[tcptuple.Hashable()] {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+	}
+	delete(pgsql.transactionsMap, tcptuple.Hashable())
+}
+
+// Sends the messages being received on a closed connection to the next
+// layer, the request first.
+func (pgsql *Pgsql) flushConnection(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	defer logp.Recover("FlushPgsql exception")
+
+	pgsqlData, ok := private.(pgsqlPrivateData)
+	if !ok {
+		return
+	}
+	pgsql.flushMessage(tcptuple, tcp.TcpDirectionOriginal, pgsqlData.Data[tcp.TcpDirectionOriginal])
+	pgsql.flushMessage(tcptuple, tcp.TcpDirectionReverse, pgsqlData.Data[tcp.TcpDirectionReverse])
+}
+
 var handlePgsql = func(pgsql *Pgsql, m *PgsqlMessage, tcptuple *common.TcpTuple,
 	dir uint8, raw_msg []byte) {
 
@@ -760,7 +851,7 @@ func (pgsql *Pgsql) receivedPgsqlRequest(msg *PgsqlMessage) {
 		if trans.timer != nil {
 			trans.timer.Stop()
 		}
-		trans.timer = time.AfterFunc(TransactionTimeout, func() { pgsql.expireTransaction(trans) })
+		trans.timer = pgsql.timers.AfterFunc(pgsql.transactionTimeout, func() { pgsql.expireTransaction(trans) })
 
 		pgsql.transactionsMap[tuple.Hashable()] = append(pgsql.transactionsMap[tuple.Hashable()], trans)
 	}
@@ -822,6 +913,7 @@ func (pgsql *Pgsql) publishTransaction(t *PgsqlTransaction) {
 		event["status"] = common.OK_STATUS
 	}
 	event["responsetime"] = t.ResponseTime
+	t.tuple.AddFields(event)
 	event["request_raw"] = t.Request_raw
 	event["response_raw"] = t.Response_raw
 	event["query"] = t.Query
@@ -232,3 +232,20 @@ func TestPgsqlParser_errorResponse(t *testing.T) {
 		t.Error("Failed to parse error message")
 	}
 }
+
+func TestPgsql_Detect(t *testing.T) {
+	var pgsql Pgsql
+
+	startup, _ := hex.DecodeString("0000002500030000" +
+		"7573657200706f73746772657300" + "646174616261736500746573740000")
+	if !pgsql.Detect(startup, 1) {
+		t.Error("Startup message not detected")
+	}
+	sslRequest, _ := hex.DecodeString("0000000804d2162f")
+	if !pgsql.Detect(sslRequest, 1) {
+		t.Error("SSL request not detected")
+	}
+	if pgsql.Detect([]byte("GET / HTTP/1.1\r\n"), 1) {
+		t.Error("Not PostgreSQL detected as PostgreSQL")
+	}
+}
@@ -2,6 +2,7 @@ package protos
 
 import (
 	"packetbeat/common"
+	"packetbeat/config"
 	"packetbeat/logp"
 	"time"
 )
@@ -15,6 +16,11 @@ type Packet struct {
 	Ts      time.Time
 	Tuple   common.IpPortTuple
 	Payload []byte
+
+	// the captured frame of the packet, for the packet dumps
+	Frame    []byte
+	Length   int // of the frame on the wire
+	Datalink int // pcap link type of the frame
 }
 
 // Functions to be exported by a protocol plugin
@@ -22,6 +28,11 @@ type ProtocolPlugin interface {
 	// Called to initialize the Plugin
 	Init(test_mode bool, results chan common.MapStr) error
 
+	// Creates a new instance of the initialized Plugin, sharing its
+	// configuration but with its own state. Each TCP worker uses its
+	// own instance and the given timers to expire the state.
+	New(timers *Timers) ProtocolPlugin
+
 	// Called when payload data is available for parsing.
 	Parse(pkt *Packet, tcptuple *common.TcpTuple,
 		dir uint8, private ProtocolData) ProtocolData
@@ -34,6 +45,52 @@ type ProtocolPlugin interface {
 	// stream.
 	GapInStream(tcptuple *common.TcpTuple, dir uint8,
 		private ProtocolData) ProtocolData
+
+	// Called when the RST flag is seen in the TCP stream, sent in
+	// the given direction. Both directions are closed, so the plugin
+	// should flush what it has buffered.
+	ReceivedRst(tcptuple *common.TcpTuple, dir uint8,
+		private ProtocolData) ProtocolData
+
+	// Called when the TCP stream expires or is closed, before its
+	// private data is dropped.
+	ConnectionExpired(tcptuple *common.TcpTuple, private ProtocolData)
+}
+
+// Implemented by the plugins able to recognize their protocol from the
+// first bytes of a TCP stream, used for the streams on ports that have
+// no protocol configured.
+type ProtocolDetector interface {
+	// Returns true if the payload, the first bytes sent in the given
+	// direction of a stream, looks like the protocol of the plugin.
+	// It must be cheap and must not keep the payload.
+	Detect(payload []byte, dir uint8) bool
+}
+
+// Implemented by the plugins whose state is included in the memory
+// budget of the TCP streams. A stream can be evicted at any time to
+// stay within the budget.
+type MemoryUser interface {
+	// Returns the number of bytes held for the stream, in its private
+	// data and in the transactions of its tuple. It is called for each
+	// packet so it must be cheap.
+	StreamMemory(tcptuple *common.TcpTuple, private ProtocolData) int
+
+	// Drops the state of the evicted stream, including its pending
+	// transactions, without publishing anything.
+	DropStream(tcptuple *common.TcpTuple, private ProtocolData)
+}
+
+// Rough size of a transaction, not counting its raw request and
+// response, for the memory budget.
+const TransactionOverhead = 512
+
+// Implemented by the plugins of the protocols running over UDP. The
+// datagrams are not reassembled, each is passed as it was captured.
+type UdpProtocolPlugin interface {
+	// Called for each datagram sent to or from a port of the
+	// protocol. The tuple of the packet tells its direction.
+	ParseUdp(pkt *Packet)
 }
 
 // Protocol identifier.
@@ -47,6 +104,7 @@ const (
 	RedisProtocol
 	PgsqlProtocol
 	ThriftProtocol
+	DnsProtocol
 )
 
 // Protocol names
@@ -57,6 +115,7 @@ var ProtocolNames = []string{
 	"redis",
 	"pgsql",
 	"thrift",
+	"dns",
 }
 
 func (p Protocol) String() string {
@@ -66,6 +125,16 @@ func (p Protocol) String() string {
 	return ProtocolNames[p]
 }
 
+// Returns the transaction timeout configured for the protocol, or def
+// when the configuration doesn't set one.
+func (p Protocol) TransactionTimeout(def time.Duration) time.Duration {
+	protoConfig, exists := config.ConfigSingleton.Protocols[p.String()]
+	if !exists || protoConfig.Transaction_timeout <= 0 {
+		return def
+	}
+	return time.Duration(protoConfig.Transaction_timeout) * time.Millisecond
+}
+
 // list of protocol plugins
 type Protocols struct {
 	protos map[Protocol]ProtocolPlugin
@@ -82,10 +151,42 @@ func (protocols Protocols) Get(proto Protocol) ProtocolPlugin {
 	return ret
 }
 
+// GetUdp returns the plugin of the protocol if it handles UDP, nil
+// otherwise.
+func (protocols Protocols) GetUdp(proto Protocol) UdpProtocolPlugin {
+	plugin, ok := protocols.protos[proto].(UdpProtocolPlugin)
+	if !ok {
+		return nil
+	}
+	return plugin
+}
+
 func (protos Protocols) Register(proto Protocol, plugin ProtocolPlugin) {
 	protos.protos[proto] = plugin
 }
 
+// New returns a list containing a new instance of each of the
+// registered plugins, all using the given timers.
+func (protocols Protocols) New(timers *Timers) Protocols {
+	instances := Protocols{protos: make(map[Protocol]ProtocolPlugin)}
+	for proto, plugin := range protocols.protos {
+		instances.protos[proto] = plugin.New(timers)
+	}
+	return instances
+}
+
+// Detect returns the first protocol, in the order of the Protocol
+// constants, whose plugin recognizes the payload, or UnknownProtocol.
+func (protocols Protocols) Detect(payload []byte, dir uint8) Protocol {
+	for proto := UnknownProtocol + 1; int(proto) < len(ProtocolNames); proto++ {
+		detector, ok := protocols.protos[proto].(ProtocolDetector)
+		if ok && detector.Detect(payload, dir) {
+			return proto
+		}
+	}
+	return UnknownProtocol
+}
+
 func init() {
 	logp.Debug("protos", "Initializing Protos")
 	Protos = Protocols{}
@@ -62,7 +62,7 @@ type RedisTransaction struct {
 	Request_raw  string
 	Response_raw string
 
-	timer *time.Timer
+	timer *protos.Timer
 }
 
 // Keep sorted for future command addition
@@ -233,18 +233,45 @@ const (
 )
 
 type Redis struct {
-	transactionsMap map[common.HashableTcpTuple]*RedisTransaction
+	transactionsMap    map[common.HashableTcpTuple]*RedisTransaction
+	timers             *protos.Timers
+	transactionTimeout time.Duration
 
 	results chan common.MapStr
 }
 
 func (redis *Redis) Init(test_mode bool, results chan common.MapStr) error {
 	redis.transactionsMap = make(map[common.HashableTcpTuple]*RedisTransaction, TransactionsHashSize)
+	redis.timers = protos.NewTimers()
+	redis.transactionTimeout = protos.RedisProtocol.TransactionTimeout(TransactionTimeout)
 	redis.results = results
 
 	return nil
 }
 
+func (redis *Redis) New(timers *protos.Timers) protos.ProtocolPlugin {
+	instance := *redis
+	instance.transactionsMap = make(map[common.HashableTcpTuple]*RedisTransaction, TransactionsHashSize)
+	instance.timers = timers
+	return &instance
+}
+
+// Detect recognizes a command sent as a multi-bulk request, which is
+// how the clients send them.
+func (redis *Redis) Detect(payload []byte, dir uint8) bool {
+	if len(payload) == 0 || payload[0] != '*' {
+		return false
+	}
+
+	// *<number of arguments>\r\n$<length of the first argument>
+	eol := bytes.Index(payload, []byte("\r\n"))
+	if eol < 2 || len(payload) <= eol+2 || payload[eol+2] != '$' {
+		return false
+	}
+	_, err := strconv.Atoi(string(payload[1:eol]))
+	return err == nil
+}
+
 func (stream *RedisStream) PrepareForNewMessage() {
 	stream.data = stream.data[stream.parseOffset:]
 	stream.parseOffset = 0
@@ -551,7 +578,7 @@ func (redis *Redis) receivedRedisRequest(msg *RedisMessage) {
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
-	trans.timer = time.AfterFunc(TransactionTimeout, func() { redis.expireTransaction(trans) })
+	trans.timer = redis.timers.AfterFunc(redis.transactionTimeout, func() { redis.expireTransaction(trans) })
 
 }
 
@@ -615,6 +642,70 @@ func (redis *Redis) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	return private
 }
 
+func (redis *Redis) ReceivedRst(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	redis.flushTransaction(tcptuple)
+	return nil
+}
+
+func (redis *Redis) ConnectionExpired(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	redis.flushTransaction(tcptuple)
+}
+
+// Returns the bytes buffered for the stream and held by its transaction.
+func (redis *Redis) StreamMemory(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) int {
+
+	size := 0
+	if priv, ok := private.(redisPrivateData); ok {
+		for _, stream := range priv.Data {
+			if stream != nil {
+				size += len(stream.data)
+			}
+		}
+	}
+	trans := redis.transactionsMap[tcptuple.Hashable()]
+	if trans != nil {
+		size += protos.TransactionOverhead +
+			len(trans.Request_raw) + len(trans.Response_raw)
+	}
+	return size
+}
+
+// Drops the pending transaction of the evicted stream.
+func (redis *Redis) DropStream(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	trans := redis.transactionsMap[tcptuple.Hashable()]
+	if trans != nil {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		delete(redis.transactionsMap, tcptuple.Hashable())
+	}
+}
+
+// Publishes the request still waiting for its response on a closed
+// connection. A partially received message can't be parsed, so it is
+// dropped.
+func (redis *Redis) flushTransaction(tcptuple *common.TcpTuple) {
+	trans := redis.transactionsMap[tcptuple.Hashable()]
+	if trans == nil || trans.Redis == nil {
+		return
+	}
+
+	logp.Debug("redis", "Connection closed before the response. Publishing the request")
+	redis.publishTransaction(trans)
+
+	delete(redis.transactionsMap, trans.tuple.Hashable())
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+}
+
 func (redis *Redis) publishTransaction(t *RedisTransaction) {
 
 	if redis.results == nil {
@@ -629,6 +720,7 @@ func (redis *Redis) publishTransaction(t *RedisTransaction) {
 		event["status"] = common.ERROR_STATUS
 	}
 	event["responsetime"] = t.ResponseTime
+	t.tuple.AddFields(event)
 	event["request_raw"] = t.Request_raw
 	event["response_raw"] = t.Response_raw
 	event["redis"] = common.MapStr(t.Redis)
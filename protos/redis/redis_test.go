@@ -88,3 +88,17 @@ func TestRedisParser_NilResult(t *testing.T) {
 		t.Errorf("Failed to parse Redis response: %s", stream.message.Message)
 	}
 }
+
+func TestRedis_Detect(t *testing.T) {
+	var redis Redis
+
+	if !redis.Detect([]byte("*3\r\n$3\r\nSET\r\n$4\r\nkey1\r\n$5\r\nHello\r\n"), 1) {
+		t.Error("Request not detected")
+	}
+	if redis.Detect([]byte("*3\r\n"), 1) {
+		t.Error("Detected on an incomplete request")
+	}
+	if redis.Detect([]byte("*x\r\n$3\r\n"), 1) || redis.Detect([]byte("GET / HTTP/1.1\r\n"), 1) {
+		t.Error("Not Redis detected as Redis")
+	}
+}
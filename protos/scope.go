@@ -0,0 +1,208 @@
+package protos
+
+import (
+	"fmt"
+	"net"
+	"packetbeat/common"
+	"packetbeat/config"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Range of ports, both ends included.
+type PortRange struct {
+	First, Last uint16
+}
+
+// Returns the BPF expression matching the ports of the range, prefixed
+// with the transport protocol if any.
+func (r PortRange) Filter(transport string) string {
+	if len(transport) > 0 {
+		transport += " "
+	}
+	if r.First == r.Last {
+		return fmt.Sprintf("%sport %d", transport, r.First)
+	}
+	return fmt.Sprintf("%sportrange %d-%d", transport, r.First, r.Last)
+}
+
+// Returns the ports of the protocol, from its ports and port_ranges
+// options, sorted by their first port.
+func ConfigToPortRanges(protoConfig config.Protocol) ([]PortRange, error) {
+	ranges := []PortRange{}
+	for _, port := range protoConfig.Ports {
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("Invalid port: %d", port)
+		}
+		ranges = append(ranges, PortRange{uint16(port), uint16(port)})
+	}
+
+	for _, spec := range protoConfig.Port_ranges {
+		bounds := strings.SplitN(spec, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid port range %q, expecting first-last", spec)
+		}
+		first, err1 := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+		last, err2 := strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16)
+		if err1 != nil || err2 != nil || first == 0 || first > last {
+			return nil, fmt.Errorf("Invalid port range %q", spec)
+		}
+		ranges = append(ranges, PortRange{uint16(first), uint16(last)})
+	}
+
+	sort.Sort(portRangesByFirst(ranges))
+	return ranges, nil
+}
+
+type portRangesByFirst []PortRange
+
+func (r portRangesByFirst) Len() int           { return len(r) }
+func (r portRangesByFirst) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r portRangesByFirst) Less(i, j int) bool { return r[i].First < r[j].First }
+
+// Hosts and networks to which the monitoring of a protocol is
+// restricted. A packet is in the scope if its source or its destination
+// is included, when there are includes, and if neither is excluded.
+type AddressScope struct {
+	include []*net.IPNet
+	exclude []*net.IPNet
+
+	filter string
+}
+
+// Returns the scope of the protocol, from its hosts, networks,
+// exclude_hosts and exclude_networks options, or nil if it has none.
+func ConfigToAddressScope(protoConfig config.Protocol) (*AddressScope, error) {
+	var scope AddressScope
+	var err error
+	var includeFilter, excludeFilter []string
+
+	scope.include, includeFilter, err = parseAddresses(
+		protoConfig.Hosts, protoConfig.Networks)
+	if err != nil {
+		return nil, err
+	}
+	scope.exclude, excludeFilter, err = parseAddresses(
+		protoConfig.Exclude_hosts, protoConfig.Exclude_networks)
+	if err != nil {
+		return nil, err
+	}
+	if len(scope.include) == 0 && len(scope.exclude) == 0 {
+		return nil, nil
+	}
+
+	filters := []string{}
+	if len(includeFilter) > 0 {
+		filters = append(filters, "("+strings.Join(includeFilter, " or ")+")")
+	}
+	if len(excludeFilter) > 0 {
+		filters = append(filters, "not ("+strings.Join(excludeFilter, " or ")+")")
+	}
+	scope.filter = strings.Join(filters, " and ")
+
+	return &scope, nil
+}
+
+// Parses the host addresses and the networks in CIDR notation. Returns
+// them as networks and as BPF expressions.
+func parseAddresses(hosts []string, networks []string) ([]*net.IPNet, []string, error) {
+	nets := []*net.IPNet{}
+	filters := []string{}
+
+	for _, host := range hosts {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("Invalid host address: %s", host)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		filters = append(filters, "host "+ip.String())
+	}
+
+	for _, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid network: %s", network)
+		}
+		nets = append(nets, ipnet)
+		filters = append(filters, "net "+ipnet.String())
+	}
+
+	return nets, filters, nil
+}
+
+func containsAny(nets []*net.IPNet, src net.IP, dst net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(src) || ipnet.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the packets between the two addresses are in the
+// scope. A nil scope contains everything.
+func (scope *AddressScope) Contains(src net.IP, dst net.IP) bool {
+	if scope == nil {
+		return true
+	}
+	if len(scope.include) > 0 && !containsAny(scope.include, src, dst) {
+		return false
+	}
+	return !containsAny(scope.exclude, src, dst)
+}
+
+// Returns the BPF expression matching the scope, empty for a nil scope.
+func (scope *AddressScope) Filter() string {
+	if scope == nil {
+		return ""
+	}
+	return scope.filter
+}
+
+// Address scopes of the protocols that have one.
+type AddressScopes map[Protocol]*AddressScope
+
+func ConfigToAddressScopes(protocols map[string]config.Protocol) (AddressScopes, error) {
+	scopes := AddressScopes{}
+	for proto := UnknownProtocol + 1; int(proto) < len(ProtocolNames); proto++ {
+		protoConfig, exists := protocols[proto.String()]
+		if !exists {
+			continue
+		}
+		scope, err := ConfigToAddressScope(protoConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", proto, err)
+		}
+		if scope != nil {
+			scopes[proto] = scope
+		}
+	}
+	return scopes, nil
+}
+
+// Returns true if the packet of the tuple is in the scope of the
+// protocol.
+func (scopes AddressScopes) Contains(proto Protocol, tuple *common.IpPortTuple) bool {
+	return scopes[proto].Contains(tuple.Src_ip, tuple.Dst_ip)
+}
+
+// Returns the BPF expression matching the ports of the protocol within
+// its address scope. The ports are prefixed with the transport
+// protocol, if any.
+func ProtocolFilter(transport string, ranges []PortRange, scope *AddressScope) string {
+	ports := []string{}
+	for _, r := range ranges {
+		ports = append(ports, r.Filter(transport))
+	}
+	filter := strings.Join(ports, " or ")
+	if scope == nil || len(filter) == 0 {
+		return filter
+	}
+	return fmt.Sprintf("((%s) and %s)", filter, scope.Filter())
+}
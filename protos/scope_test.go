@@ -0,0 +1,77 @@
+package protos
+
+import (
+	"net"
+	"packetbeat/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigToPortRanges(t *testing.T) {
+	ranges, err := ConfigToPortRanges(config.Protocol{
+		Ports:       []int{8080, 80},
+		Port_ranges: []string{"8000-8010", " 9000 - 9000 "},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []PortRange{{80, 80}, {8000, 8010}, {8080, 8080}, {9000, 9000}}, ranges)
+
+	for _, spec := range []string{"8000", "8010-8000", "0-10", "1-65536", "a-b"} {
+		_, err = ConfigToPortRanges(config.Protocol{Port_ranges: []string{spec}})
+		assert.NotNil(t, err, spec)
+	}
+	_, err = ConfigToPortRanges(config.Protocol{Ports: []int{70000}})
+	assert.NotNil(t, err)
+}
+
+func TestAddressScope(t *testing.T) {
+	scope, err := ConfigToAddressScope(config.Protocol{
+		Hosts:         []string{"192.168.0.1"},
+		Networks:      []string{"10.0.0.0/8", "2001:db8::/32"},
+		Exclude_hosts: []string{"10.0.0.5"},
+	})
+	assert.Nil(t, err)
+
+	client := net.ParseIP("172.16.0.1")
+	assert.True(t, scope.Contains(client, net.ParseIP("10.1.2.3")))
+	assert.True(t, scope.Contains(net.ParseIP("192.168.0.1"), client))
+	assert.True(t, scope.Contains(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db9::1")))
+	assert.False(t, scope.Contains(client, net.ParseIP("192.168.0.2")))
+	assert.False(t, scope.Contains(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.5")))
+
+	assert.Equal(t, "(host 192.168.0.1 or net 10.0.0.0/8 or net 2001:db8::/32)"+
+		" and not (host 10.0.0.5)", scope.Filter())
+}
+
+func TestAddressScope_excludeOnly(t *testing.T) {
+	scope, err := ConfigToAddressScope(config.Protocol{
+		Exclude_networks: []string{"10.0.0.0/8"},
+	})
+	assert.Nil(t, err)
+
+	assert.True(t, scope.Contains(net.ParseIP("192.168.0.1"), net.ParseIP("192.168.0.2")))
+	assert.False(t, scope.Contains(net.ParseIP("192.168.0.1"), net.ParseIP("10.0.0.1")))
+	assert.Equal(t, "not (net 10.0.0.0/8)", scope.Filter())
+}
+
+func TestAddressScope_none(t *testing.T) {
+	scope, err := ConfigToAddressScope(config.Protocol{Ports: []int{80}})
+	assert.Nil(t, err)
+	assert.Nil(t, scope)
+	assert.True(t, scope.Contains(net.ParseIP("192.168.0.1"), net.ParseIP("10.0.0.1")))
+
+	_, err = ConfigToAddressScope(config.Protocol{Hosts: []string{"example.com"}})
+	assert.NotNil(t, err)
+	_, err = ConfigToAddressScope(config.Protocol{Networks: []string{"10.0.0.0"}})
+	assert.NotNil(t, err)
+}
+
+func TestProtocolFilter(t *testing.T) {
+	ranges := []PortRange{{53, 53}, {5300, 5310}}
+	assert.Equal(t, "udp port 53 or udp portrange 5300-5310",
+		ProtocolFilter("udp", ranges, nil))
+
+	scope, _ := ConfigToAddressScope(config.Protocol{Networks: []string{"10.0.0.0/8"}})
+	assert.Equal(t, "((port 53 or portrange 5300-5310) and (net 10.0.0.0/8))",
+		ProtocolFilter("", ranges, scope))
+}
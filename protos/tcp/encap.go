@@ -0,0 +1,90 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+)
+
+// 802.1Q tag, recording the VLAN ID of the outermost tag of the packet.
+// With QinQ, the same decoder is used for all the tags, so the fields
+// of the embedded layer are those of the innermost one.
+type dot1qLayer struct {
+	layers.Dot1Q
+
+	tags      int
+	outerVlan uint16
+}
+
+// Forgets the tags of the previous packet.
+func (d *dot1qLayer) reset() {
+	d.tags = 0
+	d.outerVlan = 0
+}
+
+func (d *dot1qLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	err := d.Dot1Q.DecodeFromBytes(data, df)
+	if err != nil {
+		return err
+	}
+	if d.tags == 0 {
+		d.outerVlan = d.VLANIdentifier
+	}
+	d.tags += 1
+	return nil
+}
+
+// MPLS label stack entry. The protocol below the bottom of the stack is
+// not written in the packet, it is guessed from the IP version.
+type mplsLayer struct {
+	layers.MPLS
+}
+
+func (m *mplsLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return errors.New("MPLS packet too short")
+	}
+	entry := binary.BigEndian.Uint32(data[:4])
+	m.Label = entry >> 12
+	m.TrafficClass = uint8(entry>>9) & 0x7
+	m.StackBottom = entry&0x100 != 0
+	m.TTL = uint8(entry)
+	m.Contents = data[:4]
+	m.Payload = data[4:]
+	return nil
+}
+
+func (m *mplsLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeMPLS
+}
+
+func (m *mplsLayer) NextLayerType() gopacket.LayerType {
+	if !m.StackBottom {
+		return layers.LayerTypeMPLS
+	}
+	if len(m.Payload) > 0 {
+		switch m.Payload[0] >> 4 {
+		case 4:
+			return layers.LayerTypeIPv4
+		case 6:
+			return layers.LayerTypeIPv6
+		}
+	}
+	return gopacket.LayerTypePayload
+}
+
+// ERSPAN type II header, followed by the mirrored Ethernet frame.
+type erspanLayer struct {
+	layers.ERSPANII
+}
+
+func (e *erspanLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return errors.New("ERSPAN packet too short")
+	}
+	return e.ERSPANII.DecodeFromBytes(data, df)
+}
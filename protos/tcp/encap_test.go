@@ -0,0 +1,122 @@
+package tcp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+// Serializes the layers, from the outermost, followed by an HTTP request
+// from 192.168.0.1:34000 to 192.168.0.2:80.
+func testFrame(outer ...gopacket.SerializableLayer) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(192, 168, 0, 1),
+		DstIP:    net.IPv4(192, 168, 0, 2),
+	}
+	tcp := &layers.TCP{SrcPort: 34000, DstPort: 80, Seq: 1, ACK: true, PSH: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	all := append(outer, ip, tcp, gopacket.Payload("GET / HTTP/1.1\r\n\r\n"))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, all...)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func testEthernet(ethType layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: ethType,
+	}
+}
+
+func testOuterIp(protocol layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: protocol,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+}
+
+// Decodes the frame and checks that the innermost packet was reached.
+func testDecode(t *testing.T, data []byte) *DecoderStruct {
+	decoder, err := CreateDecoder(layers.LinkTypeEthernet)
+	assert.Nil(t, err)
+
+	decoder.dot1q.reset()
+	err = decoder.Parser.DecodeLayers(data, &decoder.decoded)
+	if _, unsupported := err.(gopacket.UnsupportedLayerType); err != nil && !unsupported {
+		t.Fatalf("Decoding error: %s", err)
+	}
+
+	assert.Contains(t, decoder.decoded, layers.LayerTypeTCP)
+	assert.Equal(t, "192.168.0.1", decoder.ip4.SrcIP.String())
+	assert.Equal(t, "192.168.0.2", decoder.ip4.DstIP.String())
+	assert.Equal(t, layers.TCPPort(80), decoder.tcp.DstPort)
+	assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", string(decoder.tcp.Payload))
+	return decoder
+}
+
+func TestDecoder_untagged(t *testing.T) {
+	decoder := testDecode(t, testFrame(testEthernet(layers.EthernetTypeIPv4)))
+
+	assert.Equal(t, 0, decoder.dot1q.tags)
+	assert.Equal(t, uint16(0), decoder.dot1q.outerVlan)
+}
+
+func TestDecoder_qinq(t *testing.T) {
+	decoder := testDecode(t, testFrame(
+		testEthernet(layers.EthernetTypeQinQ),
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeIPv4}))
+
+	assert.Equal(t, 2, decoder.dot1q.tags)
+	assert.Equal(t, uint16(100), decoder.dot1q.outerVlan)
+
+	// the tags of the previous packet are forgotten
+	decoder = testDecode(t, testFrame(
+		testEthernet(layers.EthernetTypeDot1Q),
+		&layers.Dot1Q{VLANIdentifier: 300, Type: layers.EthernetTypeIPv4}))
+	assert.Equal(t, uint16(300), decoder.dot1q.outerVlan)
+}
+
+func TestDecoder_mpls(t *testing.T) {
+	testDecode(t, testFrame(
+		testEthernet(layers.EthernetTypeMPLSUnicast),
+		&layers.MPLS{Label: 16, TTL: 64},
+		&layers.MPLS{Label: 17, StackBottom: true, TTL: 64}))
+}
+
+func TestDecoder_gre(t *testing.T) {
+	testDecode(t, testFrame(
+		testEthernet(layers.EthernetTypeIPv4),
+		testOuterIp(layers.IPProtocolGRE),
+		&layers.GRE{Protocol: layers.EthernetTypeIPv4}))
+}
+
+func TestDecoder_vxlan(t *testing.T) {
+	ip := testOuterIp(layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 50000, DstPort: 4789}
+	udp.SetNetworkLayerForChecksum(ip)
+	decoder := testDecode(t, testFrame(
+		testEthernet(layers.EthernetTypeIPv4),
+		ip,
+		udp,
+		&layers.VXLAN{ValidIDFlag: true, VNI: 42},
+		testEthernet(layers.EthernetTypeIPv4)))
+
+	assert.Equal(t, uint32(42), decoder.vxlan.VNI)
+}
@@ -0,0 +1,108 @@
+package tcp
+
+import (
+	"packetbeat/common"
+	"packetbeat/logp"
+	"packetbeat/procs"
+	"packetbeat/protos"
+	"time"
+
+	"github.com/packetbeat/gopacket/layers"
+)
+
+// Reasons for which a flow ends.
+const (
+	FlowClosedFin     = "fin"
+	FlowClosedRst     = "rst"
+	FlowClosedTimeout = "timeout"
+	FlowClosedEvicted = "evicted"
+	FlowClosedReused  = "reused"
+)
+
+// Config
+var flowsEnabled bool
+var flowsAllPorts bool
+
+var results chan common.MapStr
+
+// Counters of a TCP connection, published as a flow event when the
+// connection ends.
+type flowStats struct {
+	start time.Time
+	end   time.Time
+
+	packets [2]int
+	bytes   [2]int
+
+	retransmissions int
+	gaps            int
+
+	fin       [2]bool
+	published bool
+}
+
+// Accounts a captured packet of the stream, before it is reassembled.
+func (stream *TcpStream) countPacket(pkt *protos.Packet, tcphdr *layers.TCP, original_dir uint8) {
+	flow := &stream.flow
+
+	if flow.start.IsZero() {
+		flow.start = pkt.Ts
+	}
+	if pkt.Ts.After(flow.end) {
+		flow.end = pkt.Ts
+	}
+
+	flow.packets[original_dir] += 1
+	flow.bytes[original_dir] += len(pkt.Payload)
+
+	if tcphdr.FIN {
+		flow.fin[original_dir] = true
+	}
+}
+
+// Publishes the flow event of the stream, unless it was already
+// published. The original direction of the stream is the client side.
+func (stream *TcpStream) publishFlow(reason string) {
+	flow := &stream.flow
+	if !flowsEnabled || flow.published || results == nil {
+		return
+	}
+	flow.published = true
+
+	logp.Debug("tcp", "Flow of stream %d closed by %s", stream.id, reason)
+
+	cmdline := procs.ProcWatcher.FindProcessesTuple(stream.tuple)
+	src := common.Endpoint{
+		Ip:   stream.tuple.Src_ip.String(),
+		Port: stream.tuple.Src_port,
+		Proc: string(cmdline.Src),
+	}
+	dst := common.Endpoint{
+		Ip:   stream.tuple.Dst_ip.String(),
+		Port: stream.tuple.Dst_port,
+		Proc: string(cmdline.Dst),
+	}
+
+	event := common.MapStr{}
+	event["type"] = "flow"
+	event["status"] = common.OK_STATUS
+	event["@timestamp"] = common.Time(flow.start)
+	event["src"] = &src
+	event["dst"] = &dst
+	event["flow"] = common.MapStr{
+		"start":           common.Time(flow.start),
+		"end":             common.Time(flow.end),
+		"duration":        int64(flow.end.Sub(flow.start).Nanoseconds() / 1e3),
+		"protocol":        stream.protocol.String(),
+		"client_packets":  flow.packets[TcpDirectionOriginal],
+		"client_bytes":    flow.bytes[TcpDirectionOriginal],
+		"server_packets":  flow.packets[TcpDirectionReverse],
+		"server_bytes":    flow.bytes[TcpDirectionReverse],
+		"retransmissions": flow.retransmissions,
+		"gaps":            flow.gaps,
+		"closed_by":       reason,
+	}
+	stream.tcptuple.AddFields(event)
+
+	results <- event
+}
@@ -0,0 +1,315 @@
+package tcp
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"packetbeat/logp"
+	"time"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+)
+
+// Defaults for the reassembly of the fragmented IP datagrams. The memory
+// limit is shared by all the incomplete datagrams.
+const IP_DEFRAG_MAX_BYTES = 4 * 1024 * 1024
+const IP_DEFRAG_TIMEOUT = 30 * time.Second
+
+var defragMaxBytes int = IP_DEFRAG_MAX_BYTES
+var defragTimeout time.Duration = IP_DEFRAG_TIMEOUT
+
+// Largest payload of a reassembled datagram.
+const ipv4MaxPayload = 65535 - 20
+const ipv6MaxPayload = 65535
+
+// IPv6 routing and destination options extension headers, skipped. The
+// hop-by-hop options are decoded with the IPv6 header.
+type ipv6ExtensionLayer struct {
+	layers.IPv6ExtensionSkipper
+}
+
+func (e *ipv6ExtensionLayer) CanDecode() gopacket.LayerClass {
+	return gopacket.NewLayerClass([]gopacket.LayerType{
+		layers.LayerTypeIPv6Routing,
+		layers.LayerTypeIPv6Destination,
+	})
+}
+
+// IPv6 fragment extension header.
+type ipv6FragmentLayer struct {
+	layers.BaseLayer
+
+	NextHeader     layers.IPProtocol
+	FragmentOffset uint16 // in 8 bytes units
+	MoreFragments  bool
+	Identification uint32
+}
+
+func (f *ipv6FragmentLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return errors.New("IPv6 fragment header too short")
+	}
+	f.NextHeader = layers.IPProtocol(data[0])
+	f.FragmentOffset = binary.BigEndian.Uint16(data[2:4]) >> 3
+	f.MoreFragments = data[3]&0x1 != 0
+	f.Identification = binary.BigEndian.Uint32(data[4:8])
+	f.Contents = data[:8]
+	f.Payload = data[8:]
+	return nil
+}
+
+func (f *ipv6FragmentLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeIPv6Fragment
+}
+
+func (f *ipv6FragmentLayer) NextLayerType() gopacket.LayerType {
+	if f.FragmentOffset == 0 && !f.MoreFragments {
+		// atomic fragment, the whole datagram is in this packet
+		return f.NextHeader.LayerType()
+	}
+	return gopacket.LayerTypeFragment
+}
+
+func isIPv4Fragment(ip4 *layers.IPv4) bool {
+	return ip4.Flags&layers.IPv4MoreFragments != 0 || ip4.FragOffset != 0
+}
+
+// Counters of the IP fragments reassembly.
+type DefragStats struct {
+	Fragments   uint64 // fragments received
+	Reassembled uint64 // datagrams rebuilt from their fragments
+	Failed      uint64 // datagrams dropped incomplete, invalid or over the memory limit
+}
+
+type fragmentKey struct {
+	version  uint8
+	protocol uint8 // IPv4 only, the IPv6 identification is enough
+	src, dst [16]byte
+	id       uint32
+}
+
+type ipFragment struct {
+	offset int
+	data   []byte
+}
+
+// Fragments received for a datagram, sorted by offset.
+type fragmentedDatagram struct {
+	key       fragmentKey
+	first     time.Time
+	fragments []ipFragment
+	bytes     int
+	length    int // payload length, known from the last fragment, -1 before
+
+	// IP header of the reassembled datagram
+	nextHeader uint8
+	ttl        uint8
+	src, dst   []byte
+
+	elem *list.Element
+}
+
+// Reassembles the fragmented IP datagrams. It is used by the goroutine
+// decoding the packets.
+type ipDefragmenter struct {
+	datagrams map[fragmentKey]*fragmentedDatagram
+	order     *list.List // oldest first
+	bytes     int
+	stats     DefragStats
+}
+
+func newIpDefragmenter() *ipDefragmenter {
+	return &ipDefragmenter{
+		datagrams: make(map[fragmentKey]*fragmentedDatagram),
+		order:     list.New(),
+	}
+}
+
+// Adds an IPv4 fragment. Returns the reassembled IPv4 datagram, or nil
+// while it isn't complete.
+func (d *ipDefragmenter) addIPv4(ip4 *layers.IPv4, ts time.Time) []byte {
+	key := fragmentKey{version: 4, protocol: uint8(ip4.Protocol), id: uint32(ip4.Id)}
+	copy(key.src[:], ip4.SrcIP)
+	copy(key.dst[:], ip4.DstIP)
+
+	dgram := d.add(key, int(ip4.FragOffset)*8,
+		ip4.Flags&layers.IPv4MoreFragments != 0, ip4.Payload, ts, ipv4MaxPayload)
+	if dgram == nil {
+		return nil
+	}
+	if dgram.src == nil {
+		dgram.nextHeader = uint8(ip4.Protocol)
+		dgram.ttl = ip4.TTL
+		dgram.src = append([]byte{}, ip4.SrcIP.To4()...)
+		dgram.dst = append([]byte{}, ip4.DstIP.To4()...)
+	}
+	if !d.complete(dgram) {
+		return nil
+	}
+
+	data := make([]byte, 20+dgram.length)
+	data[0] = 0x45
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	binary.BigEndian.PutUint16(data[4:6], uint16(key.id))
+	data[8] = dgram.ttl
+	data[9] = dgram.nextHeader
+	copy(data[12:16], dgram.src)
+	copy(data[16:20], dgram.dst)
+	d.assemble(dgram, data[20:])
+	return data
+}
+
+// Adds an IPv6 fragment. Returns the reassembled IPv6 datagram, without
+// the extension headers preceding the fragment header, or nil while it
+// isn't complete.
+func (d *ipDefragmenter) addIPv6(ip6 *layers.IPv6, frag *ipv6FragmentLayer,
+	ts time.Time) []byte {
+
+	key := fragmentKey{version: 6, id: frag.Identification}
+	copy(key.src[:], ip6.SrcIP)
+	copy(key.dst[:], ip6.DstIP)
+
+	dgram := d.add(key, int(frag.FragmentOffset)*8, frag.MoreFragments,
+		frag.Payload, ts, ipv6MaxPayload)
+	if dgram == nil {
+		return nil
+	}
+	if frag.FragmentOffset == 0 || dgram.src == nil {
+		dgram.nextHeader = uint8(frag.NextHeader)
+		dgram.ttl = ip6.HopLimit
+		dgram.src = append([]byte{}, ip6.SrcIP...)
+		dgram.dst = append([]byte{}, ip6.DstIP...)
+	}
+	if !d.complete(dgram) {
+		return nil
+	}
+
+	data := make([]byte, 40+dgram.length)
+	data[0] = 0x60
+	binary.BigEndian.PutUint16(data[4:6], uint16(dgram.length))
+	data[6] = dgram.nextHeader
+	data[7] = dgram.ttl
+	copy(data[8:24], dgram.src)
+	copy(data[24:40], dgram.dst)
+	d.assemble(dgram, data[40:])
+	return data
+}
+
+// Stores the fragment, at offset in the payload of the datagram. Returns
+// the datagram or nil if the fragment was dropped.
+func (d *ipDefragmenter) add(key fragmentKey, offset int, more bool,
+	payload []byte, ts time.Time, maxPayload int) *fragmentedDatagram {
+
+	d.stats.Fragments += 1
+	d.expire(ts)
+
+	dgram, exists := d.datagrams[key]
+	if !exists {
+		dgram = &fragmentedDatagram{key: key, first: ts, length: -1}
+		dgram.elem = d.order.PushBack(dgram)
+		d.datagrams[key] = dgram
+	}
+
+	end := offset + len(payload)
+	switch {
+	case end > maxPayload:
+		logp.Debug("ipdefrag", "Fragment beyond the maximum datagram size: %d", end)
+		d.drop(dgram)
+		return nil
+	case !more && dgram.length >= 0 && dgram.length != end:
+		logp.Debug("ipdefrag", "Datagram with two different lengths: %d and %d", dgram.length, end)
+		d.drop(dgram)
+		return nil
+	case dgram.length >= 0 && end > dgram.length:
+		logp.Debug("ipdefrag", "Fragment beyond the end of the datagram: %d", end)
+		d.drop(dgram)
+		return nil
+	}
+	if !more {
+		dgram.length = end
+		for _, frag := range dgram.fragments {
+			if frag.offset+len(frag.data) > end {
+				logp.Debug("ipdefrag", "Fragment beyond the end of the datagram")
+				d.drop(dgram)
+				return nil
+			}
+		}
+	}
+
+	for d.bytes+len(payload) > defragMaxBytes && d.order.Len() > 0 {
+		oldest := d.order.Front().Value.(*fragmentedDatagram)
+		logp.Debug("ipdefrag", "Memory limit reached, dropping a datagram")
+		d.drop(oldest)
+		if oldest == dgram {
+			return nil
+		}
+	}
+
+	// The fragment is copied so that the datagram doesn't hold on to
+	// the whole frame. The frames read by the sniffer are not reused,
+	// and the reassembled datagram is written to a freshly allocated
+	// buffer, which the packet passed to the TCP workers owns.
+	frag := ipFragment{offset: offset, data: append([]byte{}, payload...)}
+	i := len(dgram.fragments)
+	for i > 0 && dgram.fragments[i-1].offset > offset {
+		i--
+	}
+	dgram.fragments = append(dgram.fragments, ipFragment{})
+	copy(dgram.fragments[i+1:], dgram.fragments[i:])
+	dgram.fragments[i] = frag
+
+	dgram.bytes += len(payload)
+	d.bytes += len(payload)
+	return dgram
+}
+
+// Returns true if the fragments cover the whole payload of the datagram.
+func (d *ipDefragmenter) complete(dgram *fragmentedDatagram) bool {
+	if dgram.length < 0 {
+		return false
+	}
+	covered := 0
+	for _, frag := range dgram.fragments {
+		if frag.offset > covered {
+			return false
+		}
+		if end := frag.offset + len(frag.data); end > covered {
+			covered = end
+		}
+	}
+	return covered >= dgram.length
+}
+
+// Copies the payload of the complete datagram and forgets it.
+func (d *ipDefragmenter) assemble(dgram *fragmentedDatagram, payload []byte) {
+	for _, frag := range dgram.fragments {
+		copy(payload[frag.offset:], frag.data)
+	}
+	d.remove(dgram)
+	d.stats.Reassembled += 1
+}
+
+// Drops the datagrams whose first fragment is older than the timeout.
+func (d *ipDefragmenter) expire(now time.Time) {
+	for d.order.Len() > 0 {
+		oldest := d.order.Front().Value.(*fragmentedDatagram)
+		if now.Sub(oldest.first) < defragTimeout {
+			return
+		}
+		logp.Debug("ipdefrag", "Datagram timed out with %d fragments", len(oldest.fragments))
+		d.drop(oldest)
+	}
+}
+
+func (d *ipDefragmenter) drop(dgram *fragmentedDatagram) {
+	d.remove(dgram)
+	d.stats.Failed += 1
+}
+
+func (d *ipDefragmenter) remove(dgram *fragmentedDatagram) {
+	d.order.Remove(dgram.elem)
+	delete(d.datagrams, dgram.key)
+	d.bytes -= dgram.bytes
+}
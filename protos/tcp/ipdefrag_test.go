@@ -0,0 +1,190 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+// TCP header and HTTP request, split between the fragments.
+func testTransport() []byte {
+	ip := &layers.IPv4{
+		SrcIP: net.IPv4(192, 168, 0, 1),
+		DstIP: net.IPv4(192, 168, 0, 2),
+	}
+	tcp := &layers.TCP{SrcPort: 34000, DstPort: 80, Seq: 1, ACK: true, PSH: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buf, opts, tcp,
+		gopacket.Payload("GET / HTTP/1.1\r\n\r\n"))
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Ethernet frame with an IPv4 fragment of the transport layer.
+func testIPv4Fragment(id uint16, transport []byte, offset int, end int) []byte {
+	ip := &layers.IPv4{
+		Version:    4,
+		TTL:        64,
+		Protocol:   layers.IPProtocolTCP,
+		Id:         id,
+		FragOffset: uint16(offset / 8),
+		SrcIP:      net.IPv4(192, 168, 0, 1),
+		DstIP:      net.IPv4(192, 168, 0, 2),
+	}
+	if end < len(transport) {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		testEthernet(layers.EthernetTypeIPv4), ip,
+		gopacket.Payload(transport[offset:end]))
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Ethernet frame with an IPv6 fragment of the transport layer, after a
+// destination options header.
+func testIPv6Fragment(transport []byte, offset int, end int) []byte {
+	data := []byte{
+		0x60, 0, 0, 0, 0, 0, byte(layers.IPProtocolIPv6Destination), 64,
+	}
+	data = append(data, net.ParseIP("2001:db8::1")...)
+	data = append(data, net.ParseIP("2001:db8::2")...)
+
+	// destination options header, with a PadN option
+	data = append(data, byte(layers.IPProtocolIPv6Fragment), 0, 1, 4, 0, 0, 0, 0)
+
+	frag := []byte{byte(layers.IPProtocolTCP), 0, 0, 0, 0, 0, 0x12, 0x34}
+	binary.BigEndian.PutUint16(frag[2:4], uint16(offset))
+	if end < len(transport) {
+		frag[3] |= 1
+	}
+	data = append(data, frag...)
+	data = append(data, transport[offset:end]...)
+	binary.BigEndian.PutUint16(data[4:6], uint16(len(data)-40))
+
+	eth := testEthernet(layers.EthernetTypeIPv6)
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{},
+		eth, gopacket.Payload(data))
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func testDefragDecoder(t *testing.T) *DecoderStruct {
+	defragMaxBytes = IP_DEFRAG_MAX_BYTES
+	defragTimeout = IP_DEFRAG_TIMEOUT
+
+	decoder, err := CreateDecoder(layers.LinkTypeEthernet)
+	assert.Nil(t, err)
+	return decoder
+}
+
+func testReassembled(t *testing.T, decoder *DecoderStruct) {
+	assert.Contains(t, decoder.decoded, layers.LayerTypeTCP)
+	assert.Equal(t, layers.TCPPort(80), decoder.tcp.DstPort)
+	assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", string(decoder.tcp.Payload))
+}
+
+func TestDefrag_ipv4OutOfOrder(t *testing.T) {
+	decoder := testDefragDecoder(t)
+	transport := testTransport()
+	ts := time.Now()
+
+	assert.False(t, decoder.decodeLayers(testIPv4Fragment(1, transport, 24, len(transport)), ts))
+	assert.False(t, decoder.decodeLayers(testIPv4Fragment(1, transport, 8, 24), ts))
+	assert.True(t, decoder.decodeLayers(testIPv4Fragment(1, transport, 0, 8), ts))
+	testReassembled(t, decoder)
+	assert.Equal(t, "192.168.0.1", decoder.ip4.SrcIP.String())
+
+	assert.Equal(t, DefragStats{Fragments: 3, Reassembled: 1}, decoder.DefragStats())
+	assert.Equal(t, 0, len(decoder.defrag.datagrams))
+	assert.Equal(t, 0, decoder.defrag.bytes)
+}
+
+func TestDefrag_ipv4Overlap(t *testing.T) {
+	decoder := testDefragDecoder(t)
+	transport := testTransport()
+	ts := time.Now()
+
+	assert.False(t, decoder.decodeLayers(testIPv4Fragment(1, transport, 0, 16), ts))
+	assert.False(t, decoder.decodeLayers(testIPv4Fragment(1, transport, 8, 24), ts))
+	assert.True(t, decoder.decodeLayers(testIPv4Fragment(1, transport, 16, len(transport)), ts))
+	testReassembled(t, decoder)
+}
+
+func TestDefrag_ipv6ExtensionHeaders(t *testing.T) {
+	decoder := testDefragDecoder(t)
+	transport := testTransport()
+	ts := time.Now()
+
+	assert.False(t, decoder.decodeLayers(testIPv6Fragment(transport, 0, 16), ts))
+	assert.True(t, decoder.decodeLayers(testIPv6Fragment(transport, 16, len(transport)), ts))
+	testReassembled(t, decoder)
+	assert.Equal(t, "2001:db8::1", decoder.ip6.SrcIP.String())
+
+	// an atomic fragment is decoded right away
+	assert.True(t, decoder.decodeLayers(testIPv6Fragment(transport, 0, len(transport)), ts))
+	testReassembled(t, decoder)
+	assert.Equal(t, uint64(1), decoder.DefragStats().Reassembled)
+}
+
+func TestDefrag_timeout(t *testing.T) {
+	decoder := testDefragDecoder(t)
+	transport := testTransport()
+	ts := time.Now()
+
+	assert.False(t, decoder.decodeLayers(testIPv4Fragment(1, transport, 0, 8), ts))
+
+	// the first fragment is dropped when the next one arrives too late
+	ts = ts.Add(IP_DEFRAG_TIMEOUT)
+	assert.False(t, decoder.decodeLayers(testIPv4Fragment(1, transport, 8, len(transport)), ts))
+	assert.Equal(t, DefragStats{Fragments: 2, Failed: 1}, decoder.DefragStats())
+	assert.Equal(t, 1, len(decoder.defrag.datagrams))
+}
+
+func TestDefrag_memoryLimit(t *testing.T) {
+	decoder := testDefragDecoder(t)
+	defragMaxBytes = 40
+	transport := testTransport()
+	ts := time.Now()
+
+	assert.False(t, decoder.decodeLayers(testIPv4Fragment(1, transport, 0, 16), ts))
+	assert.False(t, decoder.decodeLayers(testIPv4Fragment(2, transport, 0, 16), ts))
+	assert.Equal(t, 32, decoder.defrag.bytes)
+
+	// the oldest datagram is dropped to make room for the last fragment
+	assert.True(t, decoder.decodeLayers(testIPv4Fragment(2, transport, 16, len(transport)), ts))
+	testReassembled(t, decoder)
+	assert.Equal(t, DefragStats{Fragments: 3, Reassembled: 1, Failed: 1}, decoder.DefragStats())
+	assert.Equal(t, 0, decoder.defrag.bytes)
+}
+
+func TestDefrag_invalidLength(t *testing.T) {
+	decoder := testDefragDecoder(t)
+	transport := testTransport()
+	ts := time.Now()
+
+	assert.False(t, decoder.decodeLayers(testIPv4Fragment(1, transport, 16, len(transport)), ts))
+	// a fragment past the last one
+	assert.False(t, decoder.decodeLayers(testIPv4Fragment(1, append(transport, transport...),
+		len(transport), len(transport)+8), ts))
+	assert.Equal(t, uint64(1), decoder.DefragStats().Failed)
+	assert.Equal(t, 0, len(decoder.defrag.datagrams))
+}
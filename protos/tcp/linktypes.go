@@ -0,0 +1,205 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+)
+
+// Link types that gopacket doesn't decode.
+const (
+	// libpcap returns DLT_RAW for the files with LinkTypeRaw
+	linkTypeDltRaw layers.LinkType = 12
+	linkTypeNFLog  layers.LinkType = 239
+
+	// 276, gopacket stores the link types in a byte
+	linkTypeLinuxSLL2 layers.LinkType = 276 & 0xff
+)
+
+var (
+	layerTypeRawIP = gopacket.RegisterLayerType(1000, gopacket.LayerTypeMetadata{
+		Name: "RawIP", Decoder: gopacket.DecodeFunc(decodeRawIP)})
+	layerTypeNFLog = gopacket.RegisterLayerType(1001, gopacket.LayerTypeMetadata{
+		Name: "NFLog", Decoder: gopacket.DecodeFunc(decodeNFLog)})
+	layerTypeLinuxSLL2 = gopacket.RegisterLayerType(1002, gopacket.LayerTypeMetadata{
+		Name: "LinuxSLL2", Decoder: gopacket.DecodeFunc(decodeLinuxSLL2)})
+)
+
+type decodingLayer interface {
+	gopacket.Layer
+	gopacket.DecodingLayer
+}
+
+// Decodes the layer when the packet is decoded by gopacket.NewPacket.
+func decodeWith(l decodingLayer, data []byte, p gopacket.PacketBuilder) error {
+	err := l.DecodeFromBytes(data, p)
+	if err != nil {
+		return err
+	}
+	p.AddLayer(l)
+	return p.NextDecoder(l.NextLayerType())
+}
+
+// IP packet without link layer header, from tun interfaces. The IP
+// version is read from the first nibble.
+type rawIPLayer struct {
+	layers.BaseLayer
+}
+
+func decodeRawIP(data []byte, p gopacket.PacketBuilder) error {
+	return decodeWith(&rawIPLayer{}, data, p)
+}
+
+func (r *rawIPLayer) LayerType() gopacket.LayerType {
+	return layerTypeRawIP
+}
+
+func (r *rawIPLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) == 0 {
+		df.SetTruncated()
+		return errors.New("Empty raw IP packet")
+	}
+	r.Contents = data[:0]
+	r.Payload = data
+	return nil
+}
+
+func (r *rawIPLayer) CanDecode() gopacket.LayerClass {
+	return layerTypeRawIP
+}
+
+func (r *rawIPLayer) NextLayerType() gopacket.LayerType {
+	switch r.Payload[0] >> 4 {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	}
+	return gopacket.LayerTypePayload
+}
+
+// Packet logged by the iptables NFLOG target. The header is followed by
+// TLVs, one of which holds the IP packet.
+type nflogLayer struct {
+	layers.BaseLayer
+
+	Family     uint8
+	Version    uint8
+	ResourceId uint16
+}
+
+const (
+	nflogFamilyInet  = 2
+	nflogFamilyInet6 = 10
+	nflogTlvPayload  = 9
+)
+
+func decodeNFLog(data []byte, p gopacket.PacketBuilder) error {
+	return decodeWith(&nflogLayer{}, data, p)
+}
+
+func (n *nflogLayer) LayerType() gopacket.LayerType {
+	return layerTypeNFLog
+}
+
+func (n *nflogLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return errors.New("NFLOG header too short")
+	}
+	n.Family = data[0]
+	n.Version = data[1]
+	n.ResourceId = binary.BigEndian.Uint16(data[2:4])
+
+	// The length and the type of the TLVs are in the byte order of the
+	// capturing host, guessed from the length of the first one.
+	var order binary.ByteOrder = binary.LittleEndian
+	if len(data) >= 8 {
+		length := int(order.Uint16(data[4:6]))
+		if length < 4 || length > len(data)-4 {
+			order = binary.BigEndian
+		}
+	}
+
+	offset := 4
+	for offset+4 <= len(data) {
+		length := int(order.Uint16(data[offset : offset+2]))
+		tlvType := order.Uint16(data[offset+2 : offset+4])
+		if length < 4 || offset+length > len(data) {
+			df.SetTruncated()
+			return errors.New("Invalid NFLOG TLV length")
+		}
+		if tlvType == nflogTlvPayload {
+			n.Contents = data[:offset+4]
+			n.Payload = data[offset+4 : offset+length]
+			return nil
+		}
+		// the TLVs are aligned on 4 bytes
+		offset += (length + 3) &^ 3
+	}
+	return errors.New("No payload in the NFLOG packet")
+}
+
+func (n *nflogLayer) CanDecode() gopacket.LayerClass {
+	return layerTypeNFLog
+}
+
+func (n *nflogLayer) NextLayerType() gopacket.LayerType {
+	switch n.Family {
+	case nflogFamilyInet:
+		return layers.LayerTypeIPv4
+	case nflogFamilyInet6:
+		return layers.LayerTypeIPv6
+	}
+	return gopacket.LayerTypePayload
+}
+
+// Linux cooked capture v2 header, written by tcpdump for the "any"
+// device since libpcap 1.10.
+type linuxSLL2Layer struct {
+	layers.BaseLayer
+
+	ProtocolType   layers.EthernetType
+	InterfaceIndex uint32
+	AddrType       uint16
+	PacketType     layers.LinuxSLLPacketType
+	Addr           net.HardwareAddr
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	return decodeWith(&linuxSLL2Layer{}, data, p)
+}
+
+func (s *linuxSLL2Layer) LayerType() gopacket.LayerType {
+	return layerTypeLinuxSLL2
+}
+
+func (s *linuxSLL2Layer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 20 {
+		df.SetTruncated()
+		return errors.New("Linux SLL2 header too short")
+	}
+	s.ProtocolType = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	s.InterfaceIndex = binary.BigEndian.Uint32(data[4:8])
+	s.AddrType = binary.BigEndian.Uint16(data[8:10])
+	s.PacketType = layers.LinuxSLLPacketType(data[10])
+	addrLen := int(data[11])
+	if addrLen > 8 {
+		addrLen = 8
+	}
+	s.Addr = net.HardwareAddr(data[12 : 12+addrLen])
+	s.Contents = data[:20]
+	s.Payload = data[20:]
+	return nil
+}
+
+func (s *linuxSLL2Layer) CanDecode() gopacket.LayerClass {
+	return layerTypeLinuxSLL2
+}
+
+func (s *linuxSLL2Layer) NextLayerType() gopacket.LayerType {
+	return s.ProtocolType.LayerType()
+}
@@ -0,0 +1,77 @@
+package tcp
+
+import (
+	"io"
+	"testing"
+
+	"github.com/packetbeat/gopacket/layers"
+	"github.com/packetbeat/gopacket/pcap"
+	"github.com/stretchr/testify/assert"
+)
+
+// Decodes all the packets of the pcap file, each holding the same HTTP
+// request, and returns the source IPs.
+func testDecodePcap(t *testing.T, file string) []string {
+	handle, err := pcap.OpenOffline("../../tests/pcaps/" + file)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %s", file, err)
+	}
+	defer handle.Close()
+
+	decoder, err := CreateDecoder(handle.LinkType())
+	if err != nil {
+		t.Fatalf("Failed to create the decoder for %s: %s", file, err)
+	}
+
+	srcIps := []string{}
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read %s: %s", file, err)
+		}
+
+		decoder.dot1q.reset()
+		assert.True(t, decoder.decodeLayers(data, ci.Timestamp), file)
+		assert.Contains(t, decoder.decoded, layers.LayerTypeTCP, file)
+		assert.Equal(t, layers.TCPPort(80), decoder.tcp.DstPort, file)
+		assert.Equal(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			string(decoder.tcp.Payload), file)
+
+		for _, layerType := range decoder.decoded {
+			switch layerType {
+			case layers.LayerTypeIPv4:
+				srcIps = append(srcIps, decoder.ip4.SrcIP.String())
+			case layers.LayerTypeIPv6:
+				srcIps = append(srcIps, decoder.ip6.SrcIP.String())
+			}
+		}
+	}
+	return srcIps
+}
+
+func TestDecoder_rawIP(t *testing.T) {
+	assert.Equal(t, []string{"192.168.0.1", "2001:db8::1"},
+		testDecodePcap(t, "tcp_raw.pcap"))
+	assert.Equal(t, []string{"192.168.0.1"},
+		testDecodePcap(t, "tcp_linktype_ipv4.pcap"))
+	assert.Equal(t, []string{"2001:db8::1"},
+		testDecodePcap(t, "tcp_linktype_ipv6.pcap"))
+}
+
+func TestDecoder_nflog(t *testing.T) {
+	assert.Equal(t, []string{"192.168.0.1", "2001:db8::1"},
+		testDecodePcap(t, "tcp_nflog.pcap"))
+}
+
+func TestDecoder_linuxSLL2(t *testing.T) {
+	assert.Equal(t, []string{"192.168.0.1", "2001:db8::1"},
+		testDecodePcap(t, "tcp_sll2.pcap"))
+}
+
+func TestDecoder_unsupportedLinkType(t *testing.T) {
+	_, err := CreateDecoder(layers.LinkTypeFDDI)
+	assert.NotNil(t, err)
+}
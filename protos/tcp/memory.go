@@ -0,0 +1,123 @@
+package tcp
+
+import (
+	"packetbeat/logp"
+	"packetbeat/protos"
+	"sync/atomic"
+)
+
+// Default budget for the memory held by the TCP streams of all the
+// workers: the segments buffered for reassembly or detection, the frames
+// kept for the packet dumps, and the state of the protocol plugins.
+const TCP_MEMORY_BUDGET = 512 * 1024 * 1024
+
+var memoryBudget int64 = TCP_MEMORY_BUDGET
+
+// Part of the budget down to which a worker evicts its streams, set
+// when the workers are started.
+var memoryShare int64 = TCP_MEMORY_BUDGET
+
+// Bytes held by the streams of all the workers, and the eviction
+// counters. They are updated atomically by the workers.
+var memoryUsed int64
+var evictedStreams uint64
+var evictedBytes uint64
+
+// Counters of the memory budget of the TCP streams.
+type MemoryStats struct {
+	Budget         int64  // configured budget, in bytes
+	Used           int64  // bytes held by the streams
+	EvictedStreams uint64 // streams dropped to stay within the budget
+	EvictedBytes   uint64 // bytes they were holding
+}
+
+func GetMemoryStats() MemoryStats {
+	return MemoryStats{
+		Budget:         memoryBudget,
+		Used:           atomic.LoadInt64(&memoryUsed),
+		EvictedStreams: atomic.LoadUint64(&evictedStreams),
+		EvictedBytes:   atomic.LoadUint64(&evictedBytes),
+	}
+}
+
+// Returns the bytes held for the stream, by the TCP layer and by its
+// protocol plugin.
+func (stream *TcpStream) memoryUse() int {
+	size := stream.reassembly[0].bytes + stream.reassembly[1].bytes +
+		len(stream.detectBuf[0]) + len(stream.detectBuf[1]) +
+		stream.tcptuple.Packets.Bytes()
+
+	user, ok := stream.worker.protos.Get(stream.protocol).(protos.MemoryUser)
+	if ok {
+		size += user.StreamMemory(&stream.tcptuple, stream.Data)
+	}
+	return size
+}
+
+// Updates the memory accounted for the stream, after a packet of it was
+// processed, and evicts the least recently used streams of the worker if
+// the budget is exceeded.
+func (w *worker) accountMemory(stream *TcpStream) {
+	if stream.lru != nil {
+		size := stream.memoryUse()
+		w.memory += size - stream.memory
+		atomic.AddInt64(&memoryUsed, int64(size-stream.memory))
+		stream.memory = size
+		w.lru.MoveToBack(stream.lru)
+	}
+
+	// Each worker evicts its own streams, down to its share of the
+	// budget, so that the workers holding little memory keep their
+	// streams.
+	for atomic.LoadInt64(&memoryUsed) > memoryBudget && int64(w.memory) > memoryShare {
+		oldest := w.lru.Front()
+		if oldest == nil {
+			return
+		}
+		oldest.Value.(*TcpStream).evict()
+	}
+}
+
+// Drops the stream and the state of its protocol plugin.
+func (stream *TcpStream) evict() {
+	logp.Debug("tcp", "Evicting stream %d holding %d bytes", stream.id, stream.memory)
+	atomic.AddUint64(&evictedStreams, 1)
+	atomic.AddUint64(&evictedBytes, uint64(stream.memory))
+
+	stream.publishFlow(FlowClosedEvicted)
+
+	mod := stream.worker.protos.Get(stream.protocol)
+	if user, ok := mod.(protos.MemoryUser); ok {
+		user.DropStream(&stream.tcptuple, stream.Data)
+	} else if mod != nil {
+		mod.ConnectionExpired(&stream.tcptuple, stream.Data)
+	}
+
+	stream.remove()
+}
+
+// Removes the stream from its worker and releases the memory accounted
+// for it.
+func (stream *TcpStream) remove() {
+	w := stream.worker
+	if stream.timer != nil {
+		stream.timer.Stop()
+	}
+	if stream.reassemblyTimer != nil {
+		stream.reassemblyTimer.Stop()
+		stream.reassemblyTimer = nil
+	}
+	delete(w.streams, stream.tuple.Hashable())
+	if stream.lru != nil {
+		w.lru.Remove(stream.lru)
+		stream.lru = nil
+	}
+	w.memory -= stream.memory
+	atomic.AddInt64(&memoryUsed, -int64(stream.memory))
+	stream.memory = 0
+
+	// nullify to help the GC
+	stream.Data = nil
+	stream.reassembly = [2]reassemblyBuffer{}
+	stream.detectBuf = [2][]byte{}
+}
@@ -0,0 +1,110 @@
+package tcp
+
+import (
+	"packetbeat/protos"
+	"time"
+
+	"github.com/packetbeat/gopacket/layers"
+)
+
+// A TCP segment received ahead of the next expected sequence number.
+// It is kept until the data in front of it arrives or until the
+// reassembly limits are exceeded.
+type tcpSegment struct {
+	seq    uint32
+	seqEnd uint32
+	pkt    *protos.Packet
+	tcphdr layers.TCP
+}
+
+// Out-of-order segments of one direction of a TCP stream, sorted by
+// sequence number.
+type reassemblyBuffer struct {
+	segments []*tcpSegment
+	bytes    int
+}
+
+func newTcpSegment(pkt *protos.Packet, tcphdr *layers.TCP) *tcpSegment {
+	seg := &tcpSegment{
+		seq:    tcphdr.Seq,
+		seqEnd: tcphdr.Seq + uint32(len(pkt.Payload)),
+		pkt:    pkt,
+		tcphdr: *tcphdr,
+	}
+	if tcphdr.SYN {
+		// the SYN and FIN flags consume one sequence number each
+		seg.seqEnd++
+	}
+	if tcphdr.FIN {
+		seg.seqEnd++
+	}
+	return seg
+}
+
+// Adds a segment to the buffer, keeping it sorted. When a segment
+// with the same sequence number is already buffered, the longer of
+// the two is kept.
+func (buf *reassemblyBuffer) insert(seg *tcpSegment) {
+	i := 0
+	for ; i < len(buf.segments); i++ {
+		if !TcpSeqBefore(buf.segments[i].seq, seg.seq) {
+			break
+		}
+	}
+
+	if i < len(buf.segments) && buf.segments[i].seq == seg.seq {
+		old := buf.segments[i]
+		if TcpSeqBeforeEq(seg.seqEnd, old.seqEnd) {
+			// retransmission of something we already hold
+			return
+		}
+		buf.bytes += len(seg.pkt.Payload) - len(old.pkt.Payload)
+		buf.segments[i] = seg
+		return
+	}
+
+	buf.segments = append(buf.segments, nil)
+	copy(buf.segments[i+1:], buf.segments[i:])
+	buf.segments[i] = seg
+	buf.bytes += len(seg.pkt.Payload)
+}
+
+// Removes and returns the segment with the lowest sequence number.
+func (buf *reassemblyBuffer) pop() *tcpSegment {
+	seg := buf.segments[0]
+	buf.segments[0] = nil
+	buf.segments = buf.segments[1:]
+	buf.bytes -= len(seg.pkt.Payload)
+	if len(buf.segments) == 0 {
+		buf.segments = nil
+	}
+	return seg
+}
+
+func (buf *reassemblyBuffer) empty() bool {
+	return len(buf.segments) == 0
+}
+
+// Returns the capture time of the oldest segment in the buffer.
+func (buf *reassemblyBuffer) oldest() time.Time {
+	var ts time.Time
+	for _, seg := range buf.segments {
+		if ts.IsZero() || seg.pkt.Ts.Before(ts) {
+			ts = seg.pkt.Ts
+		}
+	}
+	return ts
+}
+
+// Returns true if the buffered segments exceed the configured byte
+// limit or were held for the configured time, meaning that the missing
+// data is not likely to arrive anymore.
+func (buf *reassemblyBuffer) overLimits(now time.Time) bool {
+	if buf.empty() {
+		return false
+	}
+	if buf.bytes > reassemblyMaxBytes {
+		return true
+	}
+	return now.Sub(buf.oldest()) >= reassemblyTimeout
+}
@@ -1,12 +1,16 @@
 package tcp
 
 import (
+	"container/list"
 	"fmt"
 	"packetbeat/common"
 	"packetbeat/config"
+	"packetbeat/dumps"
 	"packetbeat/logp"
 	"packetbeat/protos"
+	"packetbeat/protos/udp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/packetbeat/gopacket"
@@ -17,6 +21,17 @@ const TCP_STREAM_EXPIRY = 10 * 1e9
 const TCP_STREAM_HASH_SIZE = 2 ^ 16
 const TCP_MAX_DATA_IN_STREAM = 10 * 1e6
 
+// Defaults for the out-of-order segments buffer, per stream direction.
+const TCP_REASSEMBLY_MAX_BYTES = 256 * 1024
+const TCP_REASSEMBLY_TIMEOUT = 2 * time.Second
+
+// Default number of goroutines following the TCP streams.
+const TCP_DEFAULT_WORKERS = 1
+
+// Default number of bytes of a stream on which the protocol detection
+// is tried.
+const TCP_DETECT_MAX_BYTES = 1024
+
 const (
 	TcpDirectionReverse  = 0
 	TcpDirectionOriginal = 1
@@ -25,51 +40,81 @@ const (
 var __id uint32 = 0
 
 func GetId() uint32 {
-	__id += 1
-	return __id
+	return atomic.AddUint32(&__id, 1)
 }
 
 // Config
 
-var tcpStreamsMap = make(map[common.HashableIpPortTuple]*TcpStream, TCP_STREAM_HASH_SIZE)
 var tcpPortMap map[uint16]protos.Protocol
+var tcpScopes protos.AddressScopes
+
+var streamExpiry time.Duration = TCP_STREAM_EXPIRY
+
+var reassemblyMaxBytes int = TCP_REASSEMBLY_MAX_BYTES
+var reassemblyTimeout time.Duration = TCP_REASSEMBLY_TIMEOUT
+
+var detectProtocols bool
+var detectMaxBytes int = TCP_DETECT_MAX_BYTES
 
 func decideProtocol(tuple *common.IpPortTuple) protos.Protocol {
 	protocol, exists := tcpPortMap[tuple.Src_port]
-	if exists {
-		return protocol
+	if !exists {
+		protocol, exists = tcpPortMap[tuple.Dst_port]
 	}
-
-	protocol, exists = tcpPortMap[tuple.Dst_port]
-	if exists {
-		return protocol
+	if !exists || !tcpScopes.Contains(protocol, tuple) {
+		return protos.UnknownProtocol
 	}
 
-	return protos.UnknownProtocol
+	return protocol
 }
 
 type TcpStream struct {
 	id       uint32
 	tuple    *common.IpPortTuple
-	timer    *time.Timer
+	timer    *protos.Timer
 	protocol protos.Protocol
 	tcptuple common.TcpTuple
+	worker   *worker
 
 	lastSeq [2]uint32
 
+	// sequence numbers following the FIN of each direction, and
+	// whether the other side acknowledged them
+	finSeq   [2]uint32
+	finAcked [2]bool
+
+	// segments received ahead of lastSeq, and the timer reporting the
+	// gaps in front of them when the stream goes idle
+	reassembly      [2]reassemblyBuffer
+	reassemblyTimer *protos.Timer
+
+	flow flowStats
+
+	// first bytes of each direction, kept while detecting the protocol
+	detecting bool
+	detectBuf [2][]byte
+
 	// protocols private data
 	Data protos.ProtocolData
+
+	// bytes accounted in the memory budget, and position in the
+	// streams of the worker by last packet
+	memory int
+	lru    *list.Element
 }
 
 func (stream *TcpStream) AddPacket(pkt *protos.Packet, tcphdr *layers.TCP, original_dir uint8) {
 
-	// create/reset timer
-	if stream.timer != nil {
-		stream.timer.Stop()
+	if stream.protocol == protos.UnknownProtocol {
+		if !stream.detecting || len(pkt.Payload) == 0 ||
+			!stream.detectProtocol(pkt, original_dir) {
+
+			// followed only for the flow events or the detection
+			return
+		}
 	}
-	stream.timer = time.AfterFunc(TCP_STREAM_EXPIRY, func() { stream.Expire() })
 
-	mod := protos.Protos.Get(stream.protocol)
+	mod := stream.worker.protos.Get(stream.protocol)
 	if mod == nil {
 		logp.Debug("tcp", "Ignoring protocol for which we have no module loaded: %s", stream.protocol)
 		return
@@ -84,20 +129,187 @@ func (stream *TcpStream) AddPacket(pkt *protos.Packet, tcphdr *layers.TCP, origi
 	}
 }
 
+// Tries the protocol probes on the first bytes of the stream. When a
+// protocol is recognized, the bytes buffered in the other direction are
+// passed to its plugin and the payload of pkt is replaced by all the
+// bytes seen so far in its direction. Returns true in that case.
+func (stream *TcpStream) detectProtocol(pkt *protos.Packet, original_dir uint8) bool {
+	buf := append(stream.detectBuf[original_dir], pkt.Payload...)
+
+	protocol := stream.worker.protos.Detect(buf, original_dir)
+	if protocol == protos.UnknownProtocol {
+		stream.detectBuf[original_dir] = buf
+		if len(stream.detectBuf[0])+len(stream.detectBuf[1]) >= detectMaxBytes {
+			logp.Debug("tcp", "No protocol detected on stream %d", stream.id)
+			stream.detecting = false
+			stream.detectBuf = [2][]byte{}
+		}
+		return false
+	}
+	if !tcpScopes.Contains(protocol, stream.tuple) {
+		logp.Debug("tcp", "Detected protocol %s out of its scope on stream %d", protocol, stream.id)
+		stream.detecting = false
+		stream.detectBuf = [2][]byte{}
+		return false
+	}
+
+	logp.Debug("tcp", "Detected protocol %s on stream %d", protocol, stream.id)
+	stream.protocol = protocol
+	stream.detecting = false
+
+	other := 1 - original_dir
+	if len(stream.detectBuf[other]) > 0 {
+		mod := stream.worker.protos.Get(protocol)
+		stream.Data = mod.Parse(&protos.Packet{Ts: pkt.Ts, Payload: stream.detectBuf[other]},
+			&stream.tcptuple, other, stream.Data)
+	}
+	stream.detectBuf = [2][]byte{}
+
+	pkt.Payload = buf
+	return true
+}
+
 func (stream *TcpStream) GapInStream(original_dir uint8) {
-	mod := protos.Protos.Get(stream.protocol)
+	stream.flow.gaps += 1
+
+	mod := stream.worker.protos.Get(stream.protocol)
+	if mod == nil {
+		return
+	}
 	stream.Data = mod.GapInStream(&stream.tcptuple, original_dir, stream.Data)
 }
 
+func (stream *TcpStream) ReceivedRst(original_dir uint8) {
+	mod := stream.worker.protos.Get(stream.protocol)
+	if mod == nil {
+		return
+	}
+	stream.Data = mod.ReceivedRst(&stream.tcptuple, original_dir, stream.Data)
+}
+
+// Passes to the protocol module the buffered segments that are now
+// in order, trimming what was already seen.
+func (stream *TcpStream) flushReassembled(original_dir uint8) {
+	buf := &stream.reassembly[original_dir]
+
+	for !buf.empty() {
+		if TcpSeqBefore(stream.lastSeq[original_dir], buf.segments[0].seq) {
+			// still missing data in front of it
+			return
+		}
+
+		seg := buf.pop()
+		if TcpSeqBeforeEq(seg.seqEnd, stream.lastSeq[original_dir]) {
+			// fully covered by what we already got
+			continue
+		}
+
+		overlap := stream.lastSeq[original_dir] - seg.seq
+		if int(overlap) < len(seg.pkt.Payload) {
+			seg.pkt.Payload = seg.pkt.Payload[overlap:]
+		} else {
+			seg.pkt.Payload = nil
+		}
+
+		stream.lastSeq[original_dir] = seg.seqEnd
+		stream.AddPacket(seg.pkt, &seg.tcphdr, original_dir)
+	}
+}
+
+// Reports a gap to the protocol module for the directions in which
+// the buffered segments exceed the reassembly limits. The missing data
+// is skipped and the processing continues with the buffered segments.
+func (stream *TcpStream) checkGaps(now time.Time) {
+	for dir := range stream.reassembly {
+		if stream.reassembly[dir].overLimits(now) {
+			stream.skipGap(uint8(dir))
+		}
+	}
+}
+
+// Reports the data missing in front of the first buffered segment as a
+// gap and passes the segments that follow it to the protocol module.
+func (stream *TcpStream) skipGap(original_dir uint8) {
+	buf := &stream.reassembly[original_dir]
+
+	logp.Debug("tcp", "Gap in tcp stream. last_seq: %d, seq: %d, buffered: %d bytes",
+		stream.lastSeq[original_dir], buf.segments[0].seq, buf.bytes)
+
+	stream.GapInStream(original_dir)
+	stream.lastSeq[original_dir] = buf.segments[0].seq
+	stream.flushReassembled(original_dir)
+}
+
+// Arms the reassembly timer while segments are buffered, so that the
+// gaps are reported even if no more packets arrive on the stream, and
+// stops it once the buffers are empty.
+func (stream *TcpStream) armReassemblyTimer() {
+	if stream.reassembly[0].empty() && stream.reassembly[1].empty() {
+		if stream.reassemblyTimer != nil {
+			stream.reassemblyTimer.Stop()
+			stream.reassemblyTimer = nil
+		}
+		return
+	}
+	if stream.reassemblyTimer != nil {
+		return
+	}
+
+	stream.reassemblyTimer = stream.worker.timers.AfterFunc(reassemblyTimeout, func() {
+		stream.reassemblyTimer = nil
+		stream.checkGaps(stream.worker.timers.Now())
+		stream.armReassemblyTimer()
+		stream.worker.accountMemory(stream)
+	})
+}
+
 func (stream *TcpStream) Expire() {
 
 	logp.Debug("mem", "Tcp stream expired")
 
-	// de-register from dict
-	delete(tcpStreamsMap, stream.tuple.Hashable())
+	stream.close(FlowClosedTimeout)
+}
+
+// Ends the stream and removes it, so that a new connection can reuse
+// its tuple. The missing data won't arrive anymore, the buffered
+// segments are passed to the protocol module after reporting the gaps,
+// then the module flushes what it holds for the stream.
+func (stream *TcpStream) close(reason string) {
+	for dir := range stream.reassembly {
+		for !stream.reassembly[dir].empty() {
+			stream.skipGap(uint8(dir))
+		}
+	}
+
+	stream.publishFlow(reason)
+
+	mod := stream.worker.protos.Get(stream.protocol)
+	if mod != nil {
+		mod.ConnectionExpired(&stream.tcptuple, stream.Data)
+	}
+
+	stream.remove()
+}
+
+// Returns true if the SYN starts a new connection on the tuple of the
+// stream, its sequence number not matching the one tracked in its
+// direction. A retransmitted SYN matches it.
+func (stream *TcpStream) isNewConnection(tcphdr *layers.TCP, original_dir uint8) bool {
+	lastSeq := stream.lastSeq[original_dir]
+	return tcphdr.SYN && lastSeq != 0 && tcphdr.Seq+1 != lastSeq
+}
+
+// Records the FIN of the packet and the acknowledgment of the FIN of
+// the other direction.
+func (stream *TcpStream) trackClose(seg *tcpSegment, original_dir uint8) {
+	if seg.tcphdr.FIN {
+		stream.finSeq[original_dir] = seg.seqEnd
+	}
 
-	// nullify to help the GC
-	stream.Data = nil
+	other := 1 - original_dir
+	if seg.tcphdr.ACK && stream.flow.fin[other] && seg.tcphdr.Ack == stream.finSeq[other] {
+		stream.finAcked[other] = true
+	}
 }
 
 func TcpSeqBefore(seq1 uint32, seq2 uint32) bool {
@@ -108,68 +320,186 @@ func TcpSeqBeforeEq(seq1 uint32, seq2 uint32) bool {
 	return int32(seq1-seq2) <= 0
 }
 
-func FollowTcp(tcphdr *layers.TCP, pkt *protos.Packet) {
-	stream, exists := tcpStreamsMap[pkt.Tuple.Hashable()]
+// Records the capture times of the three-way handshake packets.
+func (stream *TcpStream) trackHandshake(tcphdr *layers.TCP, ts time.Time, original_dir uint8) {
+	h := stream.tcptuple.Handshake
+	if h == nil || !h.Ack.IsZero() {
+		return
+	}
+
+	switch {
+	case tcphdr.SYN && !tcphdr.ACK && original_dir == TcpDirectionOriginal:
+		if h.Syn.IsZero() {
+			h.Syn = ts
+		}
+	case tcphdr.SYN && tcphdr.ACK && original_dir == TcpDirectionReverse:
+		if h.SynAck.IsZero() {
+			h.SynAck = ts
+		}
+	case !tcphdr.SYN && tcphdr.ACK && original_dir == TcpDirectionOriginal:
+		if !h.SynAck.IsZero() {
+			h.Ack = ts
+			logp.Debug("tcp", "Handshake completed in %s", h.Ack.Sub(h.Syn))
+		}
+	}
+}
+
+// Returns true if the packet goes from the server to the client. This is
+// known from the handshake flags or, when the start of the connection
+// wasn't captured, guessed from the configured ports.
+func fromServer(tcphdr *layers.TCP, tuple *common.IpPortTuple) bool {
+	if tcphdr.SYN {
+		return tcphdr.ACK
+	}
+	_, srcKnown := tcpPortMap[tuple.Src_port]
+	_, dstKnown := tcpPortMap[tuple.Dst_port]
+	return srcKnown && !dstKnown
+}
+
+func (w *worker) followTcp(tcphdr *layers.TCP, pkt *protos.Packet) {
+	stream, exists := w.streams[pkt.Tuple.Hashable()]
 	var original_dir uint8 = TcpDirectionOriginal
-	created := false
 	if !exists {
-		stream, exists = tcpStreamsMap[pkt.Tuple.RevHashable()]
+		stream, exists = w.streams[pkt.Tuple.RevHashable()]
 		if !exists {
 			protocol := decideProtocol(&pkt.Tuple)
-			if protocol == protos.UnknownProtocol {
+			if protocol == protos.UnknownProtocol && !flowsAllPorts && !detectProtocols {
 				// don't follow
 				return
 			}
+			if tcphdr.RST {
+				// nothing to follow
+				return
+			}
 			logp.Debug("tcp", "Stream doesn't exists, creating new")
 
+			// the original direction is from the client to the server
+			tuple := &pkt.Tuple
+			if fromServer(tcphdr, &pkt.Tuple) {
+				rev := common.NewIpPortTuple(pkt.Tuple.Ip_length,
+					pkt.Tuple.Dst_ip, pkt.Tuple.Dst_port,
+					pkt.Tuple.Src_ip, pkt.Tuple.Src_port)
+				rev.Vlan = pkt.Tuple.Vlan
+				rev.Device = pkt.Tuple.Device
+				rev.ComputeHashebles()
+				tuple = &rev
+				original_dir = TcpDirectionReverse
+			}
+
 			// create
-			stream = &TcpStream{id: GetId(), tuple: &pkt.Tuple, protocol: protocol}
+			stream = &TcpStream{id: GetId(), tuple: tuple, protocol: protocol, worker: w,
+				detecting: protocol == protos.UnknownProtocol && detectProtocols}
 			stream.tcptuple = common.TcpTupleFromIpPort(stream.tuple, stream.id)
-			tcpStreamsMap[pkt.Tuple.Hashable()] = stream
-			created = true
+			if tcphdr.SYN {
+				stream.tcptuple.Handshake = &common.TcpHandshake{}
+			}
+			if dumps.Triggered.Enabled() {
+				stream.tcptuple.Packets = common.NewPacketRing(
+					dumps.Triggered.RingSize, stream.id)
+			}
+			w.streams[tuple.Hashable()] = stream
+			stream.lru = w.lru.PushBack(stream)
 		} else {
 			original_dir = TcpDirectionReverse
 		}
 	}
-	tcp_start_seq := tcphdr.Seq
-	tcp_seq := tcp_start_seq + uint32(len(pkt.Payload))
+
+	if stream.isNewConnection(tcphdr, original_dir) {
+		logp.Debug("tcp", "New connection on the tuple of stream %d", stream.id)
+		stream.close(FlowClosedReused)
+		w.followTcp(tcphdr, pkt)
+		return
+	}
+	defer w.accountMemory(stream)
+
+	if stream.tcptuple.Packets != nil {
+		stream.tcptuple.Packets.Add(pkt.Ts, pkt.Frame, pkt.Length, pkt.Datalink)
+	}
+
+	// create/reset timer, on the received packets only, the segments
+	// passed later from the reassembly buffers don't keep the stream
+	// alive
+	if stream.timer != nil {
+		stream.timer.Stop()
+	}
+	stream.timer = w.timers.AfterFunc(streamExpiry, func() { stream.Expire() })
+
+	stream.trackHandshake(tcphdr, pkt.Ts, original_dir)
+	stream.countPacket(pkt, tcphdr, original_dir)
+	if tcphdr.RST {
+		stream.publishFlow(FlowClosedRst)
+
+		// the connection is aborted, the rest of the segment and
+		// anything still buffered for reassembly is not delivered
+		stream.ReceivedRst(original_dir)
+		stream.remove()
+		return
+	}
+
+	seg := newTcpSegment(pkt, tcphdr)
+
+	stream.trackClose(seg, original_dir)
+	if stream.flow.fin[0] && stream.flow.fin[1] {
+		stream.publishFlow(FlowClosedFin)
+
+		if stream.finAcked[0] && stream.finAcked[1] {
+			// final ACK of the close
+			stream.close(FlowClosedFin)
+			return
+		}
+	}
 
 	logp.Debug("tcp", "pkt.start_seq=%v pkt.last_seq=%v stream.last_seq=%v (len=%d)",
-		tcp_start_seq, tcp_seq, stream.lastSeq[original_dir], len(pkt.Payload))
+		seg.seq, seg.seqEnd, stream.lastSeq[original_dir], len(pkt.Payload))
 
-	if len(pkt.Payload) > 0 &&
-		stream.lastSeq[original_dir] != 0 {
+	if stream.lastSeq[original_dir] != 0 {
 
-		if TcpSeqBeforeEq(tcp_seq, stream.lastSeq[original_dir]) {
+		if TcpSeqBeforeEq(seg.seqEnd, stream.lastSeq[original_dir]) {
+			if seg.seqEnd != seg.seq {
+				stream.flow.retransmissions += 1
+			}
 
 			logp.Debug("tcp", "Ignoring what looks like a retrasmitted segment. pkt.seq=%v len=%v stream.seq=%v",
 				tcphdr.Seq, len(pkt.Payload), stream.lastSeq[original_dir])
 			return
 		}
 
-		if TcpSeqBefore(stream.lastSeq[original_dir], tcp_start_seq) {
-			logp.Debug("tcp", "Gap in tcp stream. last_seq: %d, seq: %d", stream.lastSeq[original_dir], tcp_start_seq)
-			if !created {
-				stream.GapInStream(original_dir)
-				// drop stream
-				stream.Expire()
-				return
-			}
+		if TcpSeqBefore(stream.lastSeq[original_dir], seg.seq) {
+			logp.Debug("tcp", "Segment ahead of the stream, buffering it. last_seq: %d, seq: %d",
+				stream.lastSeq[original_dir], seg.seq)
+
+			stream.reassembly[original_dir].insert(seg)
+			stream.checkGaps(pkt.Ts)
+			stream.armReassemblyTimer()
+			return
+		}
+
+		// partial retransmission, skip what was already seen
+		if TcpSeqBefore(seg.seq, stream.lastSeq[original_dir]) {
+			stream.flow.retransmissions += 1
 		}
+		pkt.Payload = pkt.Payload[stream.lastSeq[original_dir]-seg.seq:]
 	}
-	stream.lastSeq[original_dir] = tcp_seq
+	stream.lastSeq[original_dir] = seg.seqEnd
 
 	stream.AddPacket(pkt, tcphdr, original_dir)
+	stream.flushReassembled(original_dir)
+	stream.checkGaps(pkt.Ts)
+	stream.armReassemblyTimer()
 }
 
 func PrintTcpMap() {
 	fmt.Printf("Streams in memory:")
-	for _, stream := range tcpStreamsMap {
-		fmt.Printf(" %d", stream.id)
+	for _, w := range workers {
+		for _, stream := range w.streams {
+			fmt.Printf(" %d", stream.id)
+		}
 	}
 	fmt.Printf("\n")
 
-	fmt.Printf("Streams dict: %v", tcpStreamsMap)
+	for i, w := range workers {
+		fmt.Printf("Streams dict of worker %d: %v\n", i, w.streams)
+	}
 }
 
 func configToPortsMap(protocols map[string]config.Protocol) (map[uint16]protos.Protocol, error) {
@@ -183,16 +513,23 @@ func configToPortsMap(protocols map[string]config.Protocol) (map[uint16]protos.P
 			continue
 		}
 
-		for _, port := range protoConfig.Ports {
-			old_proto, exists := res[uint16(port)]
-			if exists {
-				if old_proto == proto {
-					continue
+		ranges, err := protos.ConfigToPortRanges(protoConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", proto, err)
+		}
+
+		for _, r := range ranges {
+			for port := int(r.First); port <= int(r.Last); port++ {
+				old_proto, exists := res[uint16(port)]
+				if exists {
+					if old_proto == proto {
+						continue
+					}
+					return nil, fmt.Errorf("Duplicate port (%d) exists in %s and %s protocols",
+						port, old_proto, proto)
 				}
-				return nil, fmt.Errorf("Duplicate port (%d) exists in %s and %s protocols",
-					port, old_proto, proto)
+				res[uint16(port)] = proto
 			}
-			res[uint16(port)] = proto
 		}
 	}
 
@@ -201,18 +538,37 @@ func configToPortsMap(protocols map[string]config.Protocol) (map[uint16]protos.P
 
 func ConfigToFilter(protocols map[string]config.Protocol) string {
 
+	if config.ConfigSingleton.Flows.Enabled && config.ConfigSingleton.Flows.All_ports {
+		// the flows of all the connections are published
+		return "tcp"
+	}
+	if config.ConfigSingleton.Tcp.Detect_protocols {
+		// the protocols can run on any port
+		return "tcp"
+	}
+
 	res := []string{}
 
-	for _, protoConfig := range protocols {
-		for _, port := range protoConfig.Ports {
-			res = append(res, fmt.Sprintf("port %d", port))
+	var proto protos.Protocol
+	for proto = protos.UnknownProtocol + 1; int(proto) < len(protos.ProtocolNames); proto++ {
+		protoConfig, exists := protocols[protos.ProtocolNames[proto]]
+		if !exists {
+			continue
+		}
+
+		// the configuration was validated by TcpInit
+		ranges, _ := protos.ConfigToPortRanges(protoConfig)
+		scope, _ := protos.ConfigToAddressScope(protoConfig)
+		filter := protos.ProtocolFilter("", ranges, scope)
+		if len(filter) > 0 {
+			res = append(res, filter)
 		}
 	}
 
 	return strings.Join(res, " or ")
 }
 
-func TcpInit(protocols map[string]config.Protocol) error {
+func TcpInit(protocols map[string]config.Protocol, events chan common.MapStr) error {
 	var err error
 	tcpPortMap, err = configToPortsMap(protocols)
 	if err != nil {
@@ -221,66 +577,220 @@ func TcpInit(protocols map[string]config.Protocol) error {
 
 	logp.Debug("tcp", "Port map: %v", tcpPortMap)
 
+	tcpScopes, err = protos.ConfigToAddressScopes(protocols)
+	if err != nil {
+		return err
+	}
+
+	tcpConfig := config.ConfigSingleton.Tcp
+	if tcpConfig.Memory_budget_mb > 0 {
+		memoryBudget = int64(tcpConfig.Memory_budget_mb) * 1024 * 1024
+	}
+	logp.Debug("tcp", "Memory budget: %d bytes", memoryBudget)
+
+	if tcpConfig.Stream_timeout > 0 {
+		streamExpiry = time.Duration(tcpConfig.Stream_timeout) * time.Millisecond
+	}
+	logp.Debug("tcp", "Streams expire after %s without packets", streamExpiry)
+
+	if tcpConfig.Reassembly_buffer_kb > 0 {
+		reassemblyMaxBytes = tcpConfig.Reassembly_buffer_kb * 1024
+	}
+	if tcpConfig.Reassembly_timeout > 0 {
+		reassemblyTimeout = time.Duration(tcpConfig.Reassembly_timeout) * time.Millisecond
+	}
+	logp.Debug("tcp", "Reassembly buffer: %d bytes, timeout: %s", reassemblyMaxBytes, reassemblyTimeout)
+
+	ipConfig := config.ConfigSingleton.Ip
+	if ipConfig.Defrag_buffer_kb > 0 {
+		defragMaxBytes = ipConfig.Defrag_buffer_kb * 1024
+	}
+	if ipConfig.Defrag_timeout > 0 {
+		defragTimeout = time.Duration(ipConfig.Defrag_timeout) * time.Millisecond
+	}
+	logp.Debug("tcp", "IP defragmentation buffer: %d bytes, timeout: %s", defragMaxBytes, defragTimeout)
+
+	detectProtocols = tcpConfig.Detect_protocols
+	if tcpConfig.Detect_max_bytes > 0 {
+		detectMaxBytes = tcpConfig.Detect_max_bytes
+	}
+	logp.Debug("tcp", "Protocol detection: %v, on up to %d bytes", detectProtocols, detectMaxBytes)
+
+	flowsEnabled = config.ConfigSingleton.Flows.Enabled
+	flowsAllPorts = flowsEnabled && config.ConfigSingleton.Flows.All_ports
+	results = events
+	logp.Debug("tcp", "Flows enabled: %v, on all ports: %v", flowsEnabled, flowsAllPorts)
+
+	workersCount := TCP_DEFAULT_WORKERS
+	if tcpConfig.Workers > 0 {
+		workersCount = tcpConfig.Workers
+	}
+	startWorkers(workersCount)
+
 	return nil
 }
 
 type DecoderStruct struct {
 	Parser *gopacket.DecodingLayerParser
 
+	// name of the capture device, set on the decoded packets
+	Device string
+
+	datalink layers.LinkType
+
+	// parsers of the reassembled IP datagrams
+	ip4Parser *gopacket.DecodingLayerParser
+	ip6Parser *gopacket.DecodingLayerParser
+	defrag    *ipDefragmenter
+
+	// packets whose layers couldn't be decoded
+	errors uint64
+
 	sll     layers.LinuxSLL
+	sll2    linuxSLL2Layer
 	lo      layers.Loopback
+	rawip   rawIPLayer
+	nflog   nflogLayer
 	eth     layers.Ethernet
+	dot1q   dot1qLayer
+	mpls    mplsLayer
+	gre     layers.GRE
+	vxlan   layers.VXLAN
+	erspan  erspanLayer
 	ip4     layers.IPv4
 	ip6     layers.IPv6
+	ip6ext  ipv6ExtensionLayer
+	ip6frag ipv6FragmentLayer
 	tcp     layers.TCP
+	udp     layers.UDP
 	payload gopacket.Payload
 	decoded []gopacket.LayerType
 }
 
 func CreateDecoder(datalink layers.LinkType) (*DecoderStruct, error) {
 	var d DecoderStruct
+	var first gopacket.LayerType
 
 	logp.Debug("pcapread", "Layer type: %s", datalink.String())
 
 	switch datalink {
 
 	case layers.LinkTypeLinuxSLL:
-		d.Parser = gopacket.NewDecodingLayerParser(
-			layers.LayerTypeLinuxSLL,
-			&d.sll, &d.ip4, &d.ip6, &d.tcp, &d.payload)
+		first = layers.LayerTypeLinuxSLL
 
 	case layers.LinkTypeEthernet:
-		d.Parser = gopacket.NewDecodingLayerParser(
-			layers.LayerTypeEthernet,
-			&d.eth, &d.ip4, &d.ip6, &d.tcp, &d.payload)
+		first = layers.LayerTypeEthernet
 
 	case layers.LinkTypeNull: // loopback on OSx
-		d.Parser = gopacket.NewDecodingLayerParser(
-			layers.LayerTypeLoopback,
-			&d.lo, &d.ip4, &d.ip6, &d.tcp, &d.payload)
+		first = layers.LayerTypeLoopback
+
+	case layers.LinkTypeRaw, linkTypeDltRaw: // tun interfaces
+		first = layerTypeRawIP
+
+	case layers.LinkTypeIPv4:
+		first = layers.LayerTypeIPv4
+
+	case layers.LinkTypeIPv6:
+		first = layers.LayerTypeIPv6
+
+	case linkTypeNFLog:
+		first = layerTypeNFLog
+
+	case linkTypeLinuxSLL2:
+		first = layerTypeLinuxSLL2
 
 	default:
 		return nil, fmt.Errorf("Unsuported link type: %s", datalink.String())
 
 	}
 
+	// The VLAN tags and the tunnels are peeled to reach the innermost
+	// IP packet. The layers found more than once in a packet are
+	// decoded in the same struct, which keeps the innermost values.
+	decoders := []gopacket.DecodingLayer{
+		&d.sll, &d.sll2, &d.lo, &d.rawip, &d.nflog, &d.eth,
+		&d.dot1q, &d.mpls, &d.gre, &d.vxlan, &d.erspan,
+		&d.ip4, &d.ip6, &d.ip6ext, &d.ip6frag, &d.tcp, &d.udp, &d.payload,
+	}
+	d.Parser = gopacket.NewDecodingLayerParser(first, decoders...)
+	d.ip4Parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, decoders...)
+	d.ip6Parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, decoders...)
+	d.defrag = newIpDefragmenter()
+
 	d.decoded = []gopacket.LayerType{}
+	d.datalink = datalink
 
 	return &d, nil
 }
 
+// Returns the counters of the IP fragments reassembly.
+func (decoder *DecoderStruct) DefragStats() DefragStats {
+	return decoder.defrag.stats
+}
+
+// Returns the number of packets that couldn't be decoded.
+func (decoder *DecoderStruct) DecodingErrors() uint64 {
+	return decoder.errors
+}
+
+// Decodes the layers of the packet. The IP fragments are kept until
+// their datagram is complete, which is then decoded in place of the
+// packet. Returns false if there is nothing more to decode.
+func (decoder *DecoderStruct) decodeLayers(data []byte, ts time.Time) bool {
+	parser := decoder.Parser
+	for {
+		err := parser.DecodeLayers(data, &decoder.decoded)
+		if err != nil {
+			if _, unsupported := err.(gopacket.UnsupportedLayerType); !unsupported {
+				logp.Debug("pcapread", "Decoding error: %s", err)
+				decoder.errors++
+				return false
+			}
+			// the application layer is not decoded by gopacket, the
+			// payload is taken from the transport layer below
+		}
+		if len(decoder.decoded) == 0 {
+			return false
+		}
+
+		switch decoder.decoded[len(decoder.decoded)-1] {
+		case layers.LayerTypeIPv4:
+			if !isIPv4Fragment(&decoder.ip4) {
+				return true
+			}
+			data = decoder.defrag.addIPv4(&decoder.ip4, ts)
+			parser = decoder.ip4Parser
+
+		case layers.LayerTypeIPv6Fragment:
+			if decoder.ip6frag.NextLayerType() != gopacket.LayerTypeFragment {
+				return true
+			}
+			data = decoder.defrag.addIPv6(&decoder.ip6, &decoder.ip6frag, ts)
+			parser = decoder.ip6Parser
+
+		default:
+			return true
+		}
+
+		if data == nil {
+			// waiting for the other fragments
+			return false
+		}
+		logp.Debug("ipdefrag", "Reassembled datagram of %d bytes", len(data))
+	}
+}
+
 func (decoder *DecoderStruct) DecodePacketData(data []byte, ci *gopacket.CaptureInfo) {
 
-	var err error
 	var packet protos.Packet
 
-	err = decoder.Parser.DecodeLayers(data, &decoder.decoded)
-	if err != nil {
-		logp.Debug("pcapread", "Decoding error: %s", err)
+	decoder.dot1q.reset()
+	if !decoder.decodeLayers(data, ci.Timestamp) {
 		return
 	}
 
 	has_tcp := false
+	has_udp := false
 
 	for _, layerType := range decoder.decoded {
 		switch layerType {
@@ -303,27 +813,52 @@ func (decoder *DecoderStruct) DecodePacketData(data []byte, ci *gopacket.Capture
 
 			packet.Tuple.Src_port = uint16(decoder.tcp.SrcPort)
 			packet.Tuple.Dst_port = uint16(decoder.tcp.DstPort)
+			packet.Payload = decoder.tcp.Payload
 
 			has_tcp = true
+			has_udp = false
 
-		case gopacket.LayerTypePayload:
-			packet.Payload = decoder.payload
+		case layers.LayerTypeUDP:
+			logp.Debug("ip", "UDP packet")
+
+			packet.Tuple.Src_port = uint16(decoder.udp.SrcPort)
+			packet.Tuple.Dst_port = uint16(decoder.udp.DstPort)
+			packet.Payload = decoder.udp.Payload
+
+			// the UDP header of a VXLAN tunnel is followed by
+			// the transport layer of the inner packet
+			has_udp = true
+			has_tcp = false
 		}
 	}
 
-	if !has_tcp {
-		logp.Debug("pcapread", "No TCP header found in message")
+	if !has_tcp && !has_udp {
+		logp.Debug("pcapread", "No TCP or UDP header found in message")
 		return
 	}
 
-	if len(packet.Payload) == 0 && !decoder.tcp.FIN {
-		// We have no use for this atm.
-		logp.Debug("pcapread", "Ignore empty non-FIN packet")
+	packet.Ts = ci.Timestamp
+	packet.Frame = data
+	packet.Length = ci.Length
+	packet.Datalink = int(decoder.datalink)
+	packet.Tuple.Vlan = decoder.dot1q.outerVlan
+	packet.Tuple.Device = decoder.Device
+
+	packet.Tuple.ComputeHashebles()
+
+	if has_udp {
+		udp.ProcessUdp(&packet)
 		return
 	}
 
-	packet.Ts = ci.Timestamp
+	if len(packet.Payload) == 0 && !flowsEnabled &&
+		!decoder.tcp.FIN && !decoder.tcp.SYN && !decoder.tcp.RST &&
+		!isHandshakeAck(&decoder.tcp, &packet.Tuple) &&
+		!isFinAck(&decoder.tcp, &packet.Tuple) {
+		// Only the flow events need these.
+		logp.Debug("pcapread", "Ignore empty non-FIN packet")
+		return
+	}
 
-	packet.Tuple.ComputeHashebles()
 	FollowTcp(&decoder.tcp, &packet)
 }
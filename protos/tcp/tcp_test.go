@@ -1,10 +1,16 @@
 package tcp
 
 import (
+	"net"
+	"packetbeat/common"
 	"packetbeat/config"
+	"packetbeat/dumps"
 	"packetbeat/protos"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/packetbeat/gopacket/layers"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -61,6 +67,58 @@ func Test_configToPortsMap(t *testing.T) {
 	}
 }
 
+func Test_configToPortsMap_ranges(t *testing.T) {
+	output, err := configToPortsMap(map[string]config.Protocol{
+		"http":  config.Protocol{Ports: []int{80}, Port_ranges: []string{"8000-8002"}},
+		"mysql": config.Protocol{Port_ranges: []string{"3306-3306"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint16]protos.Protocol{
+		80:   protos.HttpProtocol,
+		8000: protos.HttpProtocol,
+		8001: protos.HttpProtocol,
+		8002: protos.HttpProtocol,
+		3306: protos.MysqlProtocol,
+	}, output)
+
+	_, err = configToPortsMap(map[string]config.Protocol{
+		"http":  config.Protocol{Port_ranges: []string{"8000-8100"}},
+		"mysql": config.Protocol{Ports: []int{8080}},
+	})
+	assert.NotNil(t, err)
+
+	_, err = configToPortsMap(map[string]config.Protocol{
+		"http": config.Protocol{Port_ranges: []string{"8100-8000"}},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestDecideProtocol_scope(t *testing.T) {
+	testSetup()
+	protocols := map[string]config.Protocol{
+		"http": config.Protocol{Ports: []int{80}, Networks: []string{"192.168.0.0/24"},
+			Exclude_hosts: []string{"192.168.0.3"}},
+	}
+	var err error
+	tcpScopes, err = protos.ConfigToAddressScopes(protocols)
+	assert.Nil(t, err)
+	defer func() { tcpScopes = nil }()
+
+	tuple := testPacket(34000, "", testTs).Tuple
+	assert.Equal(t, protos.HttpProtocol, decideProtocol(&tuple))
+
+	tuple.Dst_ip = net.IPv4(192, 168, 0, 3)
+	assert.Equal(t, protos.UnknownProtocol, decideProtocol(&tuple))
+
+	tuple = common.NewIpPortTuple(4,
+		net.IPv4(10, 0, 0, 1), 34000,
+		net.IPv4(10, 0, 0, 2), 80)
+	assert.Equal(t, protos.UnknownProtocol, decideProtocol(&tuple))
+
+	assert.Equal(t, "((port 80) and (net 192.168.0.0/24) and not (host 192.168.0.3))",
+		ConfigToFilter(protocols))
+}
+
 func Test_configToPortsMap_negative(t *testing.T) {
 
 	type errTest struct {
@@ -86,3 +144,653 @@ func Test_configToPortsMap_negative(t *testing.T) {
 		assert.Equal(t, test.Err, err.Error())
 	}
 }
+
+// Protocol plugin recording what the TCP layer passes to it.
+type testPlugin struct {
+	data    [2][]byte
+	gaps    [2]int
+	fins    [2]int
+	rsts    [2]int
+	expired int
+}
+
+func (p *testPlugin) Init(test_mode bool, results chan common.MapStr) error {
+	return nil
+}
+
+func (p *testPlugin) New(timers *protos.Timers) protos.ProtocolPlugin {
+	return &testPlugin{}
+}
+
+func (p *testPlugin) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+
+	p.data[dir] = append(p.data[dir], pkt.Payload...)
+	return private
+}
+
+func (p *testPlugin) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	p.fins[dir] += 1
+	return private
+}
+
+func (p *testPlugin) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	p.gaps[dir] += 1
+	return private
+}
+
+func (p *testPlugin) ReceivedRst(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	p.rsts[dir] += 1
+	return private
+}
+
+func (p *testPlugin) ConnectionExpired(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	p.expired += 1
+}
+
+var testTs = time.Date(2015, 3, 6, 12, 0, 0, 0, time.UTC)
+
+// Returns a worker that is not running, so the tests can pass it the
+// packets directly, together with its plugin instance.
+func testSetup() (*worker, *testPlugin) {
+	protos.Protos.Register(protos.HttpProtocol, &testPlugin{})
+	tcpPortMap = map[uint16]protos.Protocol{80: protos.HttpProtocol}
+	reassemblyMaxBytes = TCP_REASSEMBLY_MAX_BYTES
+	reassemblyTimeout = TCP_REASSEMBLY_TIMEOUT
+	streamExpiry = TCP_STREAM_EXPIRY
+	flowsEnabled = false
+	flowsAllPorts = false
+	results = nil
+	detectProtocols = false
+	detectMaxBytes = TCP_DETECT_MAX_BYTES
+	memoryBudget = TCP_MEMORY_BUDGET
+	memoryShare = TCP_MEMORY_BUDGET
+	memoryUsed = 0
+	evictedStreams = 0
+	evictedBytes = 0
+
+	w := newWorker()
+	return w, w.protos.Get(protos.HttpProtocol).(*testPlugin)
+}
+
+func testPacket(client_port uint16, payload string, ts time.Time) *protos.Packet {
+	return &protos.Packet{
+		Ts: ts,
+		Tuple: common.NewIpPortTuple(4,
+			net.IPv4(192, 168, 0, 1), client_port,
+			net.IPv4(192, 168, 0, 2), 80),
+		Payload: []byte(payload),
+	}
+}
+
+// Sends a client to server segment to the worker.
+func testSegment(w *worker, seq uint32, payload string, ts time.Time) {
+	w.followTcp(&layers.TCP{Seq: seq}, testPacket(34000, payload, ts))
+}
+
+func TestFollowTcp_outOfOrder(t *testing.T) {
+	w, plugin := testSetup()
+
+	testSegment(w, 1000, "GET ", testTs)
+	testSegment(w, 1008, "HTTP/1.1", testTs)
+	testSegment(w, 1006, "ab", testTs)
+	assert.Equal(t, "GET ", string(plugin.data[1]))
+
+	testSegment(w, 1004, "/ab ", testTs)
+	assert.Equal(t, "GET /ab HTTP/1.1", string(plugin.data[1]))
+	assert.Equal(t, 0, plugin.gaps[1])
+}
+
+func TestFollowTcp_partialRetransmission(t *testing.T) {
+	w, plugin := testSetup()
+
+	testSegment(w, 1000, "GET ", testTs)
+	testSegment(w, 1002, "T /index", testTs)
+	testSegment(w, 1000, "GET /in", testTs)
+	testSegment(w, 1010, "x", testTs)
+	assert.Equal(t, "GET /indexx", string(plugin.data[1]))
+}
+
+func TestFollowTcp_gapAfterByteLimit(t *testing.T) {
+	w, plugin := testSetup()
+	reassemblyMaxBytes = 8
+
+	testSegment(w, 1000, "GET ", testTs)
+	testSegment(w, 1010, "1234", testTs)
+	assert.Equal(t, 0, plugin.gaps[1])
+
+	testSegment(w, 1014, "56789", testTs)
+	assert.Equal(t, 1, plugin.gaps[1])
+	assert.Equal(t, "GET 123456789", string(plugin.data[1]))
+
+	// the stream continues after the gap
+	testSegment(w, 1019, "0", testTs)
+	assert.Equal(t, "GET 1234567890", string(plugin.data[1]))
+}
+
+func TestFollowTcp_gapAfterTimeout(t *testing.T) {
+	w, plugin := testSetup()
+
+	testSegment(w, 1000, "GET ", testTs)
+	testSegment(w, 1010, "1234", testTs)
+	testSegment(w, 1014, "5678", testTs.Add(TCP_REASSEMBLY_TIMEOUT/2))
+	assert.Equal(t, 0, plugin.gaps[1])
+
+	testSegment(w, 1018, "9", testTs.Add(TCP_REASSEMBLY_TIMEOUT+time.Millisecond))
+	assert.Equal(t, 1, plugin.gaps[1])
+	assert.Equal(t, "GET 123456789", string(plugin.data[1]))
+}
+
+func TestFollowTcp_gapWhenIdle(t *testing.T) {
+	w, plugin := testSetup()
+
+	w.timers.Advance(testTs)
+	testSegment(w, 1000, "GET ", testTs)
+	testSegment(w, 1010, "1234", testTs)
+
+	// no more packets on the stream, only the clock moves
+	w.timers.Advance(testTs.Add(TCP_REASSEMBLY_TIMEOUT / 2))
+	assert.Equal(t, 0, plugin.gaps[1])
+
+	w.timers.Advance(testTs.Add(TCP_REASSEMBLY_TIMEOUT))
+	assert.Equal(t, 1, plugin.gaps[1])
+	assert.Equal(t, "GET 1234", string(plugin.data[1]))
+}
+
+func TestFollowTcp_gapWhenExpired(t *testing.T) {
+	w, plugin := testSetup()
+	reassemblyTimeout = 2 * TCP_STREAM_EXPIRY
+
+	w.timers.Advance(testTs)
+	testSegment(w, 1000, "GET ", testTs)
+	testSegment(w, 1010, "1234", testTs)
+	testSegment(w, 1020, "5678", testTs)
+
+	// the buffered segments are passed before the expiry
+	w.timers.Advance(testTs.Add(TCP_STREAM_EXPIRY))
+	assert.Equal(t, 2, plugin.gaps[1])
+	assert.Equal(t, "GET 12345678", string(plugin.data[1]))
+	assert.Equal(t, 1, plugin.expired)
+	assert.Equal(t, 0, len(w.streams))
+}
+
+func TestWorkerIndex_symmetric(t *testing.T) {
+	for port := uint16(1000); port < 1100; port++ {
+		tuple := common.NewIpPortTuple(4,
+			net.IPv4(10, 0, 0, 1), port,
+			net.IPv4(10, 0, 0, 2), 80)
+		rev := common.NewIpPortTuple(4,
+			net.IPv4(10, 0, 0, 2), 80,
+			net.IPv4(10, 0, 0, 1), port)
+
+		assert.Equal(t, workerIndex(&tuple, 4), workerIndex(&rev, 4))
+	}
+}
+
+func TestFollowTcp_workers(t *testing.T) {
+	testSetup()
+	startWorkers(4)
+
+	for port := uint16(34000); port < 34100; port++ {
+		FollowTcp(&layers.TCP{Seq: 1000}, testPacket(port, "GET ", testTs))
+		FollowTcp(&layers.TCP{Seq: 1004}, testPacket(port, "/ HTTP/1.1", testTs))
+	}
+	Flush()
+
+	streams := 0
+	bytes := 0
+	for _, w := range workers {
+		streams += len(w.streams)
+		bytes += len(w.protos.Get(protos.HttpProtocol).(*testPlugin).data[1])
+	}
+	assert.Equal(t, 100, streams)
+	assert.Equal(t, 100*len("GET / HTTP/1.1"), bytes)
+}
+
+func TestFollowTcp_streamExpiry(t *testing.T) {
+	w, _ := testSetup()
+
+	w.timers.Advance(testTs)
+	testSegment(w, 1000, "GET ", testTs)
+	assert.Equal(t, 1, len(w.streams))
+
+	w.timers.Advance(testTs.Add(TCP_STREAM_EXPIRY / 2))
+	testSegment(w, 1004, "/ HTTP/1.1", testTs.Add(TCP_STREAM_EXPIRY/2))
+
+	// the timer was reset by the second packet
+	w.timers.Advance(testTs.Add(TCP_STREAM_EXPIRY))
+	assert.Equal(t, 1, len(w.streams))
+
+	w.timers.Advance(testTs.Add(TCP_STREAM_EXPIRY * 2))
+	assert.Equal(t, 0, len(w.streams))
+}
+
+func TestFollowTcp_reuseAfterRst(t *testing.T) {
+	w, plugin := testSetup()
+	events := testFlows(false)
+
+	testSegment(w, 1000, "GET ", testTs)
+	testSegment(w, 1010, "HTTP", testTs)
+	w.followTcp(&layers.TCP{Seq: 5000, RST: true}, testServerPacket("", testTs))
+	assert.Equal(t, [2]int{1, 0}, plugin.rsts)
+	assert.Equal(t, 0, len(w.streams))
+	assert.Equal(t, 1, len(events))
+
+	// a new connection on the same ports gets a new stream, the
+	// segments buffered for the previous one are dropped
+	ts := testTs.Add(time.Second)
+	w.followTcp(&layers.TCP{Seq: 2999, SYN: true}, testPacket(34000, "", ts))
+	testSegment(w, 3000, "GET /ab ", ts)
+	assert.Equal(t, "GET GET /ab ", string(plugin.data[1]))
+	assert.Equal(t, 1, len(w.streams))
+
+	w.followTcp(&layers.TCP{Seq: 5000, RST: true}, testServerPacket("", ts))
+	assert.Equal(t, [2]int{2, 0}, plugin.rsts)
+	assert.Equal(t, 2, len(events))
+	<-events
+	flow := (<-events)["flow"].(common.MapStr)
+	assert.Equal(t, common.Time(ts), flow["start"])
+	assert.Equal(t, 2, flow["client_packets"])
+}
+
+// Sends the packets of a connection closed by both sides.
+func testClosedConnection(w *worker, clientSeq, serverSeq uint32, ts time.Time) {
+	w.followTcp(&layers.TCP{Seq: clientSeq - 1, SYN: true}, testPacket(34000, "", ts))
+	w.followTcp(&layers.TCP{Seq: serverSeq - 1, SYN: true, ACK: true, Ack: clientSeq},
+		testServerPacket("", ts))
+	w.followTcp(&layers.TCP{Seq: clientSeq, ACK: true, Ack: serverSeq, FIN: true},
+		testPacket(34000, "GET ", ts))
+	w.followTcp(&layers.TCP{Seq: serverSeq, ACK: true, Ack: clientSeq + 5, FIN: true},
+		testServerPacket("", ts))
+	w.followTcp(&layers.TCP{Seq: clientSeq + 5, ACK: true, Ack: serverSeq + 1},
+		testPacket(34000, "", ts))
+}
+
+func TestFollowTcp_reuseAfterFin(t *testing.T) {
+	w, plugin := testSetup()
+	events := testFlows(false)
+
+	testClosedConnection(w, 1000, 5000, testTs)
+	assert.Equal(t, 0, len(w.streams))
+	assert.Equal(t, 1, plugin.expired)
+	assert.Equal(t, 1, len(events))
+
+	ts := testTs.Add(time.Second)
+	testClosedConnection(w, 3000, 7000, ts)
+	assert.Equal(t, 0, len(w.streams))
+	assert.Equal(t, 2, plugin.expired)
+	assert.Equal(t, "GET GET ", string(plugin.data[1]))
+	assert.Equal(t, 2, len(events))
+	<-events
+	flow := (<-events)["flow"].(common.MapStr)
+	assert.Equal(t, common.Time(ts), flow["start"])
+	assert.Equal(t, FlowClosedFin, flow["closed_by"])
+}
+
+func TestFollowTcp_reuseOnSyn(t *testing.T) {
+	w, plugin := testSetup()
+	events := testFlows(false)
+
+	w.followTcp(&layers.TCP{Seq: 999, SYN: true}, testPacket(34000, "", testTs))
+	// retransmission of the SYN of the stream
+	w.followTcp(&layers.TCP{Seq: 999, SYN: true}, testPacket(34000, "", testTs))
+	testSegment(w, 1000, "GET ", testTs)
+	assert.Equal(t, 0, len(events))
+
+	// the client reuses its port without the end of the previous
+	// connection being captured
+	ts := testTs.Add(time.Second)
+	w.followTcp(&layers.TCP{Seq: 2999, SYN: true}, testPacket(34000, "", ts))
+	testSegment(w, 3000, "GET /ab ", ts)
+	assert.Equal(t, 1, plugin.expired)
+	assert.Equal(t, "GET GET /ab ", string(plugin.data[1]))
+	assert.Equal(t, 1, len(w.streams))
+
+	assert.Equal(t, 1, len(events))
+	flow := (<-events)["flow"].(common.MapStr)
+	assert.Equal(t, FlowClosedReused, flow["closed_by"])
+}
+
+func TestFollowTcp_streamTimeout(t *testing.T) {
+	w, _ := testSetup()
+	streamExpiry = time.Minute
+
+	w.timers.Advance(testTs)
+	testSegment(w, 1000, "GET ", testTs)
+	w.timers.Advance(testTs.Add(TCP_STREAM_EXPIRY * 2))
+	assert.Equal(t, 1, len(w.streams))
+
+	w.timers.Advance(testTs.Add(time.Minute))
+	assert.Equal(t, 0, len(w.streams))
+}
+
+func TestFollowTcp_connectionExpired(t *testing.T) {
+	w, plugin := testSetup()
+
+	w.timers.Advance(testTs)
+	testSegment(w, 1000, "GET ", testTs)
+	w.timers.Advance(testTs.Add(TCP_STREAM_EXPIRY / 2))
+	assert.Equal(t, 0, plugin.expired)
+
+	w.timers.Advance(testTs.Add(TCP_STREAM_EXPIRY * 2))
+	assert.Equal(t, 1, plugin.expired)
+}
+
+func TestFollowTcp_memoryBudget(t *testing.T) {
+	w, plugin := testSetup()
+	memoryBudget = 100
+	memoryShare = 100
+
+	// 40 bytes buffered for reassembly in each stream
+	buffer := func(port uint16) {
+		w.followTcp(&layers.TCP{Seq: 1000}, testPacket(port, "GET ", testTs))
+		w.followTcp(&layers.TCP{Seq: 1100}, testPacket(port, strings.Repeat("x", 40), testTs))
+	}
+	buffer(34000)
+	buffer(34001)
+	assert.Equal(t, 2, len(w.streams))
+	assert.Equal(t, int64(80), GetMemoryStats().Used)
+
+	// a packet makes its stream the most recently used, the other one
+	// is evicted
+	w.followTcp(&layers.TCP{Seq: 1004}, testPacket(34000, "/", testTs))
+	buffer(34002)
+	assert.Equal(t, 2, len(w.streams))
+	_, exists := w.streams[testPacket(34001, "", testTs).Tuple.Hashable()]
+	assert.False(t, exists)
+	assert.Equal(t, 1, plugin.expired)
+	assert.Equal(t, MemoryStats{Budget: 100, Used: 80, EvictedStreams: 1, EvictedBytes: 40},
+		GetMemoryStats())
+
+	// expired streams release their memory
+	w.timers.Advance(testTs)
+	w.timers.Advance(testTs.Add(TCP_STREAM_EXPIRY * 2))
+	assert.Equal(t, 0, len(w.streams))
+	assert.Equal(t, int64(0), GetMemoryStats().Used)
+}
+
+func TestFollowTcp_handshake(t *testing.T) {
+	w, plugin := testSetup()
+
+	client := testPacket(34000, "", testTs)
+	server := testPacket(34000, "", testTs)
+	server.Tuple = common.NewIpPortTuple(4,
+		net.IPv4(192, 168, 0, 2), 80,
+		net.IPv4(192, 168, 0, 1), 34000)
+
+	w.followTcp(&layers.TCP{Seq: 999, SYN: true}, client)
+	server.Ts = testTs.Add(2 * time.Millisecond)
+	w.followTcp(&layers.TCP{Seq: 4999, SYN: true, ACK: true}, server)
+	ack := testPacket(34000, "", testTs.Add(3*time.Millisecond))
+	w.followTcp(&layers.TCP{Seq: 1000, ACK: true}, ack)
+	w.followTcp(&layers.TCP{Seq: 1000, ACK: true},
+		testPacket(34000, "GET ", testTs.Add(3*time.Millisecond)))
+
+	assert.Equal(t, "GET ", string(plugin.data[TcpDirectionOriginal]))
+
+	stream := w.streams[client.Tuple.Hashable()]
+	h := stream.tcptuple.Handshake
+	assert.Equal(t, testTs, h.Syn)
+	assert.Equal(t, 2*time.Millisecond, h.SynAck.Sub(h.Syn))
+	assert.Equal(t, 3*time.Millisecond, h.Ack.Sub(h.Syn))
+}
+
+func TestFollowTcp_packetRing(t *testing.T) {
+	w, _ := testSetup()
+	dumps.Triggered.RingSize = 2
+	defer func() { dumps.Triggered.RingSize = 0 }()
+
+	for i, payload := range []string{"GET ", "/ HTTP/1.1", "\r\n"} {
+		pkt := testPacket(34000, payload, testTs.Add(time.Duration(i)*time.Millisecond))
+		pkt.Frame = []byte(payload)
+		pkt.Length = 54 + len(payload)
+		pkt.Datalink = 1
+		w.followTcp(&layers.TCP{Seq: 1000 + uint32(4*i)}, pkt)
+	}
+
+	stream := w.streams[testPacket(34000, "", testTs).Tuple.Hashable()]
+	frames := stream.tcptuple.Packets.Frames()
+	assert.Equal(t, stream.id, frames.Stream)
+	assert.Equal(t, 2, len(frames.Frames))
+	assert.Equal(t, "/ HTTP/1.1", string(frames.Frames[0].Data))
+	assert.Equal(t, 56, frames.Frames[1].Length)
+
+	// the frames count in the memory budget
+	assert.True(t, GetMemoryStats().Used >= 12)
+}
+
+func TestFollowTcp_directionFromSynAck(t *testing.T) {
+	w, plugin := testSetup()
+
+	// the SYN was missed
+	server := testPacket(34000, "", testTs)
+	server.Tuple = common.NewIpPortTuple(4,
+		net.IPv4(192, 168, 0, 2), 80,
+		net.IPv4(192, 168, 0, 1), 34000)
+	w.followTcp(&layers.TCP{Seq: 4999, SYN: true, ACK: true}, server)
+	w.followTcp(&layers.TCP{Seq: 1000, ACK: true}, testPacket(34000, "GET ", testTs))
+
+	assert.Equal(t, "GET ", string(plugin.data[TcpDirectionOriginal]))
+	stream := w.streams[server.Tuple.RevHashable()]
+	assert.Equal(t, uint16(80), stream.tcptuple.Dst_port)
+}
+
+func TestFollowTcp_directionFromPorts(t *testing.T) {
+	w, plugin := testSetup()
+
+	// the capture starts with a response
+	server := testPacket(34000, "HTTP/1.1 200 OK", testTs)
+	server.Tuple = common.NewIpPortTuple(4,
+		net.IPv4(192, 168, 0, 2), 80,
+		net.IPv4(192, 168, 0, 1), 34000)
+	w.followTcp(&layers.TCP{Seq: 5000}, server)
+
+	assert.Equal(t, "HTTP/1.1 200 OK", string(plugin.data[TcpDirectionReverse]))
+	stream := w.streams[server.Tuple.RevHashable()]
+	assert.Nil(t, stream.tcptuple.Handshake)
+}
+
+func TestIsHandshakeAck(t *testing.T) {
+	testSetup()
+	startWorkers(1)
+
+	server := testPacket(34000, "", testTs)
+	server.Tuple = common.NewIpPortTuple(4,
+		net.IPv4(192, 168, 0, 2), 80,
+		net.IPv4(192, 168, 0, 1), 34000)
+	FollowTcp(&layers.TCP{SYN: true, ACK: true}, server)
+	Flush()
+
+	client := testPacket(34000, "", testTs)
+	assert.True(t, isHandshakeAck(&layers.TCP{ACK: true}, &client.Tuple))
+	assert.False(t, isHandshakeAck(&layers.TCP{ACK: true}, &client.Tuple))
+}
+
+func TestIsFinAck(t *testing.T) {
+	testSetup()
+	startWorkers(1)
+
+	client := testPacket(34000, "", testTs)
+	FollowTcp(&layers.TCP{ACK: true, FIN: true}, client)
+	Flush()
+
+	server := testServerPacket("", testTs)
+	assert.False(t, isFinAck(&layers.TCP{ACK: true}, &client.Tuple))
+	assert.True(t, isFinAck(&layers.TCP{ACK: true}, &server.Tuple))
+	assert.False(t, isFinAck(&layers.TCP{ACK: true}, &server.Tuple))
+}
+
+// Returns a packet from the server of the test connection.
+func testServerPacket(payload string, ts time.Time) *protos.Packet {
+	pkt := testPacket(34000, payload, ts)
+	pkt.Tuple = common.NewIpPortTuple(4,
+		net.IPv4(192, 168, 0, 2), 80,
+		net.IPv4(192, 168, 0, 1), 34000)
+	return pkt
+}
+
+func testFlows(allPorts bool) chan common.MapStr {
+	flowsEnabled = true
+	flowsAllPorts = allPorts
+	results = make(chan common.MapStr, 10)
+	return results
+}
+
+func TestFlows_closedByFin(t *testing.T) {
+	w, _ := testSetup()
+	events := testFlows(false)
+
+	w.followTcp(&layers.TCP{Seq: 999, SYN: true}, testPacket(34000, "", testTs))
+	w.followTcp(&layers.TCP{Seq: 4999, SYN: true, ACK: true},
+		testServerPacket("", testTs.Add(time.Millisecond)))
+	w.followTcp(&layers.TCP{Seq: 1000, ACK: true},
+		testPacket(34000, "GET / HTTP/1.1", testTs.Add(2*time.Millisecond)))
+	// retransmission
+	w.followTcp(&layers.TCP{Seq: 1000, ACK: true},
+		testPacket(34000, "GET / HTTP/1.1", testTs.Add(3*time.Millisecond)))
+	w.followTcp(&layers.TCP{Seq: 5000, ACK: true, FIN: true},
+		testServerPacket("HTTP/1.1 200 OK", testTs.Add(4*time.Millisecond)))
+	assert.Equal(t, 0, len(events))
+
+	w.followTcp(&layers.TCP{Seq: 1014, ACK: true, FIN: true},
+		testPacket(34000, "", testTs.Add(5*time.Millisecond)))
+	assert.Equal(t, 1, len(events))
+
+	event := <-events
+	assert.Equal(t, "flow", event["type"])
+	assert.Equal(t, common.Time(testTs), event["@timestamp"])
+	assert.Equal(t, "192.168.0.1", event["src"].(*common.Endpoint).Ip)
+	assert.Equal(t, uint16(80), event["dst"].(*common.Endpoint).Port)
+
+	flow := event["flow"].(common.MapStr)
+	assert.Equal(t, int64(5000), flow["duration"])
+	assert.Equal(t, "http", flow["protocol"])
+	assert.Equal(t, 4, flow["client_packets"])
+	assert.Equal(t, 28, flow["client_bytes"])
+	assert.Equal(t, 2, flow["server_packets"])
+	assert.Equal(t, 15, flow["server_bytes"])
+	assert.Equal(t, 1, flow["retransmissions"])
+	assert.Equal(t, 0, flow["gaps"])
+	assert.Equal(t, FlowClosedFin, flow["closed_by"])
+
+	// published only once
+	w.followTcp(&layers.TCP{Seq: 5016, ACK: true},
+		testServerPacket("", testTs.Add(6*time.Millisecond)))
+	w.timers.Advance(testTs.Add(TCP_STREAM_EXPIRY * 2))
+	assert.Equal(t, 0, len(events))
+}
+
+func TestFlows_closedByRst(t *testing.T) {
+	w, _ := testSetup()
+	events := testFlows(false)
+
+	w.followTcp(&layers.TCP{Seq: 1000}, testPacket(34000, "GET ", testTs))
+	w.followTcp(&layers.TCP{Seq: 5000, RST: true}, testServerPacket("", testTs))
+
+	assert.Equal(t, 1, len(events))
+	flow := (<-events)["flow"].(common.MapStr)
+	assert.Equal(t, FlowClosedRst, flow["closed_by"])
+}
+
+func TestFlows_expired(t *testing.T) {
+	w, _ := testSetup()
+	events := testFlows(false)
+
+	w.timers.Advance(testTs)
+	w.followTcp(&layers.TCP{Seq: 1000}, testPacket(34000, "GET ", testTs))
+	w.timers.Advance(testTs.Add(TCP_STREAM_EXPIRY * 2))
+
+	assert.Equal(t, 1, len(events))
+	flow := (<-events)["flow"].(common.MapStr)
+	assert.Equal(t, FlowClosedTimeout, flow["closed_by"])
+}
+
+func TestFlows_allPorts(t *testing.T) {
+	w, _ := testSetup()
+	events := testFlows(true)
+
+	pkt := testPacket(34000, "SSH-2.0", testTs)
+	pkt.Tuple = common.NewIpPortTuple(4,
+		net.IPv4(192, 168, 0, 1), 34000,
+		net.IPv4(192, 168, 0, 2), 22)
+	w.followTcp(&layers.TCP{Seq: 1000}, pkt)
+	w.followTcp(&layers.TCP{Seq: 1007, RST: true}, pkt)
+
+	assert.Equal(t, 1, len(events))
+	flow := (<-events)["flow"].(common.MapStr)
+	assert.Equal(t, "unknown", flow["protocol"])
+	assert.Equal(t, 2, flow["client_packets"])
+}
+
+// Plugin recognizing the payloads starting with "TEST".
+type testDetector struct {
+	testPlugin
+}
+
+func (p *testDetector) New(timers *protos.Timers) protos.ProtocolPlugin {
+	return &testDetector{}
+}
+
+func (p *testDetector) Detect(payload []byte, dir uint8) bool {
+	return len(payload) >= 4 && string(payload[:4]) == "TEST"
+}
+
+func testDetectSetup() (*worker, *testDetector) {
+	testSetup()
+	protos.Protos.Register(protos.HttpProtocol, &testDetector{})
+	detectProtocols = true
+	detectMaxBytes = 16
+
+	w := newWorker()
+	return w, w.protos.Get(protos.HttpProtocol).(*testDetector)
+}
+
+func testUnknownPortPacket(payload string, dir uint8) *protos.Packet {
+	pkt := testPacket(34000, payload, testTs)
+	if dir == TcpDirectionOriginal {
+		pkt.Tuple = common.NewIpPortTuple(4,
+			net.IPv4(192, 168, 0, 1), 34000,
+			net.IPv4(192, 168, 0, 2), 8888)
+	} else {
+		pkt.Tuple = common.NewIpPortTuple(4,
+			net.IPv4(192, 168, 0, 2), 8888,
+			net.IPv4(192, 168, 0, 1), 34000)
+	}
+	return pkt
+}
+
+func TestFollowTcp_detectProtocol(t *testing.T) {
+	w, plugin := testDetectSetup()
+
+	w.followTcp(&layers.TCP{Seq: 1000}, testUnknownPortPacket("hello", TcpDirectionOriginal))
+	w.followTcp(&layers.TCP{Seq: 5000}, testUnknownPortPacket("TE", TcpDirectionReverse))
+	assert.Equal(t, 0, len(plugin.data[0])+len(plugin.data[1]))
+
+	w.followTcp(&layers.TCP{Seq: 5002}, testUnknownPortPacket("ST 1", TcpDirectionReverse))
+	assert.Equal(t, "hello", string(plugin.data[TcpDirectionOriginal]))
+	assert.Equal(t, "TEST 1", string(plugin.data[TcpDirectionReverse]))
+
+	w.followTcp(&layers.TCP{Seq: 1005}, testUnknownPortPacket(" world", TcpDirectionOriginal))
+	assert.Equal(t, "hello world", string(plugin.data[TcpDirectionOriginal]))
+}
+
+func TestFollowTcp_detectProtocolBudget(t *testing.T) {
+	w, plugin := testDetectSetup()
+
+	w.followTcp(&layers.TCP{Seq: 1000}, testUnknownPortPacket("0123456789", TcpDirectionOriginal))
+	w.followTcp(&layers.TCP{Seq: 1010}, testUnknownPortPacket("0123456789", TcpDirectionOriginal))
+	w.followTcp(&layers.TCP{Seq: 1020}, testUnknownPortPacket("TEST", TcpDirectionOriginal))
+
+	assert.Equal(t, 0, len(plugin.data[TcpDirectionOriginal]))
+	stream := w.streams[testUnknownPortPacket("", TcpDirectionOriginal).Tuple.Hashable()]
+	assert.Equal(t, protos.UnknownProtocol, stream.protocol)
+	assert.False(t, stream.detecting)
+}
@@ -0,0 +1,208 @@
+package tcp
+
+import (
+	"container/list"
+	"hash/fnv"
+	"packetbeat/common"
+	"packetbeat/logp"
+	"packetbeat/protos"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/packetbeat/gopacket/layers"
+)
+
+// Number of packets that can be queued for a worker before the
+// packet reader blocks.
+const TCP_WORKER_QUEUE_SIZE = 4096
+
+// Interval at which the clock of all the workers is advanced, even of
+// those that don't receive packets.
+const TCP_TICK_INTERVAL = time.Second
+
+// A packet queued for a worker. A packet with the flushed field set
+// carries no data, it only marks the point up to which the queue
+// was processed. A packet without data nor flushed field only
+// advances the clock of the worker to ts.
+type tcpPacket struct {
+	tcphdr  layers.TCP
+	pkt     *protos.Packet
+	ts      time.Time
+	flushed *sync.WaitGroup
+}
+
+// A worker follows the TCP streams that hash to it. It owns its streams
+// table and its own instances of the protocol plugins, and runs their
+// timers on the same goroutine, so none of this state is shared. The
+// timers are advanced by the timestamps of the packets.
+type worker struct {
+	streams map[common.HashableIpPortTuple]*TcpStream
+	protos  protos.Protocols
+	timers  *protos.Timers
+	queue   chan tcpPacket
+
+	// streams by last packet, oldest first, and the bytes they hold
+	lru    *list.List
+	memory int
+}
+
+var workers []*worker
+
+// time of the last clock tick sent to the workers
+var lastTick time.Time
+
+// Client to server tuples of the connections for which the SYN-ACK was
+// seen, with its capture time. The ACK completing their handshake is
+// passed to the workers even if it carries no data.
+var pendingAcks = make(map[common.HashableIpPortTuple]time.Time)
+
+// Tuples of the connections for which a FIN was seen, in the direction
+// of its ACK, with its capture time. The ACK is passed to the workers
+// even if it carries no data, as it completes the close of the stream.
+var pendingFinAcks = make(map[common.HashableIpPortTuple]time.Time)
+
+func newWorker() *worker {
+	timers := protos.NewTimers()
+	return &worker{
+		streams: make(map[common.HashableIpPortTuple]*TcpStream, TCP_STREAM_HASH_SIZE),
+		protos:  protos.Protos.New(timers),
+		timers:  timers,
+		queue:   make(chan tcpPacket, TCP_WORKER_QUEUE_SIZE),
+		lru:     list.New(),
+	}
+}
+
+func (w *worker) run() {
+	for p := range w.queue {
+		switch {
+		case p.flushed != nil:
+			p.flushed.Done()
+
+		case p.pkt == nil:
+			w.timers.Advance(p.ts)
+
+		default:
+			w.timers.Advance(p.pkt.Ts)
+			w.followTcp(&p.tcphdr, p.pkt)
+		}
+	}
+}
+
+// Creates the workers and starts their goroutines. The protocol
+// plugins must be registered before.
+func startWorkers(count int) {
+	workers = make([]*worker, count)
+	lastTick = time.Time{}
+	pendingAcks = make(map[common.HashableIpPortTuple]time.Time)
+	pendingFinAcks = make(map[common.HashableIpPortTuple]time.Time)
+	memoryShare = memoryBudget / int64(count)
+	atomic.StoreInt64(&memoryUsed, 0)
+	for i := range workers {
+		workers[i] = newWorker()
+		go workers[i].run()
+	}
+	logp.Debug("tcp", "Started %d TCP workers", count)
+}
+
+// Returns the index of the worker handling the stream of the given
+// tuple. Both directions of a stream get the same index.
+func workerIndex(tuple *common.IpPortTuple, count int) int {
+	key := tuple.Hashable()
+	rev := tuple.RevHashable()
+	for i := range key {
+		if key[i] != rev[i] {
+			if rev[i] < key[i] {
+				key = rev
+			}
+			break
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write(key[:])
+	return int(h.Sum32() % uint32(count))
+}
+
+// Passes a TCP packet to the worker owning its stream. The TCP header
+// is copied, so the decoder can reuse it for the next packet.
+func FollowTcp(tcphdr *layers.TCP, pkt *protos.Packet) {
+	if pkt.Ts.Sub(lastTick) >= TCP_TICK_INTERVAL {
+		Tick(pkt.Ts)
+	}
+
+	if tcphdr.SYN && tcphdr.ACK {
+		pendingAcks[pkt.Tuple.RevHashable()] = pkt.Ts
+	}
+	if tcphdr.FIN {
+		pendingFinAcks[pkt.Tuple.RevHashable()] = pkt.Ts
+	}
+
+	w := workers[workerIndex(&pkt.Tuple, len(workers))]
+	w.queue <- tcpPacket{tcphdr: *tcphdr, pkt: pkt}
+}
+
+// Advances the clock of all the workers, expiring the streams and the
+// transactions that timed out. The packet reader calls it when no
+// packets arrive for a while.
+func Tick(now time.Time) {
+	lastTick = now
+
+	for tuple, ts := range pendingAcks {
+		if now.Sub(ts) > streamExpiry {
+			delete(pendingAcks, tuple)
+		}
+	}
+	for tuple, ts := range pendingFinAcks {
+		if now.Sub(ts) > streamExpiry {
+			delete(pendingFinAcks, tuple)
+		}
+	}
+
+	for _, w := range workers {
+		w.queue <- tcpPacket{ts: now}
+	}
+}
+
+// Moves the clock of the workers past the expiry of all the streams and
+// waits for them, so that the streams and the transactions expire
+// without waiting for more packets.
+func ExpireAll() {
+	Tick(lastTick.Add(2 * streamExpiry))
+	Flush()
+}
+
+// Returns true if the packet is the ACK completing a handshake.
+func isHandshakeAck(tcphdr *layers.TCP, tuple *common.IpPortTuple) bool {
+	if !tcphdr.ACK || tcphdr.SYN {
+		return false
+	}
+	_, exists := pendingAcks[tuple.Hashable()]
+	if exists {
+		delete(pendingAcks, tuple.Hashable())
+	}
+	return exists
+}
+
+// Returns true if the packet is the ACK of a FIN.
+func isFinAck(tcphdr *layers.TCP, tuple *common.IpPortTuple) bool {
+	if !tcphdr.ACK || tcphdr.FIN {
+		return false
+	}
+	_, exists := pendingFinAcks[tuple.Hashable()]
+	if exists {
+		delete(pendingFinAcks, tuple.Hashable())
+	}
+	return exists
+}
+
+// Waits until the workers processed all the packets passed to
+// FollowTcp before the call.
+func Flush() {
+	var flushed sync.WaitGroup
+	flushed.Add(len(workers))
+	for _, w := range workers {
+		w.queue <- tcpPacket{flushed: &flushed}
+	}
+	flushed.Wait()
+}
@@ -77,7 +77,7 @@ type ThriftTransaction struct {
 	Request *ThriftMessage
 	Reply   *ThriftMessage
 
-	timer *time.Timer
+	timer *protos.Timer
 }
 
 const (
@@ -150,7 +150,9 @@ type Thrift struct {
 	TransportType byte
 	ProtocolType  byte
 
-	transMap map[common.HashableTcpTuple]*ThriftTransaction
+	transMap           map[common.HashableTcpTuple]*ThriftTransaction
+	timers             *protos.Timers
+	transactionTimeout time.Duration
 
 	PublishQueue chan *ThriftTransaction
 	results      chan common.MapStr
@@ -237,6 +239,8 @@ func (thrift *Thrift) Init(test_mode bool, results chan common.MapStr) error {
 	}
 
 	thrift.transMap = make(map[common.HashableTcpTuple]*ThriftTransaction, TransactionsHashSize)
+	thrift.timers = protos.NewTimers()
+	thrift.transactionTimeout = protos.ThriftProtocol.TransactionTimeout(TransactionTimeout)
 
 	if !test_mode {
 		thrift.PublishQueue = make(chan *ThriftTransaction, 1000)
@@ -247,6 +251,34 @@ func (thrift *Thrift) Init(test_mode bool, results chan common.MapStr) error {
 	return nil
 }
 
+func (thrift *Thrift) New(timers *protos.Timers) protos.ProtocolPlugin {
+	instance := *thrift
+	instance.transMap = make(map[common.HashableTcpTuple]*ThriftTransaction, TransactionsHashSize)
+	instance.timers = timers
+	return &instance
+}
+
+// Detect recognizes a call in the strict binary protocol, which is the
+// default of the clients.
+func (thrift *Thrift) Detect(payload []byte, dir uint8) bool {
+	if thrift.TransportType == ThriftTFramed {
+		if len(payload) < 4 {
+			return false
+		}
+		payload = payload[4:]
+	}
+	if len(payload) < 4 {
+		return false
+	}
+
+	sz := common.Bytes_Ntohl(payload[:4])
+	if sz&^ThriftTypeMask != ThriftVersion1 {
+		return false
+	}
+	msgType := sz & ThriftTypeMask
+	return msgType == ThriftMsgTypeCall || msgType == ThriftMsgTypeOneway
+}
+
 func (m *ThriftMessage) String() string {
 	return fmt.Sprintf("IsRequest: %t Type: %d Method: %s SeqId: %d Params: %s ReturnValue: %s Exceptions: %s",
 		m.IsRequest, m.Type, m.Method, m.SeqId, m.Params, m.ReturnValue, m.Exceptions)
@@ -940,7 +972,7 @@ func (thrift *Thrift) receivedRequest(msg *ThriftMessage) {
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
-	trans.timer = time.AfterFunc(TransactionTimeout, func() { thrift.expireTransaction(trans) })
+	trans.timer = thrift.timers.AfterFunc(thrift.transactionTimeout, func() { thrift.expireTransaction(trans) })
 
 }
 
@@ -979,10 +1011,67 @@ func (thrift *Thrift) receivedReply(msg *ThriftMessage) {
 func (thrift *Thrift) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	private protos.ProtocolData) protos.ProtocolData {
 
+	thrift.flushRequest(tcptuple)
+	return private
+}
+
+func (thrift *Thrift) ReceivedRst(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	thrift.flushRequest(tcptuple)
+	return nil
+}
+
+func (thrift *Thrift) ConnectionExpired(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	thrift.flushRequest(tcptuple)
+}
+
+// Returns the bytes buffered for the stream and held by its transaction.
+func (thrift *Thrift) StreamMemory(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) int {
+
+	size := 0
+	if priv, ok := private.(thriftPrivateData); ok {
+		for _, stream := range priv.Data {
+			if stream != nil {
+				size += len(stream.data)
+			}
+		}
+	}
+	trans := thrift.transMap[tcptuple.Hashable()]
+	if trans != nil {
+		size += protos.TransactionOverhead
+		for _, msg := range []*ThriftMessage{trans.Request, trans.Reply} {
+			if msg != nil {
+				size += len(msg.Params) + len(msg.ReturnValue) + len(msg.Exceptions)
+			}
+		}
+	}
+	return size
+}
+
+// Drops the pending transaction of the evicted stream.
+func (thrift *Thrift) DropStream(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+
+	trans := thrift.transMap[tcptuple.Hashable()]
+	if trans != nil {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		delete(thrift.transMap, tcptuple.Hashable())
+	}
+}
+
+// Publishes the request without a reply of a closing connection. It
+// is assumed to be one way.
+func (thrift *Thrift) flushRequest(tcptuple *common.TcpTuple) {
 	trans := thrift.transMap[tcptuple.Hashable()]
 	if trans != nil {
 		if trans.Request != nil && trans.Reply == nil {
-			logp.Debug("thrift", "FIN and had only one transaction. Assuming one way")
+			logp.Debug("thrift", "Connection closed and had only one transaction. Assuming one way")
 			thrift.PublishQueue <- trans
 			delete(thrift.transMap, trans.tuple.Hashable())
 			if trans.timer != nil {
@@ -990,8 +1079,6 @@ func (thrift *Thrift) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 			}
 		}
 	}
-
-	return private
 }
 
 func (thrift *Thrift) GapInStream(tcptuple *common.TcpTuple, dir uint8,
@@ -1013,6 +1100,7 @@ func (thrift *Thrift) publishTransactions() {
 			event["status"] = common.OK_STATUS
 		}
 		event["responsetime"] = t.ResponseTime
+		t.tuple.AddFields(event)
 		thriftmap := common.MapStr{}
 
 		if t.Request != nil {
@@ -1053,3 +1053,23 @@ func TestThrift_ExceptionName(t *testing.T) {
 		t.Error("Bad result:", trans)
 	}
 }
+
+func TestThrift_Detect(t *testing.T) {
+	var thrift Thrift
+	thrift.InitDefaults()
+
+	call, _ := hex.DecodeString("800100010000000470696e670000000000")
+	if !thrift.Detect(call, 1) {
+		t.Error("Call not detected")
+	}
+	reply, _ := hex.DecodeString("800100020000000470696e670000000000")
+	if thrift.Detect(reply, 0) {
+		t.Error("Reply detected as a call")
+	}
+
+	thrift.TransportType = ThriftTFramed
+	framed, _ := hex.DecodeString("00000011800100010000000470696e670000000000")
+	if !thrift.Detect(framed, 1) || thrift.Detect(call, 1) {
+		t.Error("Framed call not detected")
+	}
+}
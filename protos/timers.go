@@ -0,0 +1,154 @@
+package protos
+
+import "time"
+
+// Granularity of the timers and number of slots in the wheel. A timer
+// further in the future than a full turn of the wheel stays in its slot
+// until the turn in which it is due.
+const (
+	TimersResolution = 100 * time.Millisecond
+	TimersWheelSize  = 1024
+)
+
+// Timers is a timing wheel driven by the timestamps of the captured
+// packets instead of the wall clock, so that the TCP streams and the
+// protocol transactions expire the same way when reading a trace file,
+// at any speed, as they did when the trace was captured live.
+//
+// Timers is not safe for concurrent use. The owner of the state handled
+// by the callbacks calls Advance from its own goroutine and the due
+// callbacks are executed from there.
+type Timers struct {
+	now   time.Time
+	wheel [][]*Timer
+}
+
+type Timer struct {
+	timers   *Timers
+	deadline time.Time
+	f        func()
+
+	// position in the wheel, slot is -1 when the timer isn't scheduled
+	slot int
+	pos  int
+
+	// set by Stop, a due timer stopped by another callback of the same
+	// slot is not in the wheel anymore but must not fire
+	stopped bool
+}
+
+func NewTimers() *Timers {
+	return &Timers{wheel: make([][]*Timer, TimersWheelSize)}
+}
+
+func tickOf(ts time.Time) int64 {
+	return ts.UnixNano() / int64(TimersResolution)
+}
+
+func slotOf(tick int64) int {
+	slot := tick % TimersWheelSize
+	if slot < 0 {
+		slot += TimersWheelSize
+	}
+	return int(slot)
+}
+
+// Now returns the time of the last call to Advance.
+func (timers *Timers) Now() time.Time {
+	return timers.now
+}
+
+// AfterFunc calls f from Advance once the time moved d past the current
+// time of the wheel.
+func (timers *Timers) AfterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{timers: timers, deadline: timers.now.Add(d), f: f}
+	timers.add(t)
+	return t
+}
+
+func (timers *Timers) add(t *Timer) {
+	t.slot = slotOf(tickOf(t.deadline))
+	t.pos = len(timers.wheel[t.slot])
+	timers.wheel[t.slot] = append(timers.wheel[t.slot], t)
+}
+
+func (timers *Timers) remove(t *Timer) {
+	slot := timers.wheel[t.slot]
+	last := len(slot) - 1
+	slot[t.pos] = slot[last]
+	slot[t.pos].pos = t.pos
+	slot[last] = nil
+	timers.wheel[t.slot] = slot[:last]
+	t.slot = -1
+}
+
+// Advance moves the time of the wheel to now and runs the callbacks of
+// the timers that are due, in no particular order. The time never goes
+// backwards, older timestamps are ignored.
+func (timers *Timers) Advance(now time.Time) {
+	if !now.After(timers.now) {
+		return
+	}
+
+	if timers.now.IsZero() {
+		// The timers created before the first packet are relative
+		// to the zero time, move them to the actual clock.
+		timers.rebase(now)
+		return
+	}
+
+	from := tickOf(timers.now)
+	to := tickOf(now)
+	if to-from >= TimersWheelSize {
+		from = to - TimersWheelSize + 1
+	}
+	timers.now = now
+
+	for tick := from; tick <= to; tick++ {
+		timers.expireSlot(slotOf(tick))
+	}
+}
+
+func (timers *Timers) expireSlot(slot int) {
+	var due []*Timer
+	for i := 0; i < len(timers.wheel[slot]); {
+		t := timers.wheel[slot][i]
+		if t.deadline.After(timers.now) {
+			i++
+			continue
+		}
+		timers.remove(t)
+		due = append(due, t)
+	}
+
+	for _, t := range due {
+		if t.stopped {
+			continue
+		}
+		t.f()
+	}
+}
+
+func (timers *Timers) rebase(now time.Time) {
+	var pending []*Timer
+	for slot := range timers.wheel {
+		pending = append(pending, timers.wheel[slot]...)
+		timers.wheel[slot] = nil
+	}
+
+	timers.now = now
+	for _, t := range pending {
+		t.deadline = now.Add(t.deadline.Sub(time.Time{}))
+		timers.add(t)
+	}
+}
+
+// Stop prevents the timer from firing. It does nothing if the timer
+// already fired or was stopped.
+func (t *Timer) Stop() {
+	t.stopped = true
+	if t.slot < 0 {
+		return
+	}
+	t.timers.remove(t)
+}
@@ -0,0 +1,117 @@
+package protos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTs = time.Date(2015, 3, 6, 12, 0, 0, 0, time.UTC)
+
+func TestTimers_packetTime(t *testing.T) {
+	timers := NewTimers()
+	timers.Advance(testTs)
+
+	fired := 0
+	timers.AfterFunc(10*time.Second, func() { fired++ })
+
+	timers.Advance(testTs.Add(9 * time.Second))
+	assert.Equal(t, 0, fired)
+
+	timers.Advance(testTs.Add(10 * time.Second))
+	assert.Equal(t, 1, fired)
+
+	timers.Advance(testTs.Add(20 * time.Second))
+	assert.Equal(t, 1, fired)
+}
+
+func TestTimers_stop(t *testing.T) {
+	timers := NewTimers()
+	timers.Advance(testTs)
+
+	fired := false
+	timer := timers.AfterFunc(time.Second, func() { fired = true })
+	timers.AfterFunc(time.Second, func() {})
+	timer.Stop()
+	timer.Stop()
+
+	timers.Advance(testTs.Add(2 * time.Second))
+	assert.False(t, fired)
+}
+
+func TestTimers_stopFromCallback(t *testing.T) {
+	timers := NewTimers()
+	timers.Advance(testTs)
+
+	// both timers are due in the same slot, whichever fires first stops
+	// the other one
+	fired := 0
+	var first, second *Timer
+	first = timers.AfterFunc(time.Second, func() { fired++; second.Stop() })
+	second = timers.AfterFunc(time.Second, func() { fired++; first.Stop() })
+
+	timers.Advance(testTs.Add(2 * time.Second))
+	assert.Equal(t, 1, fired)
+}
+
+func TestTimers_timeGoesBackwards(t *testing.T) {
+	timers := NewTimers()
+	timers.Advance(testTs)
+
+	fired := false
+	timers.AfterFunc(time.Second, func() { fired = true })
+
+	timers.Advance(testTs.Add(-time.Hour))
+	assert.Equal(t, testTs, timers.Now())
+	assert.False(t, fired)
+}
+
+func TestTimers_longerThanWheel(t *testing.T) {
+	timers := NewTimers()
+	timers.Advance(testTs)
+
+	d := 2 * TimersWheelSize * TimersResolution
+	fired := false
+	timers.AfterFunc(d, func() { fired = true })
+
+	// go around the wheel once in small steps
+	for ts := testTs; ts.Before(testTs.Add(d / 2)); ts = ts.Add(time.Second) {
+		timers.Advance(ts)
+	}
+	assert.False(t, fired)
+
+	timers.Advance(testTs.Add(d))
+	assert.True(t, fired)
+}
+
+func TestTimers_beforeFirstAdvance(t *testing.T) {
+	timers := NewTimers()
+
+	fired := false
+	timers.AfterFunc(time.Second, func() { fired = true })
+
+	timers.Advance(testTs)
+	assert.False(t, fired)
+
+	timers.Advance(testTs.Add(time.Second))
+	assert.True(t, fired)
+}
+
+func TestTimers_scheduleFromCallback(t *testing.T) {
+	timers := NewTimers()
+	timers.Advance(testTs)
+
+	fired := 0
+	var again func()
+	again = func() {
+		fired++
+		timers.AfterFunc(time.Second, again)
+	}
+	timers.AfterFunc(time.Second, again)
+
+	timers.Advance(testTs.Add(time.Second))
+	assert.Equal(t, 1, fired)
+	timers.Advance(testTs.Add(2 * time.Second))
+	assert.Equal(t, 2, fired)
+}
@@ -0,0 +1,127 @@
+package udp
+
+import (
+	"packetbeat/common"
+	"packetbeat/config"
+	"packetbeat/logp"
+	"packetbeat/protos"
+	"strings"
+	"time"
+)
+
+// Config
+
+var udpPortMap map[uint16]protos.Protocol
+var udpScopes protos.AddressScopes
+
+// Instances of the protocol plugins parsing the datagrams and their
+// timers. They are only used from the goroutine decoding the packets.
+var plugins protos.Protocols
+var timers = protos.NewTimers()
+
+func decideProtocol(tuple *common.IpPortTuple) protos.Protocol {
+	protocol, exists := udpPortMap[tuple.Src_port]
+	if !exists {
+		protocol, exists = udpPortMap[tuple.Dst_port]
+	}
+	if !exists || !udpScopes.Contains(protocol, tuple) {
+		return protos.UnknownProtocol
+	}
+
+	return protocol
+}
+
+// Passes a datagram to the plugin of the protocol running on its ports.
+func ProcessUdp(pkt *protos.Packet) {
+	timers.Advance(pkt.Ts)
+
+	protocol := decideProtocol(&pkt.Tuple)
+	if protocol == protos.UnknownProtocol {
+		logp.Debug("udp", "Ignoring datagram on ports %d and %d",
+			pkt.Tuple.Src_port, pkt.Tuple.Dst_port)
+		return
+	}
+
+	plugin := plugins.GetUdp(protocol)
+	if plugin == nil {
+		logp.Debug("udp", "Ignoring protocol for which we have no UDP module loaded: %s", protocol)
+		return
+	}
+	plugin.ParseUdp(pkt)
+}
+
+// Advances the clock of the UDP plugins, expiring their transactions
+// that timed out. The packet reader calls it when no packets arrive for
+// a while.
+func Tick(now time.Time) {
+	timers.Advance(now)
+}
+
+// Returns the ports of the protocols whose plugin handles UDP. The
+// duplicates and the invalid ports are reported by the TCP port map,
+// built from the same configuration.
+func configToPortsMap(protocols map[string]config.Protocol) map[uint16]protos.Protocol {
+	var res = map[uint16]protos.Protocol{}
+
+	var proto protos.Protocol
+	for proto = protos.UnknownProtocol + 1; int(proto) < len(protos.ProtocolNames); proto++ {
+		if protos.Protos.GetUdp(proto) == nil {
+			continue
+		}
+
+		protoConfig, exists := protocols[protos.ProtocolNames[proto]]
+		if !exists {
+			continue
+		}
+
+		ranges, _ := protos.ConfigToPortRanges(protoConfig)
+		for _, r := range ranges {
+			for port := int(r.First); port <= int(r.Last); port++ {
+				res[uint16(port)] = proto
+			}
+		}
+	}
+
+	return res
+}
+
+func ConfigToFilter(protocols map[string]config.Protocol) string {
+	res := []string{}
+
+	var proto protos.Protocol
+	for proto = protos.UnknownProtocol + 1; int(proto) < len(protos.ProtocolNames); proto++ {
+		if protos.Protos.GetUdp(proto) == nil {
+			continue
+		}
+
+		protoConfig, exists := protocols[protos.ProtocolNames[proto]]
+		if !exists {
+			continue
+		}
+
+		ranges, _ := protos.ConfigToPortRanges(protoConfig)
+		scope, _ := protos.ConfigToAddressScope(protoConfig)
+		filter := protos.ProtocolFilter("udp", ranges, scope)
+		if len(filter) > 0 {
+			res = append(res, filter)
+		}
+	}
+
+	return strings.Join(res, " or ")
+}
+
+func UdpInit(protocols map[string]config.Protocol) error {
+	var err error
+	udpPortMap = configToPortsMap(protocols)
+	udpScopes, err = protos.ConfigToAddressScopes(protocols)
+	if err != nil {
+		return err
+	}
+
+	logp.Debug("udp", "Port map: %v", udpPortMap)
+
+	timers = protos.NewTimers()
+	plugins = protos.Protos.New(timers)
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package udp
+
+import (
+	"net"
+	"packetbeat/common"
+	"packetbeat/config"
+	"packetbeat/protos"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Protocol plugin handling only TCP.
+type testTcpPlugin struct{}
+
+func (p *testTcpPlugin) Init(test_mode bool, results chan common.MapStr) error {
+	return nil
+}
+
+func (p *testTcpPlugin) New(timers *protos.Timers) protos.ProtocolPlugin {
+	return &testTcpPlugin{}
+}
+
+func (p *testTcpPlugin) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+func (p *testTcpPlugin) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+func (p *testTcpPlugin) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+func (p *testTcpPlugin) ReceivedRst(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+func (p *testTcpPlugin) ConnectionExpired(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+}
+
+// Protocol plugin recording the datagrams passed to it.
+type testUdpPlugin struct {
+	testTcpPlugin
+	datagrams []*protos.Packet
+}
+
+func (p *testUdpPlugin) New(timers *protos.Timers) protos.ProtocolPlugin {
+	return &testUdpPlugin{}
+}
+
+func (p *testUdpPlugin) ParseUdp(pkt *protos.Packet) {
+	p.datagrams = append(p.datagrams, pkt)
+}
+
+var testProtocols = map[string]config.Protocol{
+	"http":  config.Protocol{Ports: []int{5353, 53}},
+	"mysql": config.Protocol{Ports: []int{3306}},
+}
+
+func testSetup(t *testing.T) *testUdpPlugin {
+	protos.Protos.Register(protos.HttpProtocol, &testUdpPlugin{})
+	protos.Protos.Register(protos.MysqlProtocol, &testTcpPlugin{})
+
+	assert.Nil(t, UdpInit(testProtocols))
+	return plugins.GetUdp(protos.HttpProtocol).(*testUdpPlugin)
+}
+
+func testDatagram(src_port uint16, dst_port uint16) *protos.Packet {
+	return &protos.Packet{
+		Ts: time.Now(),
+		Tuple: common.NewIpPortTuple(4,
+			net.IPv4(192, 168, 0, 1), src_port,
+			net.IPv4(192, 168, 0, 2), dst_port),
+		Payload: []byte("datagram"),
+	}
+}
+
+func Test_configToPortsMap(t *testing.T) {
+	testSetup(t)
+
+	assert.Equal(t, map[uint16]protos.Protocol{
+		53:   protos.HttpProtocol,
+		5353: protos.HttpProtocol,
+	}, configToPortsMap(testProtocols))
+}
+
+func TestConfigToFilter(t *testing.T) {
+	testSetup(t)
+
+	assert.Equal(t, "udp port 53 or udp port 5353", ConfigToFilter(testProtocols))
+}
+
+func TestUdpInit_invalidScope(t *testing.T) {
+	err := UdpInit(map[string]config.Protocol{
+		"http": config.Protocol{Ports: []int{53}, Hosts: []string{"not-an-ip"}},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestProcessUdp(t *testing.T) {
+	plugin := testSetup(t)
+
+	ProcessUdp(testDatagram(34000, 53))
+	ProcessUdp(testDatagram(53, 34000))
+	assert.Equal(t, 2, len(plugin.datagrams))
+
+	// ports of a protocol without UDP support and unknown ports
+	ProcessUdp(testDatagram(34000, 3306))
+	ProcessUdp(testDatagram(34000, 34001))
+	assert.Equal(t, 2, len(plugin.datagrams))
+}
@@ -0,0 +1,18 @@
+from pbtests.packetbeat import TestCase
+
+
+class Test(TestCase):
+
+    def test_keep_timestamps(self):
+        """
+        With -T, the events have the timestamps of the packets in
+        the pcap file instead of the time they were read.
+        """
+        self.render_config_template()
+        self.run_packetbeat(pcap="http_minitwit.pcap",
+                            extra_args=["-T"])
+        objs = self.read_output()
+
+        assert len(objs) == 3
+        assert all([o["@timestamp"].startswith("2013-07-22T16:29:")
+                    for o in objs])